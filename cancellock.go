@@ -0,0 +1,98 @@
+package nntp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strings"
+)
+
+// Cancel-Lock schemes (RFC 8315).
+const (
+	CancelLockSHA1   = "sha1"
+	CancelLockSHA256 = "sha256"
+)
+
+// ErrUnknownCancelScheme is returned for a Cancel-Lock or Cancel-Key
+// scheme other than sha1 or sha256.
+var ErrUnknownCancelScheme = errors.New("unknown Cancel-Lock scheme")
+
+func cancelHash(scheme string) (func() hash.Hash, error) {
+	switch strings.ToLower(scheme) {
+	case CancelLockSHA1:
+		return sha1.New, nil
+	case CancelLockSHA256:
+		return sha256.New, nil
+	}
+	return nil, ErrUnknownCancelScheme
+}
+
+// CancelKey returns a Cancel-Key element (e.g. "sha256:...") for the
+// article with message ID msgid.  The key is derived from a secret
+// known only to the poster and the poster's user name, as recommended
+// by RFC 8315 section 4, so it needn't be stored anywhere.
+func CancelKey(scheme string, secret []byte, uid, msgid string) (string, error) {
+	h, err := cancelHash(scheme)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(h, secret)
+	mac.Write([]byte(uid + msgid))
+	return strings.ToLower(scheme) + ":" +
+		base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// CancelLock returns the Cancel-Lock element opened by the Cancel-Key
+// element CancelKey returns for the same arguments.  Add it to the
+// Cancel-Lock header of an article before posting it.
+func CancelLock(scheme string, secret []byte, uid, msgid string) (string, error) {
+	key, err := CancelKey(scheme, secret, uid, msgid)
+	if err != nil {
+		return "", err
+	}
+	return LockForKey(key)
+}
+
+// LockForKey returns the Cancel-Lock element opened by a Cancel-Key
+// element.
+func LockForKey(key string) (string, error) {
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) != 2 {
+		return "", ErrUnknownCancelScheme
+	}
+	h, err := cancelHash(parts[0])
+	if err != nil {
+		return "", err
+	}
+	sum := h()
+	sum.Write([]byte(parts[1]))
+	return strings.ToLower(parts[0]) + ":" +
+		base64.StdEncoding.EncodeToString(sum.Sum(nil)), nil
+}
+
+// VerifyCancelKey reports whether any element of a Cancel-Key header
+// value opens any element of a Cancel-Lock header value.  Elements with
+// unknown schemes are ignored.
+func VerifyCancelKey(lock, key string) bool {
+	for _, k := range strings.Fields(key) {
+		opened, err := LockForKey(k)
+		if err != nil {
+			continue
+		}
+		for _, l := range strings.Fields(lock) {
+			parts := strings.SplitN(l, ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			l = strings.ToLower(parts[0]) + ":" + parts[1]
+			if subtle.ConstantTimeCompare([]byte(l), []byte(opened)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
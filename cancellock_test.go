@@ -0,0 +1,38 @@
+package nntp
+
+import "testing"
+
+func TestCancelLock(t *testing.T) {
+	secret := []byte("sekrit")
+	for _, scheme := range []string{CancelLockSHA1, CancelLockSHA256} {
+		lock, err := CancelLock(scheme, secret, "user", "<a@b>")
+		if err != nil {
+			t.Fatalf("Error making %s lock: %v", scheme, err)
+		}
+		key, err := CancelKey(scheme, secret, "user", "<a@b>")
+		if err != nil {
+			t.Fatalf("Error making %s key: %v", scheme, err)
+		}
+		if !VerifyCancelKey("sha1:bogus= "+lock, key) {
+			t.Errorf("%s key %q doesn't open lock %q", scheme, key, lock)
+		}
+		other, _ := CancelKey(scheme, secret, "user", "<c@d>")
+		if VerifyCancelKey(lock, other) {
+			t.Errorf("%s key for another article opened %q", scheme, lock)
+		}
+	}
+	if _, err := CancelKey("md5", secret, "", "<a@b>"); err != ErrUnknownCancelScheme {
+		t.Errorf("Expected unknown scheme error, got %v", err)
+	}
+}
+
+func TestCancelLockRFC8315(t *testing.T) {
+	// Example from RFC 8315 section 2.2.
+	lock, err := LockForKey("sha1:aaaBBBcccDDDeeeFFF")
+	if err != nil {
+		t.Fatalf("Error computing lock: %v", err)
+	}
+	if lock != "sha1:bNXHc6ohSmeHaRHHW56BIWZJt+4=" {
+		t.Errorf("Lock = %q", lock)
+	}
+}
@@ -226,6 +226,69 @@ func (c *Client) Post(r io.Reader) error {
 	return err
 }
 
+// IHave offers the article with the given message ID to a peer, and
+// sends it if the peer wants it.
+//
+// The reader should contain the entire article, headers and body in
+// RFC822ish format.  If the peer doesn't want the article or refuses
+// it, the *textproto.Error returned carries the response code (435, 436
+// or 437).
+func (c *Client) IHave(id string, r io.Reader) error {
+	_, _, err := c.Command("IHAVE "+id, 335)
+	if err != nil {
+		return err
+	}
+	return c.sendArticle(r, 235)
+}
+
+// ModeStream switches the connection to streaming mode (RFC 4644), for
+// use with Check and TakeThis.
+func (c *Client) ModeStream() error {
+	_, _, err := c.Command("MODE STREAM", 203)
+	return err
+}
+
+// Check asks a peer in streaming mode whether it wants the article with
+// the given message ID.  A peer asking to be offered the article later
+// (431) results in an error.
+func (c *Client) Check(id string) (bool, error) {
+	code, _, err := c.Command("CHECK "+id, -1)
+	if err != nil {
+		return false, err
+	}
+	switch code {
+	case 238:
+		return true, nil
+	case 438:
+		return false, nil
+	}
+	return false, &textproto.Error{Code: code, Msg: "CHECK " + id}
+}
+
+// TakeThis sends the article with the given message ID to a peer in
+// streaming mode.  If the peer rejects it, the *textproto.Error
+// returned has the code 439.
+func (c *Client) TakeThis(id string, r io.Reader) error {
+	err := c.conn.PrintfLine("TAKETHIS %s", id)
+	if err != nil {
+		return err
+	}
+	return c.sendArticle(r, 239)
+}
+
+func (c *Client) sendArticle(r io.Reader, expectCode int) error {
+	w := c.conn.DotWriter()
+	_, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	_, _, err = c.conn.ReadCodeLine(expectCode)
+	return err
+}
+
 // Command sends a low-level command and get a response.
 //
 // This will return an error if the code doesn't match the expectCode
@@ -12,13 +12,14 @@ import (
 	"net"
 	"net/textproto"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/dustin/go-nntp"
+	"github.com/dustin/go-nntp/htpasswd"
 	"github.com/dustin/go-nntp/server"
 
 	"github.com/dustin/go-couch"
@@ -26,10 +27,18 @@ import (
 
 var groupCacheTimeout = flag.Int("groupTimeout", 300,
 	"Time (in seconds), group cache is valid")
+var cacheSize = flag.Int64("cacheSize", 64,
+	"Size (in megabytes) of the article and overview cache")
 var optimisticPost = flag.Bool("optimistic", false,
 	"Optimistically return success on store before storing")
 var useSyslog = flag.Bool("syslog", false,
 	"Log to syslog")
+var pathIdentity = flag.String("pathid", "",
+	"Path identity of this server (default: hostname)")
+var passwdFile = flag.String("htpasswd", "",
+	"File of users allowed to authenticate (default: none)")
+var useStdio = flag.Bool("stdio", false,
+	"Serve one session on stdin and stdout, e.g. from inetd")
 
 type groupRow struct {
 	Group string        `json:"key"`
@@ -73,10 +82,14 @@ type article struct {
 
 // Supply mandatory headers if not present already.
 //
-// * RFC1036/5536 say required headers are From, Date, Newsgroups, Subject,
-//   Message-ID and Path.
-// * RFC5537 says client may omit Message-ID, Date and Path when posting.
-// * RFC5537 mentions Injection-Date, too, but not as mandatory.
+// Articles posted through this server get these headers from the
+// injector at posting time; this only papers over articles stored before
+// the injector was in place.
+//
+//   - RFC1036/5536 say required headers are From, Date, Newsgroups, Subject,
+//     Message-ID and Path.
+//   - RFC5537 says client may omit Message-ID, Date and Path when posting.
+//   - RFC5537 mentions Injection-Date, too, but not as mandatory.
 //
 // textproto.MIMEHeader.Get could have been used rather than direct map access
 // to perform case-insensitive fetches. But since this depends on
@@ -102,6 +115,13 @@ type article struct {
 //
 // These are treated as defaults and will only be added if needed.
 func (ar *article) addMandatoryHeaders() {
+	// Injected or relayed articles carry these; only ones stored before
+	// the injector was in place lack Path and Injection-Date both.
+	h := textproto.MIMEHeader(ar.Headers)
+	if h.Get("Path") != "" || h.Get("Injection-Date") != "" {
+		return
+	}
+
 	defaults := make(textproto.MIMEHeader)
 
 	// RFC5536 says this should be a RFC5322 date. RFC822Z will suffice.
@@ -131,37 +151,27 @@ type articleResults struct {
 }
 
 type couchBackend struct {
-	db        *couch.Database
-	groups    map[string]*nntp.Group
-	grouplock sync.Mutex
-}
-
-func (cb *couchBackend) clearGroups() {
-	cb.grouplock.Lock()
-	defer cb.grouplock.Unlock()
+	db       *couch.Database
+	numberer *nntpserver.Numberer
 
-	log.Printf("Dumping group cache")
-	cb.groups = nil
+	mu sync.Mutex
+	// The names of the groups last fetched, so posting needn't
+	// query the view.
+	known map[string]bool
 }
 
-func (cb *couchBackend) fetchGroups() error {
-	cb.grouplock.Lock()
-	defer cb.grouplock.Unlock()
-
-	if cb.groups != nil {
-		return nil
-	}
-
-	log.Printf("Filling group cache")
-
+// fetchGroups loads the active groups.  The server wraps the backend in
+// an nntpserver.Cache, so this only happens once per groupTimeout.
+func (cb *couchBackend) fetchGroups() (map[string]*nntp.Group, error) {
 	results := groupResults{}
 	err := cb.db.Query("_design/groups/_view/active", map[string]interface{}{
 		"group": true,
 	}, &results)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	cb.groups = make(map[string]*nntp.Group)
+	groups := make(map[string]*nntp.Group)
+	known := make(map[string]bool)
 	for _, gr := range results.Rows {
 		if gr.Value[0].(string) != "" {
 			group := nntp.Group{
@@ -172,38 +182,63 @@ func (cb *couchBackend) fetchGroups() error {
 				High:        int64(gr.Value[3].(float64)),
 				Posting:     nntp.PostingPermitted,
 			}
-			cb.groups[group.Name] = &group
+			cb.numberer.Seed(group.Name, group.High)
+			groups[group.Name] = cb.current(&group)
+			known[group.Name] = true
 		}
 	}
+	cb.mu.Lock()
+	cb.known = known
+	cb.mu.Unlock()
+	return groups, nil
+}
 
-	go func() {
-		time.Sleep(time.Duration(*groupCacheTimeout) * time.Second)
-		cb.clearGroups()
-	}()
+// isGroup reports whether the named group exists, fetching the groups
+// again only if it isn't known.
+func (cb *couchBackend) isGroup(name string) (bool, error) {
+	cb.mu.Lock()
+	ok := cb.known[name]
+	cb.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+	groups, err := cb.fetchGroups()
+	if err != nil {
+		return false, err
+	}
+	_, ok = groups[name]
+	return ok, nil
+}
 
-	return nil
+// current returns a copy of a group, brought up to date with the
+// articles numbered since the view was last indexed.
+func (cb *couchBackend) current(g *nntp.Group) *nntp.Group {
+	rv := *g
+	if high := cb.numberer.High(g.Name); high > rv.High {
+		rv.Count += high - rv.High
+		rv.High = high
+	}
+	return &rv
 }
 
 func (cb *couchBackend) ListGroups(max int) ([]*nntp.Group, error) {
-	if cb.groups == nil {
-		if err := cb.fetchGroups(); err != nil {
-			return nil, err
-		}
+	groups, err := cb.fetchGroups()
+	if err != nil {
+		return nil, err
 	}
-	rv := make([]*nntp.Group, 0, len(cb.groups))
-	for _, g := range cb.groups {
+	rv := make([]*nntp.Group, 0, len(groups))
+	for _, g := range groups {
 		rv = append(rv, g)
 	}
 	return rv, nil
 }
 
 func (cb *couchBackend) GetGroup(name string) (*nntp.Group, error) {
-	if cb.groups == nil {
-		if err := cb.fetchGroups(); err != nil {
-			return nil, err
-		}
+	groups, err := cb.fetchGroups()
+	if err != nil {
+		return nil, err
 	}
-	g, exists := cb.groups[name]
+	g, exists := groups[name]
 	if !exists {
 		return nil, nntpserver.ErrNoSuchGroup
 	}
@@ -249,6 +284,11 @@ func (cb *couchBackend) GetArticle(group *nntp.Group, id string) (*nntp.Article,
 	return cb.mkArticle(ar), nil
 }
 
+func (cb *couchBackend) HasArticle(id string) (bool, error) {
+	var ar article
+	return cb.db.Retrieve(cleanupID(id, false), &ar) == nil, nil
+}
+
 func (cb *couchBackend) GetArticles(group *nntp.Group,
 	from, to int64) ([]nntpserver.NumberedArticle, error) {
 
@@ -311,16 +351,22 @@ func (cb *couchBackend) Post(art *nntp.Article) error {
 
 	a.Attachments["article"] = &attachment{"text/plain", b}
 
-	for _, g := range strings.Split(art.Header.Get("Newsgroups"), ",") {
-		g = strings.TrimSpace(g)
-		group, err := cb.GetGroup(g)
-		if err == nil {
-			a.Nums[g] = atomic.AddInt64(&group.High, 1)
-			atomic.AddInt64(&group.Count, 1)
+	groups := []string{}
+	for _, g := range nntpserver.SplitGroups(art.Header.Get("Newsgroups")) {
+		ok, err := cb.isGroup(g)
+		if err != nil {
+			log.Printf("Error getting groups: %v", err)
+			return nntpserver.ErrPostingFailed
+		}
+		if ok {
+			groups = append(groups, g)
 		} else {
-			log.Printf("Error getting group %q:  %v", g, err)
+			log.Printf("No such group %q", g)
 		}
 	}
+	for _, x := range cb.numberer.Number(art, groups) {
+		a.Nums[x.Group] = x.Num
+	}
 
 	if len(a.Nums) == 0 {
 		log.Printf("Found no matching groups in %v",
@@ -375,11 +421,11 @@ func main() {
 		log.SetFlags(0)
 	}
 
-	a, err := net.ResolveTCPAddr("tcp", ":1119")
-	maybefatal(err, "Error resolving listener: %v", err)
-	l, err := net.ListenTCP("tcp", a)
-	maybefatal(err, "Error setting up listener: %v", err)
-	defer l.Close()
+	var err error
+	if *pathIdentity == "" {
+		*pathIdentity, err = os.Hostname()
+		maybefatal(err, "Can't determine hostname: %v", err)
+	}
 
 	db, err := couch.Connect(*couchURL)
 	maybefatal(err, "Can't connect to the couch: %v", err)
@@ -387,14 +433,39 @@ func main() {
 	maybefatal(err, "Error setting up views: %v", err)
 
 	backend := couchBackend{
-		db: &db,
+		db:       &db,
+		numberer: nntpserver.NewNumberer(*pathIdentity),
+	}
+
+	cache := nntpserver.NewCache(&backend,
+		time.Duration(*groupCacheTimeout)*time.Second, *cacheSize<<20)
+
+	s := nntpserver.NewServer(cache)
+	if *passwdFile != "" {
+		users, err := htpasswd.Open(*passwdFile)
+		maybefatal(err, "Error loading users: %v", err)
+		s.Authenticator = users
 	}
+	s.Injector = nntpserver.NewInjector(*pathIdentity)
 
-	s := nntpserver.NewServer(&backend)
+	if *useStdio {
+		s.Process(nntpserver.StdioConn())
+		return
+	}
 
-	for {
-		c, err := l.AcceptTCP()
-		maybefatal(err, "Error accepting connection: %v", err)
-		go s.Process(c)
+	listeners, err := nntpserver.SystemdListeners()
+	maybefatal(err, "Error using systemd's sockets: %v", err)
+	if len(listeners) == 0 {
+		l, err := net.Listen("tcp", ":1119")
+		maybefatal(err, "Error setting up listener: %v", err)
+		listeners = append(listeners, l)
+	}
+	for _, l := range listeners[1:] {
+		go func(l net.Listener) {
+			err := s.Serve(l)
+			maybefatal(err, "Error accepting connection: %v", err)
+		}(l)
 	}
+	err = s.Serve(listeners[0])
+	maybefatal(err, "Error accepting connection: %v", err)
 }
@@ -16,3 +16,19 @@ func TestJSONMarshalling(t *testing.T) {
 	}
 	t.Logf("Marshalled to %v", string(b))
 }
+
+func TestMandatoryHeaders(t *testing.T) {
+	injected := article{MsgID: "a", Headers: map[string][]string{
+		"Path": {"news.example.com!not-for-mail"}, "Subject": {"hi"},
+	}}
+	injected.addMandatoryHeaders()
+	if _, ok := injected.Headers["From"]; ok {
+		t.Errorf("Headers made up for an injected article: %v", injected.Headers)
+	}
+
+	legacy := article{MsgID: "b", Headers: map[string][]string{"Subject": {"hi"}}}
+	legacy.addMandatoryHeaders()
+	if _, ok := legacy.Headers["From"]; !ok || legacy.Headers["Subject"][0] != "hi" {
+		t.Errorf("Legacy article headers: %v", legacy.Headers)
+	}
+}
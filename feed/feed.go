@@ -0,0 +1,392 @@
+// Package feed sends the articles a news server accepts on to its
+// peers, making it a transit node.
+//
+// A Manager is handed each accepted article (see
+// nntpserver.Server.AcceptHook), decides which peers should get it from
+// their newsgroup and distribution patterns and the article's Path, and
+// queues its message ID on disk for each of them.  One goroutine per
+// peer then fetches queued articles from the backend and offers them
+// with IHAVE, or with CHECK and TAKETHIS when streaming, retrying with
+// exponential backoff while the peer is unreachable.
+//
+// Delivery is at least once: an article whose sending was interrupted,
+// e.g. by a crash, is offered again, and the peer's duplicate check
+// turns it down.
+package feed
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-nntp"
+	"github.com/dustin/go-nntp/client"
+	"github.com/dustin/go-nntp/server"
+)
+
+// A Peer is a server articles are fed to.
+type Peer struct {
+	// Name is the peer's path identity.  Articles whose Path already
+	// lists it are not sent, and it names the peer's queue file.
+	Name string
+	// Addr is the peer's host:port.
+	Addr string
+	// Groups is a wildmat selecting the articles to send: one posted
+	// to any matching group is sent.  Patterns starting with "@"
+	// poison the article instead, so it isn't sent if posted to any
+	// group matching them.
+	Groups string
+	// Distributions, if set, is a wildmat an article's Distribution
+	// must match for it to be sent.  Articles without a Distribution
+	// are always sent.
+	Distributions string
+	// Streaming offers articles with CHECK and TAKETHIS instead of
+	// IHAVE.
+	Streaming bool
+	// Dial, if set, connects to the peer instead of a plain TCP
+	// connection to Addr, e.g. to use TLS or authenticate.
+	Dial func() (*nntpclient.Client, error)
+}
+
+// Wants reports whether the peer should be sent the given article.
+func (p *Peer) Wants(article *nntp.Article) bool {
+	for _, hop := range strings.Split(article.Header.Get("Path"), "!") {
+		if strings.TrimSpace(hop) == p.Name {
+			return false
+		}
+	}
+
+	if p.Distributions != "" {
+		dists := nntpserver.SplitGroups(article.Header.Get("Distribution"))
+		matched := len(dists) == 0
+		for _, d := range dists {
+			if nntp.MatchWildmat(p.Distributions, d) {
+				matched = true
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	wanted, poison := []string{}, []string{}
+	for _, pat := range strings.Split(p.Groups, ",") {
+		pat = strings.TrimSpace(pat)
+		if strings.HasPrefix(pat, "@") {
+			poison = append(poison, pat[1:])
+		} else {
+			wanted = append(wanted, pat)
+		}
+	}
+	rv := false
+	for _, g := range nntpserver.SplitGroups(article.Header.Get("Newsgroups")) {
+		if len(poison) > 0 && nntp.MatchWildmat(strings.Join(poison, ","), g) {
+			return false
+		}
+		if nntp.MatchWildmat(strings.Join(wanted, ","), g) {
+			rv = true
+		}
+	}
+	return rv
+}
+
+func (p *Peer) dial() (*nntpclient.Client, error) {
+	if p.Dial != nil {
+		return p.Dial()
+	}
+	return nntpclient.New("tcp", p.Addr)
+}
+
+type peerFeed struct {
+	*Peer
+	q      *queue
+	client *nntpclient.Client
+}
+
+// A Manager feeds accepted articles to peers.
+type Manager struct {
+	// Backend is where queued articles are fetched from by message ID.
+	Backend nntpserver.Backend
+	// PathIdentity is prepended to the Path of articles as they are
+	// sent, if it isn't there already.
+	PathIdentity string
+	// RetryMin and RetryMax bound the backoff between attempts to
+	// reach an unavailable peer.
+	RetryMin, RetryMax time.Duration
+	// Logger receives the Manager's log output.  If nil, the log
+	// package's standard logger is used.
+	Logger *log.Logger
+
+	peers []*peerFeed
+}
+
+// NewManager builds a Manager feeding the given peers, with their
+// queues kept in dir.
+func NewManager(b nntpserver.Backend, pathIdentity, dir string, peers []*Peer) (*Manager, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		Backend:      b,
+		PathIdentity: pathIdentity,
+		RetryMin:     time.Second,
+		RetryMax:     5 * time.Minute,
+	}
+	for _, p := range peers {
+		q, err := openQueue(filepath.Join(dir, p.Name))
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.peers = append(m.peers, &peerFeed{Peer: p, q: q})
+	}
+	return m, nil
+}
+
+func (m *Manager) logf(format string, args ...interface{}) {
+	if m.Logger != nil {
+		m.Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// queueGroup returns a group an article can be fetched from: the first
+// in its Xref, which is this server's own, or else in its Newsgroups.
+func queueGroup(article *nntp.Article) string {
+	if xref := strings.Fields(article.Header.Get("Xref")); len(xref) > 1 {
+		if i := strings.IndexByte(xref[1], ':'); i > 0 {
+			return xref[1][:i]
+		}
+	}
+	if groups := nntpserver.SplitGroups(article.Header.Get("Newsgroups")); len(groups) > 0 {
+		return groups[0]
+	}
+	return ""
+}
+
+// Offer queues an article for every peer that wants it.  Its signature
+// fits nntpserver.Server.AcceptHook.
+func (m *Manager) Offer(article *nntp.Article) {
+	id, group := article.MessageID(), queueGroup(article)
+	if id == "" || group == "" {
+		return
+	}
+	for _, p := range m.peers {
+		if !p.Wants(article) {
+			continue
+		}
+		// Each entry names a group to find the article in.
+		if err := p.q.push(id + " " + group); err != nil {
+			m.logf("feed %s: error queueing %s: %v", p.Name, id, err)
+		}
+	}
+}
+
+// Backlog returns how many bytes of message IDs are queued for each
+// peer.
+func (m *Manager) Backlog() map[string]int64 {
+	rv := make(map[string]int64, len(m.peers))
+	for _, p := range m.peers {
+		rv[p.Name] = p.q.pending()
+	}
+	return rv
+}
+
+// Run feeds peers until stop is closed.
+func (m *Manager) Run(stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, p := range m.peers {
+		wg.Add(1)
+		go func(p *peerFeed) {
+			defer wg.Done()
+			m.runPeer(p, stop)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// Close closes the peers' queues.
+func (m *Manager) Close() error {
+	var rv error
+	for _, p := range m.peers {
+		if p.client != nil {
+			p.client.Close()
+			p.client = nil
+		}
+		if err := p.q.close(); err != nil && rv == nil {
+			rv = err
+		}
+	}
+	return rv
+}
+
+func (m *Manager) runPeer(p *peerFeed, stop <-chan struct{}) {
+	delay := m.RetryMin
+	for {
+		entry, next, ok, err := p.q.peek()
+		if err != nil {
+			m.logf("feed %s: error reading queue: %v", p.Name, err)
+		}
+		if !ok {
+			select {
+			case <-stop:
+				return
+			case <-p.q.notify:
+			case <-time.After(time.Minute):
+			}
+			continue
+		}
+
+		if err := m.send(p, entry); err != nil {
+			m.logf("feed %s: error sending %s, retrying in %v: %v",
+				p.Name, entry, delay, err)
+			if p.client != nil {
+				p.client.Close()
+				p.client = nil
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > m.RetryMax {
+				delay = m.RetryMax
+			}
+			continue
+		}
+		delay = m.RetryMin
+
+		if err := p.q.commit(next); err != nil {
+			m.logf("feed %s: error updating queue: %v", p.Name, err)
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
+
+// gone reports whether a backend error means the article is no more.
+func gone(err error) bool {
+	if e, ok := err.(*nntpserver.NNTPError); ok {
+		switch e.Code {
+		case 411, 423, 430:
+			return true
+		}
+	}
+	return false
+}
+
+// fetch gets a queued article from the backend.
+func (m *Manager) fetch(groupName, id string) (*nntp.Article, error) {
+	group, err := m.Backend.GetGroup(groupName)
+	if err != nil {
+		return nil, err
+	}
+	return m.Backend.GetArticle(group, id)
+}
+
+// send offers the article of a queue entry to a peer.  Errors mean the
+// article should be tried again later; articles the peer doesn't want
+// or refuses, and ones that have gone from the backend, are done with.
+func (m *Manager) send(p *peerFeed, entry string) error {
+	fields := strings.Fields(entry)
+	if len(fields) != 2 {
+		// Torn by a crash.
+		m.logf("feed %s: dropping bad queue entry %q", p.Name, entry)
+		return nil
+	}
+	id := fields[0]
+	article, err := m.fetch(fields[1], id)
+	if gone(err) || (err == nil && article == nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	text, err := m.render(article)
+	if err != nil {
+		return err
+	}
+
+	if p.client == nil {
+		c, err := p.dial()
+		if err != nil {
+			return err
+		}
+		if p.Streaming {
+			if err := c.ModeStream(); err != nil {
+				c.Close()
+				return err
+			}
+		}
+		p.client = c
+	}
+
+	if p.Streaming {
+		wanted, err := p.client.Check(id)
+		if err != nil || !wanted {
+			return err
+		}
+		err = p.client.TakeThis(id, bytes.NewReader(text))
+		return refused(err, 439)
+	}
+	return refused(p.client.IHave(id, bytes.NewReader(text)), 435, 437)
+}
+
+// refused turns the responses that mean an article will never be
+// taken into success, since there's no point offering it again.
+func refused(err error, codes ...int) error {
+	if e, ok := err.(*textproto.Error); ok {
+		for _, c := range codes {
+			if e.Code == c {
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+// render formats an article for sending, with this host added to its
+// Path.
+func (m *Manager) render(article *nntp.Article) ([]byte, error) {
+	h := make(textproto.MIMEHeader, len(article.Header))
+	for k, v := range article.Header {
+		h[k] = v
+	}
+	if m.PathIdentity != "" {
+		path := h.Get("Path")
+		if !strings.HasPrefix(path, m.PathIdentity+"!") {
+			h.Set("Path", m.PathIdentity+"!"+path)
+		}
+	}
+	// Xref is local to this server.
+	h.Del("Xref")
+
+	var buf bytes.Buffer
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+		}
+	}
+	buf.WriteString("\r\n")
+	if _, err := io.Copy(&buf, article.Body); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,214 @@
+package feed
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-nntp"
+	"github.com/dustin/go-nntp/client"
+	"github.com/dustin/go-nntp/server"
+)
+
+// mapBackend keeps articles by message ID and signals each post.
+type mapBackend struct {
+	nntpserver.Backend
+	mu       sync.Mutex
+	articles map[string]*nntp.Article
+	bodies   map[string][]byte
+	posted   chan string
+	// failures is how many lookups fail before they succeed.
+	failures int
+}
+
+func newMapBackend() *mapBackend {
+	return &mapBackend{
+		articles: map[string]*nntp.Article{},
+		bodies:   map[string][]byte{},
+		posted:   make(chan string, 10),
+	}
+}
+
+func (b *mapBackend) GetGroup(name string) (*nntp.Group, error) {
+	return &nntp.Group{Name: name, Posting: nntp.PostingPermitted}, nil
+}
+
+func (b *mapBackend) GetArticle(group *nntp.Group, id string) (*nntp.Article, error) {
+	if group == nil {
+		return nil, errors.New("no group")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures > 0 {
+		b.failures--
+		return nil, errors.New("database unavailable")
+	}
+	a, ok := b.articles[id]
+	if !ok {
+		return nil, nntpserver.ErrInvalidMessageID
+	}
+	return &nntp.Article{
+		Header: a.Header,
+		Body:   bytes.NewReader(b.bodies[id]),
+		Bytes:  a.Bytes,
+		Lines:  a.Lines,
+	}, nil
+}
+
+func (b *mapBackend) HasArticle(id string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.articles[id]
+	return ok, nil
+}
+
+func (b *mapBackend) Authorized() bool { return true }
+func (b *mapBackend) AllowPost() bool  { return true }
+
+func (b *mapBackend) Post(article *nntp.Article) error {
+	body, err := ioutil.ReadAll(article.Body)
+	if err != nil {
+		return err
+	}
+	id := article.MessageID()
+	b.mu.Lock()
+	b.articles[id] = article
+	b.bodies[id] = body
+	b.mu.Unlock()
+	b.posted <- id
+	return nil
+}
+
+func testArticle(id, path, groups string) *nntp.Article {
+	return &nntp.Article{
+		Header: textproto.MIMEHeader{
+			"Message-Id": {id},
+			"Path":       {path},
+			"Newsgroups": {groups},
+			"From":       {"someone@example.com"},
+			"Subject":    {"test"},
+		},
+		Body: bytes.NewBufferString("body\r\n"),
+	}
+}
+
+func TestWants(t *testing.T) {
+	p := &Peer{
+		Name:          "peer.example.com",
+		Groups:        "comp.*,!comp.lang.*,@alt.binaries.*",
+		Distributions: "world,local",
+	}
+	for _, test := range []struct {
+		path, groups, dist string
+		exp                bool
+	}{
+		{"here!not-for-mail", "comp.misc", "", true},
+		{"here!not-for-mail", "comp.lang.go", "", false},
+		{"here!not-for-mail", "comp.lang.go,comp.misc", "", true},
+		{"here!not-for-mail", "comp.misc,alt.binaries.x", "", false},
+		{"here!not-for-mail", "rec.misc", "", false},
+		{"here!peer.example.com!not-for-mail", "comp.misc", "", false},
+		{"here!not-for-mail", "comp.misc", "local", true},
+		{"here!not-for-mail", "comp.misc", "fr", false},
+	} {
+		a := testArticle("<x@example.com>", test.path, test.groups)
+		if test.dist != "" {
+			a.Header.Set("Distribution", test.dist)
+		}
+		if got := p.Wants(a); got != test.exp {
+			t.Errorf("Wants(%q, %q, %q) = %v, wanted %v",
+				test.path, test.groups, test.dist, got, test.exp)
+		}
+	}
+}
+
+func testFeed(t *testing.T, streaming bool) {
+	dir, err := ioutil.TempDir("", "feed")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	local, remote := newMapBackend(), newMapBackend()
+	srv := nntpserver.NewServer(remote)
+	srv.Logger = log.New(ioutil.Discard, "", 0)
+	peer := &Peer{
+		Name:      "peer.example.com",
+		Groups:    "*",
+		Streaming: streaming,
+		Dial: func() (*nntpclient.Client, error) {
+			s, c := net.Pipe()
+			go srv.Process(s)
+			return nntpclient.NewConn(c)
+		},
+	}
+
+	m, err := NewManager(local, "here.example.com", dir, []*Peer{peer})
+	if err != nil {
+		t.Fatalf("Error making manager: %v", err)
+	}
+	m.Logger = srv.Logger
+	m.RetryMin = time.Millisecond
+	defer m.Close()
+
+	a := testArticle("<one@example.com>", "here.example.com!not-for-mail", "misc.test")
+	if err := local.Post(a); err != nil {
+		t.Fatalf("Error posting locally: %v", err)
+	}
+	<-local.posted
+	// The backend's trouble doesn't lose the article.
+	local.failures = 2
+	m.Offer(a)
+	// Queued for a peer already in the Path, so never sent.
+	m.Offer(testArticle("<two@example.com>", "peer.example.com!x", "misc.test"))
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		m.Run(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	select {
+	case id := <-remote.posted:
+		if id != "<one@example.com>" {
+			t.Fatalf("Peer got %v", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the article to arrive")
+	}
+	got, _ := remote.GetArticle(&nntp.Group{}, "<one@example.com>")
+	if p := got.Header.Get("Path"); p != "here.example.com!not-for-mail" {
+		t.Errorf("Path not kept as-is, got %q", p)
+	}
+	if body := string(remote.bodies["<one@example.com>"]); body != "body\n" {
+		t.Errorf("Body = %q", body)
+	}
+
+	// The queue is emptied once the peer has it.
+	for i := 0; i < 100 && m.Backlog()[peer.Name] != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := m.Backlog()[peer.Name]; n != 0 {
+		t.Errorf("Expected an empty backlog, got %d bytes", n)
+	}
+}
+
+func TestFeedIHave(t *testing.T) {
+	testFeed(t, false)
+}
+
+func TestFeedStreaming(t *testing.T) {
+	testFeed(t, true)
+}
@@ -0,0 +1,130 @@
+package feed
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A queue is a durable backlog of message IDs waiting to be sent to a
+// peer.  IDs are appended to a file, one per line, and the offset of
+// the first unsent one is kept in a second file.  Once everything has
+// been sent both are reset.
+type queue struct {
+	path   string
+	mu     sync.Mutex
+	f      *os.File
+	offset int64
+	size   int64
+	notify chan struct{}
+}
+
+func openQueue(path string) (*queue, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	q := &queue{
+		path:   path,
+		f:      f,
+		size:   st.Size(),
+		notify: make(chan struct{}, 1),
+	}
+	if b, err := ioutil.ReadFile(path + ".offset"); err == nil {
+		q.offset, _ = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	}
+	if q.offset > q.size {
+		q.offset = q.size
+	}
+	return q, nil
+}
+
+// push appends a message ID to the queue.  It is on disk when push
+// returns.
+func (q *queue) push(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n, err := q.f.WriteString(id + "\n")
+	q.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if err := q.f.Sync(); err != nil {
+		return err
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// peek returns the first unsent message ID and the offset just past it,
+// to be passed to commit once it has been dealt with.
+func (q *queue) peek() (string, int64, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.offset >= q.size {
+		return "", 0, false, nil
+	}
+	r := bufio.NewReader(io.NewSectionReader(q.f, q.offset, q.size-q.offset))
+	// A line torn by a crash comes back without its newline, and
+	// is dropped when it is sent.
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", 0, false, err
+	}
+	return strings.TrimSpace(line), q.offset + int64(len(line)), true, nil
+}
+
+// commit marks everything before next as sent.
+func (q *queue) commit(next int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.offset = next
+	if q.offset >= q.size {
+		if err := q.f.Truncate(0); err != nil {
+			return err
+		}
+		q.offset, q.size = 0, 0
+	}
+	tmp := q.path + ".offset.tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strconv.FormatInt(q.offset, 10))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path+".offset")
+}
+
+// pending returns the number of bytes of message IDs waiting to be
+// sent.
+func (q *queue) pending() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size - q.offset
+}
+
+func (q *queue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.f.Close()
+}
@@ -3,6 +3,8 @@ module github.com/dustin/go-nntp
 go 1.16
 
 require (
+	github.com/ProtonMail/go-crypto v0.0.0-20230217124315-7d5c6f04bbb8
 	github.com/dustin/go-couch v0.0.0-20160816170231-8251128dab73
 	github.com/dustin/httputil v0.0.0-20170305193905-c47743f54f89 // indirect
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 )
@@ -0,0 +1,235 @@
+// Package history records the message IDs a news server has seen, so
+// articles it has already accepted or refused aren't taken again, even
+// after they have been expired.
+//
+// Only an MD5 hash of each message ID is kept, along with when the
+// article arrived and when it expires.  Records are appended to a file
+// as they are added and loaded back by Open; Compact rewrites the file
+// without the records that have been forgotten.
+package history
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const recordSize = md5.Size + 8 + 8
+
+type entry struct {
+	arrived int64
+	expires int64
+}
+
+// A History is an on-disk database of message IDs.  It is safe for
+// concurrent use.
+type History struct {
+	// Remember is how long a message ID is kept after its article
+	// has expired.
+	Remember time.Duration
+	// Retention is how long the server keeps articles, for those that
+	// don't say when they expire or expire sooner.  Zero means
+	// articles are gone once their Expires date has passed.
+	Retention time.Duration
+	// Now returns the current time.  It defaults to time.Now.
+	Now func() time.Time
+
+	path    string
+	mu      sync.RWMutex
+	f       *os.File
+	w       *bufio.Writer
+	entries map[[md5.Size]byte]entry
+}
+
+// Open loads the history at path, creating it if needed.  Message IDs
+// are remembered for the given duration after their articles expire.
+func Open(path string, remember time.Duration) (*History, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	h := &History{
+		Remember: remember,
+		path:     path,
+		f:        f,
+		entries:  make(map[[md5.Size]byte]entry),
+	}
+
+	var rec [recordSize]byte
+	r := bufio.NewReader(f)
+	var good int64
+	for {
+		_, err := io.ReadFull(r, rec[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		k, e := decode(rec[:])
+		h.entries[k] = e
+		good += recordSize
+	}
+	// Drop a record left half-written by a crash.
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	h.w = bufio.NewWriter(f)
+	return h, nil
+}
+
+func key(id string) [md5.Size]byte {
+	return md5.Sum([]byte(id))
+}
+
+func decode(rec []byte) ([md5.Size]byte, entry) {
+	var k [md5.Size]byte
+	copy(k[:], rec)
+	return k, entry{
+		arrived: int64(binary.BigEndian.Uint64(rec[md5.Size:])),
+		expires: int64(binary.BigEndian.Uint64(rec[md5.Size+8:])),
+	}
+}
+
+func encode(k [md5.Size]byte, e entry) []byte {
+	rec := make([]byte, recordSize)
+	copy(rec, k[:])
+	binary.BigEndian.PutUint64(rec[md5.Size:], uint64(e.arrived))
+	binary.BigEndian.PutUint64(rec[md5.Size+8:], uint64(e.expires))
+	return rec
+}
+
+func (h *History) now() time.Time {
+	if h.Now != nil {
+		return h.Now()
+	}
+	return time.Now()
+}
+
+// forgotten reports whether an entry's article expired longer than the
+// remember window ago.
+func (h *History) forgotten(e entry, now time.Time) bool {
+	expiry := time.Unix(0, e.arrived).Add(h.Retention)
+	if e.expires != 0 {
+		if exp := time.Unix(0, e.expires); exp.After(expiry) {
+			expiry = exp
+		}
+	}
+	return now.After(expiry.Add(h.Remember))
+}
+
+// Seen reports whether a message ID is in the history.
+func (h *History) Seen(id string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	e, ok := h.entries[key(id)]
+	return ok && !h.forgotten(e, h.now())
+}
+
+// Add records a message ID with its article's arrival time and, if
+// known, its expiry time.  The record is written to disk before Add
+// returns.
+func (h *History) Add(id string, arrived, expires time.Time) error {
+	e := entry{arrived: arrived.UnixNano()}
+	if !expires.IsZero() {
+		e.expires = expires.UnixNano()
+	}
+	k := key(id)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.w.Write(encode(k, e)); err != nil {
+		return err
+	}
+	if err := h.w.Flush(); err != nil {
+		return err
+	}
+	h.entries[k] = e
+	return nil
+}
+
+// Sync commits the history file to stable storage.
+func (h *History) Sync() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.f.Sync()
+}
+
+// Len returns the number of message IDs in the history, including
+// forgotten ones not yet compacted away.
+func (h *History) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.entries)
+}
+
+// Compact drops forgotten message IDs and rewrites the history file
+// without them.
+func (h *History) Compact() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	tmp := h.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for k, e := range h.entries {
+		if h.forgotten(e, now) {
+			delete(h.entries, k)
+			continue
+		}
+		if _, err := w.Write(encode(k, e)); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	h.f.Close()
+	h.f = f
+	h.w = bufio.NewWriter(f)
+	return nil
+}
+
+// Close flushes and closes the history file.
+func (h *History) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.w.Flush(); err != nil {
+		h.f.Close()
+		return err
+	}
+	if err := h.f.Sync(); err != nil {
+		h.f.Close()
+		return err
+	}
+	return h.f.Close()
+}
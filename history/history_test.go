@@ -0,0 +1,79 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history")
+
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	h, err := Open(path, 10*day)
+	if err != nil {
+		t.Fatalf("Error opening: %v", err)
+	}
+	h.Now = func() time.Time { return now }
+
+	h.Add("<old@example.com>", now.Add(-20*day), time.Time{})
+	h.Add("<kept@example.com>", now.Add(-20*day), now.Add(day))
+	h.Add("<new@example.com>", now.Add(-day), time.Time{})
+	// Arrived long ago, but only just expired.
+	h.Add("<late@example.com>", now.Add(-20*day), now.Add(-5*day))
+	if err := h.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+
+	// A torn write at the end of the file must be ignored.
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte("partial"))
+	f.Close()
+
+	h, err = Open(path, 10*day)
+	if err != nil {
+		t.Fatalf("Error reopening: %v", err)
+	}
+	defer h.Close()
+	h.Now = func() time.Time { return now }
+
+	for id, exp := range map[string]bool{
+		"<old@example.com>":     false,
+		"<kept@example.com>":    true,
+		"<new@example.com>":     true,
+		"<late@example.com>":    true,
+		"<unknown@example.com>": false,
+	} {
+		if h.Seen(id) != exp {
+			t.Errorf("Seen(%v) = %v, wanted %v", id, !exp, exp)
+		}
+	}
+
+	// Articles kept for 30 days are remembered for 10 more.
+	h.Retention = 30 * day
+	if !h.Seen("<old@example.com>") {
+		t.Errorf("Forgot an article still within retention")
+	}
+	h.Retention = 0
+
+	if err := h.Compact(); err != nil {
+		t.Fatalf("Error compacting: %v", err)
+	}
+	if h.Len() != 3 {
+		t.Errorf("Expected 3 entries after compaction, got %d", h.Len())
+	}
+	if err := h.Add("<after@example.com>", now, time.Time{}); err != nil {
+		t.Fatalf("Error adding after compaction: %v", err)
+	}
+	if st, _ := os.Stat(path); st.Size() != 4*recordSize {
+		t.Errorf("History file is %d bytes, wanted %d", st.Size(), 4*recordSize)
+	}
+}
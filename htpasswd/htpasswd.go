@@ -0,0 +1,158 @@
+// Package htpasswd authenticates NNTP users against a file of
+// "user:hash" lines, like those written by Apache's "htpasswd -B" or
+// "mkpasswd -m sha-512".
+//
+// Passwords may be hashed with bcrypt ("$2a$", "$2b$" or "$2y$") or
+// SHA-crypt ("$5$" or "$6$").  Lines with other hashes are logged and
+// ignored.  Blank lines and lines starting with "#" are skipped.
+//
+// The file is reloaded when it changes, so users can be added and
+// removed while the server is running.
+package htpasswd
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/dustin/go-nntp/server"
+)
+
+// A File checks passwords against an htpasswd file.  It is safe for
+// concurrent use.
+type File struct {
+	// Path is the file's name.
+	Path string
+	// Backend, if set, returns the Backend an authenticated user's
+	// session switches to.  Otherwise the session keeps its Backend,
+	// and knows the user only by name, e.g. for nntpserver.ACL rules.
+	Backend func(user string) (nntpserver.Backend, error)
+	// Logger receives the File's log output.  If nil, the log
+	// package's standard logger is used.
+	Logger *log.Logger
+
+	mu    sync.Mutex
+	users map[string]string
+	mtime time.Time
+	size  int64
+}
+
+// Open loads the htpasswd file at path.
+func Open(path string) (*File, error) {
+	f := &File{Path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) logf(format string, args ...interface{}) {
+	if f.Logger != nil {
+		f.Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// reload reads the file again if it has changed since it was last read.
+func (f *File) reload() error {
+	fi, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	unchanged := f.users != nil && fi.ModTime().Equal(f.mtime) && fi.Size() == f.size
+	f.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	in, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	users := map[string]string{}
+	scanner := bufio.NewScanner(in)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 1 {
+			return fmt.Errorf("%s:%d: malformed line", f.Path, n)
+		}
+		user, hash := line[:i], line[i+1:]
+		if !supported(hash) {
+			f.logf("%s:%d: unsupported password hash for %s", f.Path, n, user)
+			continue
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users, f.mtime, f.size = users, fi.ModTime(), fi.Size()
+	return nil
+}
+
+func supported(hash string) bool {
+	for _, p := range []string{"$2a$", "$2b$", "$2y$", "$5$", "$6$"} {
+		if strings.HasPrefix(hash, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Timing attacks shouldn't tell whether a user exists, so unknown users'
+// passwords are checked against this, a bcrypt hash of nothing.
+const dummyHash = "$2a$10$AiOvlaWZZz8MMDFL85rh..h1PY1EPNRF86hnYI.C.r5lfF1/WMeBC"
+
+func match(hash, password string) bool {
+	if strings.HasPrefix(hash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	got, ok := shaCrypt(hash, password)
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(hash)) == 1
+}
+
+// Check reports whether password is the user's.  The file is reloaded
+// first if it has changed; if it can't be, the users last loaded are
+// used.
+func (f *File) Check(user, password string) bool {
+	if err := f.reload(); err != nil {
+		f.logf("Error reloading %s: %v", f.Path, err)
+	}
+	f.mu.Lock()
+	hash, ok := f.users[user]
+	f.mu.Unlock()
+	if !ok {
+		match(dummyHash, password)
+		return false
+	}
+	return match(hash, password)
+}
+
+// Authenticate implements nntpserver.Authenticator.  Set a File as a
+// Server's Authenticator to check AUTHINFO passwords against it.
+func (f *File) Authenticate(user, pass string) (nntpserver.Backend, error) {
+	if !f.Check(user, pass) {
+		return nil, nntpserver.ErrAuthRejected
+	}
+	if f.Backend == nil {
+		return nil, nil
+	}
+	return f.Backend(user)
+}
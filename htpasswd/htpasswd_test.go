@@ -0,0 +1,173 @@
+package htpasswd
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-nntp"
+	"github.com/dustin/go-nntp/server"
+)
+
+func TestSHACrypt(t *testing.T) {
+	for _, test := range []struct {
+		setting, password, exp string
+	}{
+		{"$5$saltstring", "Hello world!",
+			"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+		{"$5$rounds=10000$saltstringsaltstring", "Hello world!",
+			"$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+		{"$6$saltstring", "Hello world!",
+			"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"$6$rounds=10$roundstoolow", "the minimum number is still observed",
+			"$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+	} {
+		got, ok := shaCrypt(test.setting, test.password)
+		if !ok || got != test.exp {
+			t.Errorf("shaCrypt(%q) = %q, wanted %q", test.setting, got, test.exp)
+		}
+	}
+	if _, ok := shaCrypt("$1$md5", "x"); ok {
+		t.Errorf("Expected MD5-crypt refused")
+	}
+}
+
+const testFile = `# Test users.
+alice:$2a$04$YgNDddZ83kJ9jJ6084eKkOzr3ROhDFmWZs4xpRYt5SmW8O/c77s5K
+bob:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5
+
+carol:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1
+dave:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+`
+
+type userBackend struct {
+	nntpserver.Backend
+	user string
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users")
+	ioutil.WriteFile(path, []byte(testFile), 0600)
+
+	f, err := Open(path)
+	if err != nil {
+		t.Fatalf("Error opening: %v", err)
+	}
+	f.Logger = log.New(ioutil.Discard, "", 0)
+	for _, test := range []struct {
+		user, pass string
+		exp        bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "Secret", false},
+		{"bob", "Hello world!", true},
+		{"carol", "Hello world!", true},
+		{"carol", "", false},
+		{"dave", "secret", false},
+		{"eve", "secret", false},
+	} {
+		if got := f.Check(test.user, test.pass); got != test.exp {
+			t.Errorf("Check(%q, %q) = %v", test.user, test.pass, got)
+		}
+	}
+
+	// Alice leaves; the file is reloaded.
+	ioutil.WriteFile(path, []byte(strings.Replace(testFile, "alice:", "#alice:", 1)), 0600)
+	if f.Check("alice", "secret") || !f.Check("bob", "Hello world!") {
+		t.Errorf("File not reloaded")
+	}
+	// A broken file leaves the users as they were.
+	ioutil.WriteFile(path, []byte("no colon here\n"), 0600)
+	if !f.Check("bob", "Hello world!") {
+		t.Errorf("Broken file was loaded")
+	}
+
+	if got, err := f.Authenticate("bob", "Hello world!"); got != nil || err != nil {
+		t.Errorf("Authenticate = %v, %v", got, err)
+	}
+	if _, err := f.Authenticate("bob", "wrong"); err != nntpserver.ErrAuthRejected {
+		t.Errorf("Expected wrong password rejected, got %v", err)
+	}
+	f.Backend = func(user string) (nntpserver.Backend, error) {
+		return &userBackend{user: user}, nil
+	}
+	if got, _ := f.Authenticate("carol", "Hello world!"); got.(*userBackend).user != "carol" {
+		t.Errorf("Got backend %v", got)
+	}
+}
+
+// overBackend serves overviews, and fails the test if whole articles are
+// loaded instead.
+type overBackend struct {
+	nntpserver.Backend
+	t *testing.T
+}
+
+func (ob overBackend) Authorized() bool { return true }
+
+func (ob overBackend) GetGroup(name string) (*nntp.Group, error) {
+	return &nntp.Group{Name: name, Count: 1, Low: 1, High: 1}, nil
+}
+
+func (ob overBackend) GetArticles(group *nntp.Group, from, to int64) ([]nntpserver.NumberedArticle, error) {
+	ob.t.Errorf("GetArticles called")
+	return nil, nil
+}
+
+func (ob overBackend) GetOverview(group *nntp.Group, from, to int64) ([]nntpserver.OverviewRecord, error) {
+	return []nntpserver.OverviewRecord{{Num: 1, Subject: "hi", MessageID: "<1@x>"}}, nil
+}
+
+func TestServerAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users")
+	ioutil.WriteFile(path, []byte(testFile), 0600)
+	f, err := Open(path)
+	if err != nil {
+		t.Fatalf("Error opening: %v", err)
+	}
+
+	s := nntpserver.NewServer(overBackend{t: t})
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	s.Authenticator = f
+	srv, cli := net.Pipe()
+	go s.Process(srv)
+	c := textproto.NewConn(cli)
+	defer c.Close()
+	c.ReadCodeLine(200)
+
+	for _, test := range []struct {
+		cmd  string
+		code int
+	}{
+		{"AUTHINFO USER bob", 350},
+		{"AUTHINFO PASS wrong", 452},
+		{"AUTHINFO USER bob", 350},
+		{"AUTHINFO PASS Hello world!", 250},
+		{"GROUP misc.test", 211},
+		{"OVER 1-1", 224},
+	} {
+		c.PrintfLine(test.cmd)
+		if _, _, err := c.ReadCodeLine(test.code); err != nil {
+			t.Fatalf("%v: %v", test.cmd, err)
+		}
+	}
+	lines, err := c.ReadDotLines()
+	if err != nil || len(lines) != 1 || !strings.HasPrefix(lines[0], "1\thi\t") {
+		t.Errorf("OVER = %q, %v", lines, err)
+	}
+}
@@ -0,0 +1,177 @@
+package htpasswd
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt, as specified at https://www.akkadia.org/drepper/SHA-crypt.txt
+// and used by glibc's crypt(3) for "$5$" (SHA-256) and "$6$" (SHA-512)
+// hashes.
+
+const (
+	shaCryptRounds    = 5000
+	shaCryptMinRounds = 1000
+	shaCryptMaxRounds = 999999999
+	shaCryptMaxSalt   = 16
+)
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// The order digest bytes are encoded in, three at a time, with the odd
+// bytes left over at the end.
+var (
+	sha256Order = []int{
+		0, 10, 20, 21, 1, 11, 12, 22, 2, 3, 13, 23, 24, 4, 14,
+		15, 25, 5, 6, 16, 26, 27, 7, 17, 18, 28, 8, 9, 19, 29,
+		-1, 31, 30,
+	}
+	sha512Order = []int{
+		0, 21, 42, 22, 43, 1, 44, 2, 23, 3, 24, 45, 25, 46, 4,
+		47, 5, 26, 6, 27, 48, 28, 49, 7, 50, 8, 29, 9, 30, 51,
+		31, 52, 10, 53, 11, 32, 12, 33, 54, 34, 55, 13, 56, 14, 35,
+		15, 36, 57, 37, 58, 16, 59, 17, 38, 18, 39, 60, 40, 61, 19,
+		62, 20, 41, -1, -1, 63,
+	}
+)
+
+// shaCrypt hashes a password with the algorithm, salt and rounds given
+// by setting, a "$5$" or "$6$" hash or its prefix.  ok is false if
+// setting can't be parsed.
+func shaCrypt(setting, password string) (string, bool) {
+	var newHash func() hash.Hash
+	var order []int
+	switch {
+	case strings.HasPrefix(setting, "$5$"):
+		newHash, order = sha256.New, sha256Order
+	case strings.HasPrefix(setting, "$6$"):
+		newHash, order = sha512.New, sha512Order
+	default:
+		return "", false
+	}
+	prefix := setting[:3]
+	rest := setting[3:]
+
+	rounds, explicitRounds := shaCryptRounds, false
+	if strings.HasPrefix(rest, "rounds=") {
+		i := strings.IndexByte(rest, '$')
+		if i < 0 {
+			return "", false
+		}
+		n, err := strconv.ParseUint(rest[len("rounds="):i], 10, 64)
+		if err != nil {
+			return "", false
+		}
+		switch {
+		case n < shaCryptMinRounds:
+			n = shaCryptMinRounds
+		case n > shaCryptMaxRounds:
+			n = shaCryptMaxRounds
+		}
+		rounds, explicitRounds = int(n), true
+		rest = rest[i+1:]
+	}
+	salt := rest
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > shaCryptMaxSalt {
+		salt = salt[:shaCryptMaxSalt]
+	}
+
+	p, s := []byte(password), []byte(salt)
+
+	h := newHash()
+	h.Write(p)
+	h.Write(s)
+	h.Write(p)
+	b := h.Sum(nil)
+	size := len(b)
+
+	h.Reset()
+	h.Write(p)
+	h.Write(s)
+	h.Write(repeat(b, len(p)))
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for range p {
+		h.Write(p)
+	}
+	pseq := repeat(h.Sum(nil), len(p))
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(s)
+	}
+	sseq := repeat(h.Sum(nil), len(s))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(pseq)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sseq)
+		}
+		if i%7 != 0 {
+			h.Write(pseq)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pseq)
+		}
+		c = h.Sum(c[:0])
+	}
+
+	var out strings.Builder
+	out.WriteString(prefix)
+	if explicitRounds {
+		out.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	out.WriteString(salt)
+	out.WriteByte('$')
+	for i := 0; i < len(order); i += 3 {
+		var w uint
+		n := 4
+		for j := 0; j < 3; j++ {
+			w <<= 8
+			if k := order[i+j]; k >= 0 && k < size {
+				w |= uint(c[k])
+			} else {
+				n--
+			}
+		}
+		for ; n > 0; n-- {
+			out.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	return out.String(), true
+}
+
+// repeat returns n bytes of b repeated.
+func repeat(b []byte, n int) []byte {
+	rv := make([]byte, 0, n)
+	for len(rv) < n {
+		if n-len(rv) < len(b) {
+			return append(rv, b[:n-len(rv)]...)
+		}
+		rv = append(rv, b...)
+	}
+	return rv
+}
@@ -0,0 +1,419 @@
+// Package memstore provides an nntpserver.Backend keeping everything in
+// memory, for tests and small, short-lived servers.
+package memstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/dustin/go-nntp"
+	"github.com/dustin/go-nntp/server"
+)
+
+type article struct {
+	header textproto.MIMEHeader
+	body   []byte
+	lines  int
+	// The number of groups the article is in.
+	refs int
+}
+
+type group struct {
+	info nntp.Group
+	// Article numbers in ascending order, and their message IDs.
+	nums []int64
+	ids  map[int64]string
+}
+
+// A Store is an in-memory Backend.  It is safe for concurrent use.
+//
+// Besides Backend, a Store implements nntpserver.OverviewBackend,
+// OverviewStreamer, ArticleStreamer, ArticleChecker, ArticleDeleter,
+// GroupCreator, GroupRemover and ArticleExpirer, so it can act on
+// control messages and be expired by an nntpserver.Expirer.
+type Store struct {
+	// MaxArticles, if positive, is how many articles each group
+	// keeps.  Posting more removes the oldest.  Retention by age or
+	// size is left to an nntpserver.Expirer.
+	MaxArticles int
+
+	mu       sync.RWMutex
+	groups   map[string]*group
+	articles map[string]*article
+	numberer *nntpserver.Numberer
+}
+
+// New builds an empty Store naming itself pathIdentity in Xref headers.
+func New(pathIdentity string) *Store {
+	return &Store{
+		groups:   map[string]*group{},
+		articles: map[string]*article{},
+		numberer: nntpserver.NewNumberer(pathIdentity),
+	}
+}
+
+// CreateGroup adds a group, or updates the description and posting
+// status of an existing one.  Its article counters are ignored.
+func (s *Store) CreateGroup(g *nntp.Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if gs, ok := s.groups[g.Name]; ok {
+		gs.info.Description = g.Description
+		gs.info.Posting = g.Posting
+		return nil
+	}
+	gs := &group{
+		info: nntp.Group{
+			Name:        g.Name,
+			Description: g.Description,
+			Posting:     g.Posting,
+		},
+		ids: map[int64]string{},
+	}
+	gs.update(s.numberer.High(g.Name))
+	s.groups[g.Name] = gs
+	return nil
+}
+
+// RemoveGroup removes a group and the articles only it held.
+func (s *Store) RemoveGroup(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gs, ok := s.groups[name]
+	if !ok {
+		return nntpserver.ErrNoSuchGroup
+	}
+	for _, num := range gs.nums {
+		s.release(gs.ids[num])
+	}
+	delete(s.groups, name)
+	return nil
+}
+
+// update recomputes a group's counters.  An empty group's low water
+// mark is one more than its high water mark, as RFC 3977 suggests.
+func (gs *group) update(high int64) {
+	gs.info.High = high
+	gs.info.Count = int64(len(gs.nums))
+	if len(gs.nums) > 0 {
+		gs.info.Low = gs.nums[0]
+	} else {
+		gs.info.Low = high + 1
+	}
+}
+
+// release drops one group's reference to an article, forgetting it
+// once no group holds it.  The caller must hold s.mu.
+func (s *Store) release(id string) {
+	if a, ok := s.articles[id]; ok {
+		if a.refs--; a.refs <= 0 {
+			delete(s.articles, id)
+		}
+	}
+}
+
+// ListGroups returns up to max groups, or all of them if max isn't
+// positive, sorted by name.
+func (s *Store) ListGroups(max int) ([]*nntp.Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rv := make([]*nntp.Group, 0, len(s.groups))
+	for _, gs := range s.groups {
+		g := gs.info
+		rv = append(rv, &g)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Name < rv[j].Name })
+	if max > 0 && len(rv) > max {
+		rv = rv[:max]
+	}
+	return rv, nil
+}
+
+// GetGroup returns a copy of the named group.
+func (s *Store) GetGroup(name string) (*nntp.Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	gs, ok := s.groups[name]
+	if !ok {
+		return nil, nntpserver.ErrNoSuchGroup
+	}
+	g := gs.info
+	return &g, nil
+}
+
+func cloneHeader(h textproto.MIMEHeader) textproto.MIMEHeader {
+	rv := make(textproto.MIMEHeader, len(h))
+	for k, v := range h {
+		rv[k] = append([]string(nil), v...)
+	}
+	return rv
+}
+
+// toArticle returns a copy of the article that the caller may modify
+// and read as it likes.
+func (a *article) toArticle() *nntp.Article {
+	return &nntp.Article{
+		Header: cloneHeader(a.header),
+		Body:   bytes.NewReader(a.body),
+		Bytes:  len(a.body),
+		Lines:  a.lines,
+	}
+}
+
+// GetArticle returns an article by message ID, or by number in the
+// given group.
+func (s *Store) GetArticle(g *nntp.Group, id string) (*nntp.Article, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if num, err := strconv.ParseInt(id, 10, 64); err == nil {
+		if g == nil {
+			return nil, nntpserver.ErrNoGroupSelected
+		}
+		gs, ok := s.groups[g.Name]
+		if !ok {
+			return nil, nntpserver.ErrNoSuchGroup
+		}
+		msgid, ok := gs.ids[num]
+		if !ok {
+			return nil, nntpserver.ErrInvalidArticleNumber
+		}
+		id = msgid
+	}
+	a, ok := s.articles[id]
+	if !ok {
+		return nil, nntpserver.ErrInvalidMessageID
+	}
+	return a.toArticle(), nil
+}
+
+// HasArticle reports whether the Store has the article with the given
+// message ID.
+func (s *Store) HasArticle(id string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.articles[id]
+	return ok, nil
+}
+
+// GetArticles returns a group's articles numbered from from to to
+// inclusive, in order.
+func (s *Store) GetArticles(g *nntp.Group, from, to int64) ([]nntpserver.NumberedArticle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	gs, ok := s.groups[g.Name]
+	if !ok {
+		return nil, nntpserver.ErrNoSuchGroup
+	}
+	rv := []nntpserver.NumberedArticle{}
+	i := sort.Search(len(gs.nums), func(i int) bool { return gs.nums[i] >= from })
+	for ; i < len(gs.nums) && gs.nums[i] <= to; i++ {
+		num := gs.nums[i]
+		rv = append(rv, nntpserver.NumberedArticle{
+			Num:     num,
+			Article: s.articles[gs.ids[num]].toArticle(),
+		})
+	}
+	return rv, nil
+}
+
+// GetOverview returns the overview of a group's articles numbered from
+// from to to inclusive, in order, without copying their bodies.
+func (s *Store) GetOverview(g *nntp.Group, from, to int64) ([]nntpserver.OverviewRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	gs, ok := s.groups[g.Name]
+	if !ok {
+		return nil, nntpserver.ErrNoSuchGroup
+	}
+	rv := []nntpserver.OverviewRecord{}
+	i := sort.Search(len(gs.nums), func(i int) bool { return gs.nums[i] >= from })
+	for ; i < len(gs.nums) && gs.nums[i] <= to; i++ {
+		a := s.articles[gs.ids[gs.nums[i]]]
+		rv = append(rv, nntpserver.NewOverviewRecord(gs.nums[i], &nntp.Article{
+			Header: a.header,
+			Bytes:  len(a.body),
+			Lines:  a.lines,
+		}))
+	}
+	return rv, nil
+}
+
+// next returns the first article in a group numbered from from to to,
+// or a zero number if there is none.
+func (s *Store) next(g *nntp.Group, from, to int64) (int64, *article, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	gs, ok := s.groups[g.Name]
+	if !ok {
+		return 0, nil, nntpserver.ErrNoSuchGroup
+	}
+	i := sort.Search(len(gs.nums), func(i int) bool { return gs.nums[i] >= from })
+	if i == len(gs.nums) || gs.nums[i] > to {
+		return 0, nil, nil
+	}
+	return gs.nums[i], s.articles[gs.ids[gs.nums[i]]], nil
+}
+
+// EachArticle calls f with each of a group's articles numbered from
+// from to to, in order, stopping with f's error if it returns one.  The
+// store isn't locked while f runs.
+func (s *Store) EachArticle(g *nntp.Group, from, to int64, f func(nntpserver.NumberedArticle) error) error {
+	for {
+		num, a, err := s.next(g, from, to)
+		if err != nil || num == 0 {
+			return err
+		}
+		if err := f(nntpserver.NumberedArticle{Num: num, Article: a.toArticle()}); err != nil {
+			return err
+		}
+		if num == to {
+			return nil
+		}
+		from = num + 1
+	}
+}
+
+// EachOverview is like EachArticle, but passes overview records.
+func (s *Store) EachOverview(g *nntp.Group, from, to int64, f func(nntpserver.OverviewRecord) error) error {
+	for {
+		num, a, err := s.next(g, from, to)
+		if err != nil || num == 0 {
+			return err
+		}
+		// Stored articles are never changed, so their headers can be
+		// read without the lock.
+		r := nntpserver.NewOverviewRecord(num, &nntp.Article{
+			Header: a.header,
+			Bytes:  len(a.body),
+			Lines:  a.lines,
+		})
+		if err := f(r); err != nil {
+			return err
+		}
+		if num == to {
+			return nil
+		}
+		from = num + 1
+	}
+}
+
+// Authorized returns true: a Store has no users.
+func (s *Store) Authorized() bool {
+	return true
+}
+
+// Authenticate always fails.
+func (s *Store) Authenticate(user, pass string) (nntpserver.Backend, error) {
+	return nil, nntpserver.ErrAuthRejected
+}
+
+// AllowPost returns true.
+func (s *Store) AllowPost() bool {
+	return true
+}
+
+// Post stores an article in those of its newsgroups that exist,
+// numbering it and setting its Xref header.  Articles without a
+// message ID, already stored, or for no known group are refused.
+func (s *Store) Post(a *nntp.Article) error {
+	body, err := ioutil.ReadAll(a.Body)
+	if err != nil {
+		return err
+	}
+	id := a.MessageID()
+	if id == "" {
+		return nntpserver.ErrPostingFailed
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.articles[id]; ok {
+		return nntpserver.ErrPostingFailed
+	}
+	groups := []string{}
+	for _, g := range nntpserver.SplitGroups(a.Header.Get("Newsgroups")) {
+		if _, ok := s.groups[g]; ok {
+			groups = append(groups, g)
+		}
+	}
+	if len(groups) == 0 {
+		return nntpserver.ErrPostingFailed
+	}
+
+	entries := s.numberer.Number(a, groups)
+	stored := &article{
+		header: cloneHeader(a.Header),
+		body:   body,
+		lines:  bytes.Count(body, []byte{'\n'}),
+	}
+	s.articles[id] = stored
+	for _, x := range entries {
+		gs := s.groups[x.Group]
+		gs.nums = append(gs.nums, x.Num)
+		gs.ids[x.Num] = id
+		stored.refs++
+		if s.MaxArticles > 0 && len(gs.nums) > s.MaxArticles {
+			for _, num := range gs.nums[:len(gs.nums)-s.MaxArticles] {
+				s.release(gs.ids[num])
+				delete(gs.ids, num)
+			}
+			gs.nums = append([]int64(nil), gs.nums[len(gs.nums)-s.MaxArticles:]...)
+		}
+		gs.update(x.Num)
+	}
+	return nil
+}
+
+// remove takes the given numbers out of a group.  The caller must hold
+// s.mu.
+func (s *Store) remove(gs *group, nums []int64) {
+	drop := make(map[int64]bool, len(nums))
+	for _, num := range nums {
+		if id, ok := gs.ids[num]; ok {
+			drop[num] = true
+			s.release(id)
+			delete(gs.ids, num)
+		}
+	}
+	kept := gs.nums[:0]
+	for _, num := range gs.nums {
+		if !drop[num] {
+			kept = append(kept, num)
+		}
+	}
+	gs.nums = kept
+	gs.update(gs.info.High)
+}
+
+// DeleteArticle removes an article from every group.
+func (s *Store) DeleteArticle(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.articles[id]
+	if !ok {
+		return nntpserver.ErrInvalidMessageID
+	}
+	for _, x := range nntpserver.ParseXref(a.header.Get("Xref")) {
+		if gs, ok := s.groups[x.Group]; ok && gs.ids[x.Num] == id {
+			s.remove(gs, []int64{x.Num})
+		}
+	}
+	return nil
+}
+
+// ExpireArticles removes the given numbers from a group.  Articles
+// crossposted elsewhere stay there.
+func (s *Store) ExpireArticles(g *nntp.Group, nums []int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gs, ok := s.groups[g.Name]
+	if !ok {
+		return nntpserver.ErrNoSuchGroup
+	}
+	s.remove(gs, nums)
+	return nil
+}
@@ -0,0 +1,254 @@
+package memstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-nntp"
+	"github.com/dustin/go-nntp/server"
+)
+
+func testArticle(id, groups, body string) *nntp.Article {
+	return &nntp.Article{
+		Header: textproto.MIMEHeader{
+			"Message-Id": {id},
+			"Newsgroups": {groups},
+			"Subject":    {"test"},
+		},
+		Body: strings.NewReader(body),
+	}
+}
+
+func newStore(t *testing.T, groups ...string) *Store {
+	s := New("test.example.com")
+	for _, g := range groups {
+		if err := s.CreateGroup(&nntp.Group{Name: g, Posting: nntp.PostingPermitted}); err != nil {
+			t.Fatalf("Error creating %v: %v", g, err)
+		}
+	}
+	return s
+}
+
+func checkGroup(t *testing.T, s *Store, name string, count, low, high int64) {
+	t.Helper()
+	g, err := s.GetGroup(name)
+	if err != nil {
+		t.Fatalf("Error getting %v: %v", name, err)
+	}
+	if g.Count != count || g.Low != low || g.High != high {
+		t.Errorf("%v: count=%d low=%d high=%d, wanted %d %d %d",
+			name, g.Count, g.Low, g.High, count, low, high)
+	}
+}
+
+func TestPostAndGet(t *testing.T) {
+	s := newStore(t, "a.test", "b.test")
+	checkGroup(t, s, "a.test", 0, 1, 0)
+
+	if err := s.Post(testArticle("<1@x>", "a.test", "one\n")); err != nil {
+		t.Fatalf("Error posting: %v", err)
+	}
+	if err := s.Post(testArticle("<2@x>", "a.test,b.test,c.test", "two\nlines\n")); err != nil {
+		t.Fatalf("Error posting crosspost: %v", err)
+	}
+	checkGroup(t, s, "a.test", 2, 1, 2)
+	checkGroup(t, s, "b.test", 1, 1, 1)
+
+	for _, test := range []struct {
+		group string
+		id    string
+		err   error
+	}{
+		{"", "<2@x>", nil},
+		{"a.test", "2", nil},
+		{"b.test", "1", nil},
+		{"b.test", "2", nntpserver.ErrInvalidArticleNumber},
+		{"", "1", nntpserver.ErrNoGroupSelected},
+		{"", "<3@x>", nntpserver.ErrInvalidMessageID},
+	} {
+		var g *nntp.Group
+		if test.group != "" {
+			g, _ = s.GetGroup(test.group)
+		}
+		a, err := s.GetArticle(g, test.id)
+		if err != test.err {
+			t.Errorf("GetArticle(%v, %v) = %v, wanted %v", test.group, test.id, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		body, _ := ioutil.ReadAll(a.Body)
+		if a.MessageID() != "<2@x>" || string(body) != "two\nlines\n" || a.Bytes != 10 || a.Lines != 2 {
+			t.Errorf("GetArticle(%v, %v) = %v %q %d %d", test.group, test.id,
+				a.MessageID(), body, a.Bytes, a.Lines)
+		}
+		if x := a.Header.Get("Xref"); x != "test.example.com a.test:2 b.test:1" {
+			t.Errorf("Xref = %q", x)
+		}
+	}
+
+	for _, a := range []*nntp.Article{
+		testArticle("<1@x>", "a.test", "again"),
+		testArticle("<3@x>", "c.test", "nowhere"),
+		testArticle("", "a.test", "anonymous"),
+	} {
+		if err := s.Post(a); err != nntpserver.ErrPostingFailed {
+			t.Errorf("Post(%v to %v) = %v", a.MessageID(), a.Header.Get("Newsgroups"), err)
+		}
+	}
+
+	groups, _ := s.ListGroups(-1)
+	if len(groups) != 2 || groups[0].Name != "a.test" || groups[1].Name != "b.test" {
+		t.Errorf("ListGroups = %v", groups)
+	}
+}
+
+func TestGetArticles(t *testing.T) {
+	s := newStore(t, "a.test")
+	for i := 1; i <= 5; i++ {
+		s.Post(testArticle(fmt.Sprintf("<%d@x>", i), "a.test", "body"))
+	}
+	g, _ := s.GetGroup("a.test")
+	for _, test := range []struct {
+		from, to int64
+		exp      string
+	}{
+		{0, math.MaxInt64, "1 2 3 4 5"},
+		{2, 4, "2 3 4"},
+		{4, 100, "4 5"},
+		{6, 10, ""},
+	} {
+		articles, err := s.GetArticles(g, test.from, test.to)
+		if err != nil {
+			t.Fatalf("Error getting articles: %v", err)
+		}
+		nums := []string{}
+		for _, a := range articles {
+			nums = append(nums, fmt.Sprint(a.Num))
+		}
+		if got := strings.Join(nums, " "); got != test.exp {
+			t.Errorf("GetArticles(%d, %d) = %v, wanted %v", test.from, test.to, got, test.exp)
+		}
+
+		nums = nums[:0]
+		s.EachOverview(g, test.from, test.to, func(r nntpserver.OverviewRecord) error {
+			nums = append(nums, fmt.Sprint(r.Num))
+			return nil
+		})
+		if got := strings.Join(nums, " "); got != test.exp {
+			t.Errorf("EachOverview(%d, %d) = %v, wanted %v", test.from, test.to, got, test.exp)
+		}
+	}
+
+	// Streaming stops at the first error.
+	n := 0
+	err := s.EachArticle(g, 1, 5, func(a nntpserver.NumberedArticle) error {
+		if n++; a.Num == 2 {
+			return nntpserver.ErrPostingFailed
+		}
+		return nil
+	})
+	if err != nntpserver.ErrPostingFailed || n != 2 {
+		t.Errorf("EachArticle returned %v after %d articles", err, n)
+	}
+}
+
+func TestMaxArticles(t *testing.T) {
+	s := newStore(t, "a.test", "b.test")
+	s.MaxArticles = 2
+	s.Post(testArticle("<1@x>", "a.test,b.test", "body"))
+	s.Post(testArticle("<2@x>", "a.test", "body"))
+	s.Post(testArticle("<3@x>", "a.test", "body"))
+	checkGroup(t, s, "a.test", 2, 2, 3)
+
+	// Still in b.test.
+	if _, err := s.GetArticle(nil, "<1@x>"); err != nil {
+		t.Errorf("Crossposted article lost: %v", err)
+	}
+	s.Post(testArticle("<4@x>", "b.test", "body"))
+	s.Post(testArticle("<5@x>", "b.test", "body"))
+	if _, err := s.GetArticle(nil, "<1@x>"); err != nntpserver.ErrInvalidMessageID {
+		t.Errorf("Expected article gone from both groups, got %v", err)
+	}
+}
+
+func TestRemoval(t *testing.T) {
+	s := newStore(t, "a.test", "b.test")
+	s.Post(testArticle("<1@x>", "a.test,b.test", "body"))
+	s.Post(testArticle("<2@x>", "a.test", "body"))
+	s.Post(testArticle("<3@x>", "a.test", "body"))
+
+	if err := s.DeleteArticle("<1@x>"); err != nil {
+		t.Fatalf("Error deleting: %v", err)
+	}
+	checkGroup(t, s, "a.test", 2, 2, 3)
+	checkGroup(t, s, "b.test", 0, 2, 1)
+
+	g, _ := s.GetGroup("a.test")
+	if err := s.ExpireArticles(g, []int64{3}); err != nil {
+		t.Fatalf("Error expiring: %v", err)
+	}
+	checkGroup(t, s, "a.test", 1, 2, 3)
+
+	if err := s.RemoveGroup("a.test"); err != nil {
+		t.Fatalf("Error removing group: %v", err)
+	}
+	if _, err := s.GetArticle(nil, "<2@x>"); err != nntpserver.ErrInvalidMessageID {
+		t.Errorf("Article of removed group still there: %v", err)
+	}
+	if _, err := s.GetGroup("a.test"); err != nntpserver.ErrNoSuchGroup {
+		t.Errorf("Removed group still there: %v", err)
+	}
+
+	// Numbers aren't reused when a group comes back.
+	s.CreateGroup(&nntp.Group{Name: "a.test"})
+	s.Post(testArticle("<4@x>", "a.test", "body"))
+	checkGroup(t, s, "a.test", 1, 4, 4)
+}
+
+func TestExpirer(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	s := newStore(t, "a.test")
+	for i, age := range []int{10, 5, 1} {
+		a := testArticle(fmt.Sprintf("<%d@x>", i), "a.test", "body")
+		a.Header.Set("Date", now.Add(-time.Duration(age)*24*time.Hour).Format(time.RFC1123Z))
+		s.Post(a)
+	}
+	e := &nntpserver.Expirer{
+		Backend: s,
+		Rules:   []nntpserver.RetentionRule{{Groups: "*", MaxAge: 7 * 24 * time.Hour}},
+		Now:     func() time.Time { return now },
+	}
+	exps, err := e.Expire()
+	if err != nil || len(exps) != 1 || exps[0].MessageID != "<0@x>" {
+		t.Fatalf("Expire() = %v, %v", exps, err)
+	}
+	checkGroup(t, s, "a.test", 2, 2, 3)
+}
+
+func TestConcurrentUse(t *testing.T) {
+	s := newStore(t, "a.test", "b.test")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				s.Post(testArticle(fmt.Sprintf("<%d.%d@x>", i, j), "a.test,b.test", "body"))
+				g, _ := s.GetGroup("a.test")
+				s.GetArticles(g, g.Low, g.High)
+				s.ListGroups(-1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	checkGroup(t, s, "a.test", 400, 1, 400)
+	checkGroup(t, s, "b.test", 400, 1, 400)
+}
@@ -0,0 +1,407 @@
+// Package overview keeps a database of overview records, so a backend
+// can answer OVER, HDR and LISTGROUP without loading articles.
+//
+// A backend feeds an Index from Post, after numbering the article, and
+// tells it when articles or groups go away.  Embedding an *Index makes
+// a backend an nntpserver.OverviewBackend and OverviewStreamer.
+//
+// An Index opened on a directory keeps a file per group, in the
+// traditional tab-separated NOV format, that records are appended to
+// as they are added.  Removals are appended as "-" lines until Compact
+// rewrites the file.  Files aren't synced as they are written, since
+// an overview can be rebuilt from the articles; call Sync to do so.
+package overview
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-nntp"
+	"github.com/dustin/go-nntp/server"
+)
+
+type groupIndex struct {
+	// Records in ascending order of number.
+	recs []nntpserver.OverviewRecord
+	f    *os.File
+	// How many lines of f Compact could drop.
+	dead int
+}
+
+func (g *groupIndex) find(num int64) int {
+	return sort.Search(len(g.recs), func(i int) bool { return g.recs[i].Num >= num })
+}
+
+func (g *groupIndex) put(r nntpserver.OverviewRecord) {
+	i := g.find(r.Num)
+	switch {
+	case i < len(g.recs) && g.recs[i].Num == r.Num:
+		g.recs[i] = r
+	case i == len(g.recs):
+		g.recs = append(g.recs, r)
+	default:
+		g.recs = append(g.recs, nntpserver.OverviewRecord{})
+		copy(g.recs[i+1:], g.recs[i:])
+		g.recs[i] = r
+	}
+}
+
+func (g *groupIndex) remove(num int64) bool {
+	i := g.find(num)
+	if i == len(g.recs) || g.recs[i].Num != num {
+		return false
+	}
+	g.recs = append(g.recs[:i], g.recs[i+1:]...)
+	return true
+}
+
+// An Index holds overview records by group.  It is safe for concurrent
+// use.
+type Index struct {
+	dir    string
+	mu     sync.RWMutex
+	groups map[string]*groupIndex
+}
+
+// New builds an Index kept only in memory.
+func New() *Index {
+	return &Index{groups: map[string]*groupIndex{}}
+}
+
+// Open loads the Index kept in dir, creating it if needed.
+func Open(dir string) (*Index, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	x := &Index{dir: dir, groups: map[string]*groupIndex{}}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		if err := x.load(fi.Name()); err != nil {
+			x.Close()
+			return nil, err
+		}
+	}
+	return x, nil
+}
+
+// load reads a group's file.  A line torn by a crash at its end is cut
+// off.
+func (x *Index) load(name string) error {
+	f, err := os.OpenFile(filepath.Join(x.dir, name), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	g := &groupIndex{f: f}
+	var good int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		good += int64(len(line))
+		if rec, ok := parseRecord(line); ok {
+			g.put(rec)
+		} else if strings.HasPrefix(line, "-\t") {
+			if num, err := strconv.ParseInt(strings.TrimSpace(line[2:]), 10, 64); err == nil {
+				g.remove(num)
+			}
+			g.dead += 2
+		}
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return err
+	}
+	x.groups[name] = g
+	return nil
+}
+
+func formatRecord(r *nntpserver.OverviewRecord) string {
+	return fmt.Sprintf("%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", r.Num,
+		r.Subject, r.From, r.Date, r.MessageID, r.References,
+		r.Bytes, r.Lines, r.Xref)
+}
+
+func parseRecord(line string) (nntpserver.OverviewRecord, bool) {
+	fields := strings.Split(strings.TrimRight(line, "\n"), "\t")
+	if len(fields) != 9 {
+		return nntpserver.OverviewRecord{}, false
+	}
+	num, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nntpserver.OverviewRecord{}, false
+	}
+	b, _ := strconv.Atoi(fields[6])
+	l, _ := strconv.Atoi(fields[7])
+	return nntpserver.OverviewRecord{
+		Num:        num,
+		Subject:    fields[1],
+		From:       fields[2],
+		Date:       fields[3],
+		MessageID:  fields[4],
+		References: fields[5],
+		Bytes:      b,
+		Lines:      l,
+		Xref:       fields[8],
+	}, true
+}
+
+func validGroup(name string) bool {
+	return name != "" && name[0] != '.' && !strings.ContainsAny(name, "/\\ \t\n")
+}
+
+// group returns a group's index, creating it if asked to.  The caller
+// must hold x.mu for writing if create is set.
+func (x *Index) group(name string, create bool) (*groupIndex, error) {
+	g := x.groups[name]
+	if g != nil || !create {
+		return g, nil
+	}
+	if !validGroup(name) {
+		return nil, fmt.Errorf("invalid group name %q", name)
+	}
+	g = &groupIndex{}
+	if x.dir != "" {
+		f, err := os.OpenFile(filepath.Join(x.dir, name),
+			os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		g.f = f
+	}
+	x.groups[name] = g
+	return g, nil
+}
+
+// write appends lines to a group's file, if it has one.
+func (g *groupIndex) write(lines string) error {
+	if g.f == nil {
+		return nil
+	}
+	_, err := io.WriteString(g.f, lines)
+	return err
+}
+
+// Add records an article in each group its Xref header numbers it in.
+// The article's Bytes and Lines must be set; its body is not read.
+func (x *Index) Add(article *nntp.Article) error {
+	for _, e := range nntpserver.ParseXref(article.Header.Get("Xref")) {
+		if err := x.Put(e.Group, nntpserver.NewOverviewRecord(e.Num, article)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put records an overview record in a group, replacing any with the
+// same number.
+func (x *Index) Put(group string, r nntpserver.OverviewRecord) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	g, err := x.group(group, true)
+	if err != nil {
+		return err
+	}
+	if err := g.write(formatRecord(&r)); err != nil {
+		return err
+	}
+	g.put(r)
+	return nil
+}
+
+// Remove drops the records with the given numbers from a group.
+func (x *Index) Remove(group string, nums ...int64) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	g, _ := x.group(group, false)
+	if g == nil {
+		return nil
+	}
+	var lines strings.Builder
+	for _, num := range nums {
+		if g.remove(num) {
+			fmt.Fprintf(&lines, "-\t%d\n", num)
+			g.dead += 2
+		}
+	}
+	return g.write(lines.String())
+}
+
+// RemoveMessage drops the records of the article with the given message
+// ID from every group.
+func (x *Index) RemoveMessage(id string) error {
+	x.mu.RLock()
+	found := map[string][]int64{}
+	for name, g := range x.groups {
+		for _, r := range g.recs {
+			if r.MessageID == id {
+				found[name] = append(found[name], r.Num)
+			}
+		}
+	}
+	x.mu.RUnlock()
+	for name, nums := range found {
+		if err := x.Remove(name, nums...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveGroup drops a group's records.
+func (x *Index) RemoveGroup(group string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	g := x.groups[group]
+	if g == nil {
+		return nil
+	}
+	delete(x.groups, group)
+	if g.f == nil {
+		return nil
+	}
+	g.f.Close()
+	return os.Remove(filepath.Join(x.dir, group))
+}
+
+// Len returns the number of records held for a group.
+func (x *Index) Len(group string) int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if g := x.groups[group]; g != nil {
+		return len(g.recs)
+	}
+	return 0
+}
+
+// GetOverview returns a group's records numbered from from to to
+// inclusive, in order.
+func (x *Index) GetOverview(group *nntp.Group, from, to int64) ([]nntpserver.OverviewRecord, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	rv := []nntpserver.OverviewRecord{}
+	g := x.groups[group.Name]
+	if g == nil {
+		return rv, nil
+	}
+	for i := g.find(from); i < len(g.recs) && g.recs[i].Num <= to; i++ {
+		rv = append(rv, g.recs[i])
+	}
+	return rv, nil
+}
+
+// EachOverview calls f with each of a group's records numbered from
+// from to to, in order, stopping with f's error if it returns one.  The
+// index isn't locked while f runs.
+func (x *Index) EachOverview(group *nntp.Group, from, to int64, f func(nntpserver.OverviewRecord) error) error {
+	for {
+		x.mu.RLock()
+		g := x.groups[group.Name]
+		var r nntpserver.OverviewRecord
+		found := false
+		if g != nil {
+			if i := g.find(from); i < len(g.recs) && g.recs[i].Num <= to {
+				r, found = g.recs[i], true
+			}
+		}
+		x.mu.RUnlock()
+		if !found {
+			return nil
+		}
+		if err := f(r); err != nil {
+			return err
+		}
+		if r.Num == to {
+			return nil
+		}
+		from = r.Num + 1
+	}
+}
+
+// Sync flushes the group files to disk.
+func (x *Index) Sync() error {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	for _, g := range x.groups {
+		if g.f == nil {
+			continue
+		}
+		if err := g.f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact rewrites the group files that have removed records in them.
+func (x *Index) Compact() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for name, g := range x.groups {
+		if g.f == nil || g.dead == 0 {
+			continue
+		}
+		path := filepath.Join(x.dir, name)
+		tmp, err := ioutil.TempFile(x.dir, "."+name)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(tmp)
+		for i := range g.recs {
+			w.WriteString(formatRecord(&g.recs[i]))
+		}
+		err = w.Flush()
+		if err == nil {
+			err = tmp.Sync()
+		}
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		g.f.Close()
+		g.f = f
+		g.dead = 0
+	}
+	return nil
+}
+
+// Close closes the group files.
+func (x *Index) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var rv error
+	for _, g := range x.groups {
+		if g.f == nil {
+			continue
+		}
+		if err := g.f.Close(); err != nil && rv == nil {
+			rv = err
+		}
+	}
+	return rv
+}
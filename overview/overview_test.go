@@ -0,0 +1,102 @@
+package overview
+
+import (
+	"io/ioutil"
+	"math"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dustin/go-nntp"
+	"github.com/dustin/go-nntp/server"
+)
+
+func nums(t *testing.T, x *Index, group string) []int64 {
+	t.Helper()
+	recs, err := x.GetOverview(&nntp.Group{Name: group}, 0, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Error getting overview: %v", err)
+	}
+	rv := []int64{}
+	for _, r := range recs {
+		rv = append(rv, r.Num)
+	}
+	return rv
+}
+
+func TestIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overview")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	x, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Error opening: %v", err)
+	}
+	for i, xref := range []string{
+		"here a.test:1 b.test:1",
+		"here a.test:2",
+		"here a.test:3 b.test:2",
+	} {
+		err := x.Add(&nntp.Article{
+			Header: textproto.MIMEHeader{
+				"Subject":    {"Tabs\tand\r\nbreaks"},
+				"Message-Id": {"<" + string(rune('a'+i)) + "@x>"},
+				"Xref":       {xref},
+			},
+			Bytes: 10 * i,
+			Lines: i,
+		})
+		if err != nil {
+			t.Fatalf("Error adding: %v", err)
+		}
+	}
+	x.Remove("a.test", 2)
+	x.RemoveMessage("<a@x>")
+	x.Close()
+
+	// A crash mid-write leaves a torn line, which is ignored.
+	f, _ := os.OpenFile(filepath.Join(dir, "a.test"), os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString("4\ttorn")
+	f.Close()
+
+	x, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Error reopening: %v", err)
+	}
+	defer x.Close()
+	if got := nums(t, x, "a.test"); len(got) != 1 || got[0] != 3 {
+		t.Errorf("a.test has %v", got)
+	}
+	if got := nums(t, x, "b.test"); len(got) != 1 || got[0] != 2 {
+		t.Errorf("b.test has %v", got)
+	}
+
+	recs, _ := x.GetOverview(&nntp.Group{Name: "b.test"}, 2, 2)
+	exp := nntpserver.OverviewRecord{
+		Num:       2,
+		Subject:   "Tabs and  breaks",
+		MessageID: "<c@x>",
+		Bytes:     20,
+		Lines:     2,
+		Xref:      "here a.test:3 b.test:2",
+	}
+	if len(recs) != 1 || recs[0] != exp {
+		t.Errorf("Got %+v, wanted %+v", recs, exp)
+	}
+
+	if err := x.Compact(); err != nil {
+		t.Fatalf("Error compacting: %v", err)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "a.test"))
+	if string(data) != "3\tTabs and  breaks\t\t\t<c@x>\t\t20\t2\there a.test:3 b.test:2\n" {
+		t.Errorf("Compacted file is %q", data)
+	}
+	x.RemoveGroup("b.test")
+	if _, err := os.Stat(filepath.Join(dir, "b.test")); !os.IsNotExist(err) {
+		t.Errorf("Removed group's file still there: %v", err)
+	}
+}
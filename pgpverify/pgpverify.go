@@ -0,0 +1,263 @@
+// Package pgpverify checks and creates the X-PGP-Sig signatures used to
+// authenticate Usenet control messages, compatible with INN's pgpverify
+// and signcontrol.
+package pgpverify
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-nntp"
+	"github.com/dustin/go-nntp/server"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// DefaultHeaders are the headers signed by Sign when none are given,
+// the same ones signcontrol signs.
+var DefaultHeaders = []string{
+	"Subject", "Control", "Message-ID", "Date", "From", "Sender",
+}
+
+// Version is the version token written at the start of X-PGP-Sig.
+const Version = "GoNNTP"
+
+// ErrNoSignature is returned when verifying an article without an
+// X-PGP-Sig header.
+var ErrNoSignature = errors.New("article has no X-PGP-Sig header")
+
+// ErrMalformedSignature is returned when X-PGP-Sig can't be parsed.
+var ErrMalformedSignature = errors.New("malformed X-PGP-Sig header")
+
+// ErrControlUnsigned is returned when a control message's signature
+// doesn't cover its Control header.
+var ErrControlUnsigned = errors.New("X-PGP-Sig does not sign the Control header")
+
+// ErrEmptyControl is returned by SignedControl for a blank control
+// message.
+var ErrEmptyControl = errors.New("empty control message")
+
+// ReadKeyring reads an armored or binary OpenPGP keyring.
+func ReadKeyring(r io.Reader) (openpgp.EntityList, error) {
+	br := bufio.NewReader(r)
+	if start, err := br.Peek(5); err == nil && string(start) == "-----" {
+		return openpgp.ReadArmoredKeyRing(br)
+	}
+	return openpgp.ReadKeyRing(br)
+}
+
+// signedText builds the text covered by an X-PGP-Sig signature.
+func signedText(header textproto.MIMEHeader, body []byte, signed []string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "X-Signed-Headers: %s\n", strings.Join(signed, ","))
+	for _, k := range signed {
+		fmt.Fprintf(&buf, "%s: %s\n", k, header.Get(k))
+	}
+	buf.WriteString("\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// Verify checks the X-PGP-Sig signature of an article against keyring
+// and returns the key that made it.  Control messages must have their
+// Control header signed.
+func Verify(keyring openpgp.KeyRing, header textproto.MIMEHeader, body []byte) (*openpgp.Entity, error) {
+	v := header.Get("X-PGP-Sig")
+	if v == "" {
+		return nil, ErrNoSignature
+	}
+	// Folded lines have been joined with spaces by the time the
+	// header was parsed, so each field is one line of the signature.
+	fields := strings.Fields(v)
+	if len(fields) < 3 {
+		return nil, ErrMalformedSignature
+	}
+	signed := strings.Split(fields[1], ",")
+	if header.Get("Control") != "" && !containsFold(signed, "Control") {
+		return nil, ErrControlUnsigned
+	}
+
+	armored := fmt.Sprintf(
+		"-----BEGIN PGP SIGNATURE-----\nVersion: %s\n\n%s\n-----END PGP SIGNATURE-----\n",
+		fields[0], strings.Join(fields[2:], "\n"))
+
+	return openpgp.CheckArmoredDetachedSignature(keyring,
+		bytes.NewReader(signedText(header, body, signed)),
+		strings.NewReader(armored), nil)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign signs the given headers and the body of an article with signer,
+// and sets the article's X-PGP-Sig header.  If signed is nil,
+// DefaultHeaders are signed.
+func Sign(signer *openpgp.Entity, header textproto.MIMEHeader, body []byte, signed []string) error {
+	if signed == nil {
+		signed = DefaultHeaders
+	}
+	var armored bytes.Buffer
+	err := openpgp.ArmoredDetachSignText(&armored, signer,
+		bytes.NewReader(signedText(header, body, signed)), nil)
+	if err != nil {
+		return err
+	}
+
+	// Keep the armor's payload, dropping its delimiters and headers.
+	lines := []string{}
+	inBody := false
+	for _, l := range strings.Split(armored.String(), "\n") {
+		l = strings.TrimSpace(l)
+		switch {
+		case strings.HasPrefix(l, "-----"):
+		case !inBody:
+			inBody = l == ""
+		case l != "":
+			lines = append(lines, l)
+		}
+	}
+
+	header.Set("X-PGP-Sig", fmt.Sprintf("%s %s\r\n\t%s", Version,
+		strings.Join(signed, ","), strings.Join(lines, "\r\n\t")))
+	return nil
+}
+
+// Identifies reports whether e has a user ID matching signer, either in
+// full ("Name <address>") or by address alone.
+func Identifies(e *openpgp.Entity, signer string) bool {
+	for name, id := range e.Identities {
+		if strings.EqualFold(name, signer) ||
+			(id.UserId != nil && strings.EqualFold(id.UserId.Email, signer)) {
+			return true
+		}
+	}
+	return false
+}
+
+// A Rule requires control messages for some groups to be signed by a
+// particular key, like a verify-<signer> entry in INN's control.ctl.
+type Rule struct {
+	// Verbs is a wildmat matched against the control verb.
+	Verbs string
+	// Groups is a wildmat every group the message acts on must match.
+	Groups string
+	// Signer identifies the key that must have signed the message:
+	// one of its user IDs, or the address in one.
+	Signer string
+	// Action is taken for correctly signed messages.
+	Action nntpserver.ControlAction
+}
+
+func (r *Rule) matches(msg *nntpserver.ControlMessage) bool {
+	if !nntp.MatchWildmat(r.Verbs, msg.Verb) {
+		return false
+	}
+	for _, g := range msg.Groups() {
+		if !nntp.MatchWildmat(r.Groups, g) {
+			return false
+		}
+	}
+	return true
+}
+
+// A Verifier is an nntpserver.ControlPolicy that only lets control
+// messages through when they are signed by the key their hierarchy
+// requires.  The last matching rule applies, as in control.ctl.
+type Verifier struct {
+	Keyring openpgp.KeyRing
+	Rules   []Rule
+	// Unverified is the action for messages that match a rule but
+	// aren't signed by its signer.  It defaults to ControlLog.
+	Unverified nntpserver.ControlAction
+	// Fallback decides about messages no rule matches.  If nil, they
+	// are logged.
+	Fallback nntpserver.ControlPolicy
+}
+
+// Authorize verifies msg against the last rule it matches.
+func (v *Verifier) Authorize(msg *nntpserver.ControlMessage) nntpserver.ControlAction {
+	var rule *Rule
+	for i := range v.Rules {
+		if v.Rules[i].matches(msg) {
+			rule = &v.Rules[i]
+		}
+	}
+	if rule == nil {
+		if v.Fallback != nil {
+			return v.Fallback.Authorize(msg)
+		}
+		return nntpserver.ControlLog
+	}
+
+	e, err := Verify(v.Keyring, msg.Header, msg.Body)
+	if err != nil || !Identifies(e, rule.Signer) {
+		return v.Unverified
+	}
+	return rule.Action
+}
+
+// SignedControl builds a control message from the given sender, signs
+// it with signer and returns it ready for nntpclient's Post.  For
+// example, a newgroup could be issued with
+//
+//	body := "For your newsgroups file:\ncomp.lang.go\tThe Go language.\n"
+//	r, err := pgpverify.SignedControl(key, "admin@example.com",
+//		"newgroup comp.lang.go", "comp.lang.go", []byte(body))
+//	...
+//	err = client.Post(r)
+func SignedControl(signer *openpgp.Entity, from, control, newsgroups string, body []byte) (io.Reader, error) {
+	verb := strings.Fields(control)
+	if len(verb) == 0 {
+		return nil, ErrEmptyControl
+	}
+	domain := "localhost"
+	if a, err := mail.ParseAddress(from); err == nil {
+		if i := strings.LastIndex(a.Address, "@"); i >= 0 {
+			domain = a.Address[i+1:]
+		}
+	}
+	now := time.Now()
+
+	h := textproto.MIMEHeader{}
+	h.Set("From", from)
+	h.Set("Approved", from)
+	h.Set("Newsgroups", newsgroups)
+	h.Set("Subject", "cmsg "+control)
+	h.Set("Control", control)
+	h.Set("Message-ID", fmt.Sprintf("<%s-%d@%s>",
+		verb[0], now.UnixNano(), domain))
+	h.Set("Date", now.Format(time.RFC1123Z))
+
+	if err := Sign(signer, h, body, nil); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return &buf, nil
+}
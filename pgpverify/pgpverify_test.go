@@ -0,0 +1,132 @@
+package pgpverify
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"testing"
+
+	"github.com/dustin/go-nntp"
+	"github.com/dustin/go-nntp/client"
+	"github.com/dustin/go-nntp/memstore"
+	"github.com/dustin/go-nntp/server"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+func newKey(t *testing.T, email string) *openpgp.Entity {
+	e, err := openpgp.NewEntity("Test", "", email, &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatalf("Error creating key: %v", err)
+	}
+	return e
+}
+
+func TestSignedControl(t *testing.T) {
+	admin := newKey(t, "admin@example.com")
+	other := newKey(t, "other@example.com")
+	keyring := openpgp.EntityList{admin, other}
+
+	r, err := SignedControl(admin, "admin@example.com",
+		"newgroup comp.lang.go", "comp.lang.go",
+		[]byte("For your newsgroups file:\ncomp.lang.go\tGo.\n"))
+	if err != nil {
+		t.Fatalf("Error signing: %v", err)
+	}
+	br := bufio.NewReader(r)
+	h, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("Error reading signed headers: %v", err)
+	}
+	body, _ := ioutil.ReadAll(br)
+
+	e, err := Verify(keyring, h, body)
+	if err != nil {
+		t.Fatalf("Error verifying: %v", err)
+	}
+	if !Identifies(e, "admin@example.com") {
+		t.Fatalf("Signed by the wrong key: %v", e.Identities)
+	}
+
+	msg := &nntpserver.ControlMessage{
+		Verb:   "newgroup",
+		Args:   []string{"comp.lang.go"},
+		Header: h,
+		Body:   body,
+	}
+	v := &Verifier{
+		Keyring: keyring,
+		Rules: []Rule{
+			{Verbs: "*", Groups: "comp.*", Signer: "admin@example.com",
+				Action: nntpserver.ControlApply},
+		},
+		Unverified: nntpserver.ControlDrop,
+	}
+	if a := v.Authorize(msg); a != nntpserver.ControlApply {
+		t.Errorf("Signed message got %v", a)
+	}
+
+	v.Rules[0].Signer = "other@example.com"
+	if a := v.Authorize(msg); a != nntpserver.ControlDrop {
+		t.Errorf("Message signed by the wrong key got %v", a)
+	}
+	v.Rules[0].Signer = "admin@example.com"
+
+	h.Set("Control", "rmgroup comp.lang.go")
+	if _, err := Verify(keyring, h, body); err == nil {
+		t.Errorf("Tampered header verified")
+	}
+	if a := v.Authorize(msg); a != nntpserver.ControlDrop {
+		t.Errorf("Tampered message got %v", a)
+	}
+}
+
+func TestSignedControlEmpty(t *testing.T) {
+	if _, err := SignedControl(newKey(t, "admin@example.com"), "admin@example.com",
+		" ", "comp.lang.go", nil); err != ErrEmptyControl {
+		t.Errorf("Blank control message gave %v", err)
+	}
+}
+
+func TestServerNewgroup(t *testing.T) {
+	admin := newKey(t, "admin@example.com")
+	store := memstore.New("news.example.com")
+	store.CreateGroup(&nntp.Group{Name: "control", Posting: nntp.PostingPermitted})
+	s := nntpserver.NewServer(store)
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	s.Controls = &nntpserver.Controls{Policy: &Verifier{
+		Keyring: openpgp.EntityList{admin},
+		Rules: []Rule{
+			{Verbs: "newgroup", Groups: "comp.*", Signer: "admin@example.com",
+				Action: nntpserver.ControlApply},
+		},
+		Unverified: nntpserver.ControlDrop,
+	}}
+
+	srv, cli := net.Pipe()
+	go s.Process(srv)
+	c, err := nntpclient.NewConn(cli)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	r, err := SignedControl(admin, "admin@example.com", "newgroup comp.lang.go",
+		"control", []byte("For your newsgroups file:\ncomp.lang.go\tThe Go language.\n"))
+	if err != nil {
+		t.Fatalf("Error signing: %v", err)
+	}
+	if err := c.Post(r); err != nil {
+		t.Fatalf("Error posting: %v", err)
+	}
+	g, err := store.GetGroup("comp.lang.go")
+	if err != nil {
+		t.Fatalf("Group wasn't created: %v", err)
+	}
+	if g.Description != "The Go language." {
+		t.Errorf("Description = %q", g.Description)
+	}
+}
@@ -0,0 +1,365 @@
+// Package proxy provides an nntpserver.Backend that forwards to an
+// upstream NNTP server, so a go-nntp server can put its own
+// authentication, access control and logging in front of another
+// server, such as a Usenet provider's.
+//
+// Requests are made over a pool of nntpclient connections, each
+// remembering the group it has selected upstream.  Wrap a Backend in an
+// nntpserver.Cache to avoid asking the upstream server the same thing
+// repeatedly.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-nntp"
+	"github.com/dustin/go-nntp/client"
+	"github.com/dustin/go-nntp/server"
+)
+
+// ErrUpstream is returned when the upstream server can't be reached,
+// or answers in a way that can't be understood.
+var ErrUpstream = &nntpserver.NNTPError{Code: 403, Msg: "Upstream server unavailable"}
+
+// A Backend forwards requests to an upstream server.  It is safe for
+// concurrent use.
+//
+// Besides Backend, a Backend implements nntpserver.OverviewBackend.
+type Backend struct {
+	// Dial opens an authenticated connection to the upstream server.
+	Dial func() (*nntpclient.Client, error)
+	// Logger receives the Backend's log output.  If nil, the log
+	// package's standard logger is used.
+	Logger *log.Logger
+
+	mu   sync.Mutex
+	idle []*conn
+	// sem holds a token for each connection in use.  A Backend built
+	// without New has no limit.
+	sem chan struct{}
+}
+
+// A conn is a pooled connection.
+type conn struct {
+	*nntpclient.Client
+	// The group selected upstream, if any.
+	group string
+}
+
+// New builds a Backend using at most maxConns connections from dial at
+// once.
+func New(dial func() (*nntpclient.Client, error), maxConns int) *Backend {
+	if maxConns < 1 {
+		maxConns = 1
+	}
+	return &Backend{
+		Dial: dial,
+		sem:  make(chan struct{}, maxConns),
+	}
+}
+
+func (b *Backend) logf(format string, args ...interface{}) {
+	if b.Logger != nil {
+		b.Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// Close closes the idle connections.
+func (b *Backend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.idle {
+		c.Close()
+	}
+	b.idle = nil
+	return nil
+}
+
+// get returns an idle connection, or a new one.  reused is true for an
+// idle one, which the upstream server may have closed meanwhile.
+func (b *Backend) get() (c *conn, reused bool, err error) {
+	b.mu.Lock()
+	if n := len(b.idle); n > 0 {
+		c = b.idle[n-1]
+		b.idle = b.idle[:n-1]
+		b.mu.Unlock()
+		return c, true, nil
+	}
+	b.mu.Unlock()
+	client, err := b.Dial()
+	if err != nil {
+		return nil, false, err
+	}
+	return &conn{Client: client}, false, nil
+}
+
+func (b *Backend) put(c *conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.idle = append(b.idle, c)
+}
+
+// do calls f with a connection.  Protocol errors from the upstream
+// server are returned as NNTPErrors with the same code, leaving the
+// connection usable.  Other errors close it, and f is tried again if
+// it had been idle.
+func (b *Backend) do(f func(c *conn) error) error {
+	if b.sem != nil {
+		b.sem <- struct{}{}
+		defer func() { <-b.sem }()
+	}
+	for {
+		c, reused, err := b.get()
+		if err != nil {
+			b.logf("Error connecting upstream: %v", err)
+			return ErrUpstream
+		}
+		err = f(c)
+		switch e := err.(type) {
+		case nil, *nntpserver.NNTPError:
+			b.put(c)
+			return err
+		case *textproto.Error:
+			b.put(c)
+			return &nntpserver.NNTPError{Code: e.Code, Msg: e.Msg}
+		}
+		c.Close()
+		if !reused {
+			b.logf("Error from upstream: %v", err)
+			return ErrUpstream
+		}
+	}
+}
+
+func (c *conn) selectGroup(name string) error {
+	if c.group == name {
+		return nil
+	}
+	if _, err := c.Group(name); err != nil {
+		return err
+	}
+	c.group = name
+	return nil
+}
+
+// ListGroups lists the upstream server's active groups.
+func (b *Backend) ListGroups(max int) ([]*nntp.Group, error) {
+	var groups []nntp.Group
+	err := b.do(func(c *conn) (err error) {
+		groups, err = c.List("ACTIVE")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && len(groups) > max {
+		groups = groups[:max]
+	}
+	rv := make([]*nntp.Group, len(groups))
+	for i := range groups {
+		rv[i] = &groups[i]
+	}
+	return rv, nil
+}
+
+// GetGroup selects a group upstream.
+func (b *Backend) GetGroup(name string) (*nntp.Group, error) {
+	var g nntp.Group
+	err := b.do(func(c *conn) (err error) {
+		c.group = ""
+		if g, err = c.Group(name); err != nil {
+			return err
+		}
+		c.group = name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// readArticle fetches an article, by number in the connection's
+// selected group or by message ID.
+func (c *conn) readArticle(id string) (*nntp.Article, error) {
+	_, _, r, err := c.Article(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(bytes.NewReader(data))
+	h, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		return nil, ErrUpstream
+	}
+	body, _ := ioutil.ReadAll(br)
+	return &nntp.Article{
+		Header: h,
+		Body:   bytes.NewReader(body),
+		Bytes:  len(body),
+		Lines:  bytes.Count(body, []byte{'\n'}),
+	}, nil
+}
+
+// GetArticle fetches an article by message ID, or by number in the
+// given group.
+func (b *Backend) GetArticle(group *nntp.Group, id string) (*nntp.Article, error) {
+	var a *nntp.Article
+	err := b.do(func(c *conn) (err error) {
+		if !strings.HasPrefix(id, "<") {
+			if group == nil {
+				return nntpserver.ErrNoGroupSelected
+			}
+			if err := c.selectGroup(group.Name); err != nil {
+				return err
+			}
+		}
+		a, err = c.readArticle(id)
+		return err
+	})
+	return a, err
+}
+
+func overRange(from, to int64) string {
+	if to == math.MaxInt64 {
+		return fmt.Sprintf("%d-", from)
+	}
+	return fmt.Sprintf("%d-%d", from, to)
+}
+
+// over fetches the overview of a group's articles numbered from from
+// to to.  An empty range isn't an error.
+func (c *conn) over(group string, from, to int64) ([]nntpserver.OverviewRecord, error) {
+	if err := c.selectGroup(group); err != nil {
+		return nil, err
+	}
+	lines, err := c.Over(overRange(from, to))
+	if e, ok := err.(*textproto.Error); ok && e.Code == 423 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]nntpserver.OverviewRecord, 0, len(lines))
+	for _, l := range lines {
+		if r, ok := parseOverview(l); ok {
+			rv = append(rv, r)
+		}
+	}
+	return rv, nil
+}
+
+// parseOverview parses an OVER response line in the RFC 3977 format,
+// with the Xref header among any extra fields.
+func parseOverview(l string) (nntpserver.OverviewRecord, bool) {
+	var r nntpserver.OverviewRecord
+	f := strings.Split(l, "\t")
+	if len(f) < 8 {
+		return r, false
+	}
+	var err error
+	if r.Num, err = strconv.ParseInt(f[0], 10, 64); err != nil {
+		return r, false
+	}
+	r.Subject, r.From, r.Date, r.MessageID, r.References = f[1], f[2], f[3], f[4], f[5]
+	r.Bytes, _ = strconv.Atoi(f[6])
+	r.Lines, _ = strconv.Atoi(f[7])
+	for _, x := range f[8:] {
+		if len(x) > 5 && strings.EqualFold(x[:5], "xref:") {
+			r.Xref = strings.TrimSpace(x[5:])
+		}
+	}
+	return r, true
+}
+
+// GetArticles fetches a group's articles numbered from from to to,
+// finding their numbers with OVER.
+func (b *Backend) GetArticles(group *nntp.Group, from, to int64) ([]nntpserver.NumberedArticle, error) {
+	var rv []nntpserver.NumberedArticle
+	err := b.do(func(c *conn) error {
+		rv = nil
+		recs, err := c.over(group.Name, from, to)
+		if err != nil {
+			return err
+		}
+		for _, r := range recs {
+			a, err := c.readArticle(strconv.FormatInt(r.Num, 10))
+			if e, ok := err.(*textproto.Error); ok && e.Code == 423 {
+				// Gone since the overview was read.
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			rv = append(rv, nntpserver.NumberedArticle{Num: r.Num, Article: a})
+		}
+		return nil
+	})
+	return rv, err
+}
+
+// GetOverview fetches the overview of a group's articles numbered from
+// from to to.
+func (b *Backend) GetOverview(group *nntp.Group, from, to int64) ([]nntpserver.OverviewRecord, error) {
+	var rv []nntpserver.OverviewRecord
+	err := b.do(func(c *conn) (err error) {
+		rv, err = c.over(group.Name, from, to)
+		return err
+	})
+	return rv, err
+}
+
+// Authorized returns true.  Put authentication in front of a Backend
+// by wrapping it.
+func (b *Backend) Authorized() bool {
+	return true
+}
+
+// Authenticate always fails.
+func (b *Backend) Authenticate(user, pass string) (nntpserver.Backend, error) {
+	return nil, nntpserver.ErrAuthRejected
+}
+
+// AllowPost returns true, leaving the upstream server to refuse posts.
+func (b *Backend) AllowPost() bool {
+	return true
+}
+
+// Post posts an article upstream.
+func (b *Backend) Post(article *nntp.Article) error {
+	var buf bytes.Buffer
+	keys := make([]string, 0, len(article.Header))
+	for k := range article.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range article.Header[k] {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+		}
+	}
+	buf.WriteString("\r\n")
+	if _, err := io.Copy(&buf, article.Body); err != nil {
+		return err
+	}
+	text := buf.Bytes()
+	return b.do(func(c *conn) error {
+		return c.Post(bytes.NewReader(text))
+	})
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-nntp"
+	"github.com/dustin/go-nntp/client"
+	"github.com/dustin/go-nntp/memstore"
+	"github.com/dustin/go-nntp/server"
+)
+
+var discardLogger = log.New(ioutil.Discard, "", 0)
+
+func testArticle(id, body string) *nntp.Article {
+	return &nntp.Article{
+		Header: textproto.MIMEHeader{
+			"Message-Id": {id},
+			"Newsgroups": {"misc.test"},
+			"Subject":    {"Subject of " + id},
+		},
+		Body: strings.NewReader(body),
+	}
+}
+
+// upstream starts a server for a Backend to proxy, returning it with
+// the number of connections made to it.
+func upstream(t *testing.T) (*Backend, *int) {
+	store := memstore.New("upstream.example.com")
+	store.CreateGroup(&nntp.Group{Name: "misc.test", Posting: nntp.PostingPermitted})
+	store.Post(testArticle("<1@x>", "one\n"))
+	store.Post(testArticle("<2@x>", "two\nlines\n"))
+	s := nntpserver.NewServer(store)
+	s.Logger = discardLogger
+
+	dials := 0
+	b := New(func() (*nntpclient.Client, error) {
+		dials++
+		srv, cli := net.Pipe()
+		go s.Process(srv)
+		return nntpclient.NewConn(cli)
+	}, 2)
+	b.Logger = discardLogger
+	return b, &dials
+}
+
+func TestProxy(t *testing.T) {
+	b, dials := upstream(t)
+	defer b.Close()
+
+	g, err := b.GetGroup("misc.test")
+	if err != nil || g.Count != 2 || g.High != 2 {
+		t.Fatalf("GetGroup = %+v, %v", g, err)
+	}
+	if _, err := b.GetGroup("no.such"); err == nil || err.(*nntpserver.NNTPError).Code != 411 {
+		t.Errorf("Expected no such group, got %v", err)
+	}
+	if groups, err := b.ListGroups(-1); err != nil || len(groups) != 1 || groups[0].Name != "misc.test" {
+		t.Errorf("ListGroups = %v, %v", groups, err)
+	}
+
+	recs, err := b.GetOverview(g, 1, math.MaxInt64)
+	if err != nil || len(recs) != 2 || recs[1].MessageID != "<2@x>" || recs[1].Lines != 2 {
+		t.Errorf("GetOverview = %+v, %v", recs, err)
+	}
+	if recs, err := b.GetOverview(g, 5, 10); err != nil || len(recs) != 0 {
+		t.Errorf("Expected an empty range, got %+v, %v", recs, err)
+	}
+
+	for _, id := range []string{"2", "<2@x>"} {
+		a, err := b.GetArticle(g, id)
+		if err != nil {
+			t.Fatalf("Error getting %v: %v", id, err)
+		}
+		body, _ := ioutil.ReadAll(a.Body)
+		if a.Header.Get("Subject") != "Subject of <2@x>" || string(body) != "two\nlines\n" {
+			t.Errorf("%v: got %v %q", id, a.Header, body)
+		}
+	}
+	if _, err := b.GetArticle(g, "<9@x>"); err == nil || err.(*nntpserver.NNTPError).Code != 430 {
+		t.Errorf("Expected no such article, got %v", err)
+	}
+
+	if err := b.Post(testArticle("<3@x>", "three\n")); err != nil {
+		t.Fatalf("Error posting: %v", err)
+	}
+	articles, err := b.GetArticles(g, 2, 3)
+	if err != nil || len(articles) != 2 || articles[1].Article.MessageID() != "<3@x>" {
+		t.Errorf("GetArticles = %v, %v", articles, err)
+	}
+
+	// Everything above went over one connection.
+	if *dials != 1 {
+		t.Errorf("Dialed %d times", *dials)
+	}
+
+	// A connection the upstream server dropped is replaced.
+	b.idle[0].Close()
+	if _, err := b.GetGroup("misc.test"); err != nil {
+		t.Errorf("Error after reconnecting: %v", err)
+	}
+	if *dials != 2 {
+		t.Errorf("Dialed %d times", *dials)
+	}
+}
@@ -0,0 +1,170 @@
+package nntpserver
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/dustin/go-nntp"
+)
+
+// An Access is what a client may do with a group.
+type Access int
+
+// Access values, each allowing what the ones before it do.
+const (
+	// AccessHidden hides the group: it seems not to exist.
+	AccessHidden = Access(iota)
+	// AccessRead allows reading the group.
+	AccessRead
+	// AccessPost allows reading and posting to the group.
+	AccessPost
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessHidden:
+		return "hidden"
+	case AccessRead:
+		return "read"
+	case AccessPost:
+		return "post"
+	}
+	return fmt.Sprintf("Access(%d)", int(a))
+}
+
+// ClientInfo describes a session's client for access control.
+type ClientInfo struct {
+	// User is the name the client authenticated as, if it did.
+	User string
+	// IP is the client's address, if known.
+	IP net.IP
+	// TLS is true if the connection is encrypted.
+	TLS bool
+}
+
+// An ACLRule grants access to some groups to the clients it matches.
+type ACLRule struct {
+	// Users is a wildmat matched against the name the client
+	// authenticated as.  If empty, the rule matches clients whether
+	// they authenticated or not; otherwise it never matches
+	// unauthenticated ones.
+	Users string
+	// Networks, if set, limits the rule to clients whose address is
+	// in one of them.
+	Networks []*net.IPNet
+	// TLS limits the rule to clients using TLS.
+	TLS bool
+	// Groups is a wildmat selecting the groups the rule applies to.
+	Groups string
+	Access Access
+}
+
+func (r *ACLRule) matchesClient(c *ClientInfo) bool {
+	if r.Users != "" && (c.User == "" || !nntp.MatchWildmat(r.Users, c.User)) {
+		return false
+	}
+	if r.TLS && !c.TLS {
+		return false
+	}
+	if len(r.Networks) == 0 {
+		return true
+	}
+	for _, n := range r.Networks {
+		if c.IP != nil && n.Contains(c.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// An ACL decides what access clients have to each group, in the style
+// of INN's readers.conf: the last rule matching both the client and the
+// group decides.  Groups no rule matches are hidden.
+type ACL []ACLRule
+
+// Access returns the access the client has to the named group.
+func (acl ACL) Access(c *ClientInfo, group string) Access {
+	access := AccessHidden
+	for i := range acl {
+		if acl[i].matchesClient(c) && nntp.MatchWildmat(acl[i].Groups, group) {
+			access = acl[i].Access
+		}
+	}
+	return access
+}
+
+// MayPost reports whether any rule lets the client post somewhere.
+func (acl ACL) MayPost(c *ClientInfo) bool {
+	for i := range acl {
+		if acl[i].Access == AccessPost && acl[i].matchesClient(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *session) clientInfo() *ClientInfo {
+	c := &ClientInfo{User: s.user, TLS: s.tls}
+	if s.remote != nil {
+		host := s.remote.String()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		c.IP = net.ParseIP(host)
+	}
+	return c
+}
+
+// access returns the session's access to the named group.  Without an
+// ACL, everything is allowed, leaving the backend to decide.
+func (s *session) access(group string) Access {
+	if s.server.ACL == nil {
+		return AccessPost
+	}
+	return s.server.ACL.Access(s.clientInfo(), group)
+}
+
+// mayPost reports whether the session may post at all.
+func (s *session) mayPost() bool {
+	if !s.backend.AllowPost() || !s.offers("POST") {
+		return false
+	}
+	return s.server.ACL == nil || s.server.ACL.MayPost(s.clientInfo())
+}
+
+// getGroup fetches a group the session may read.
+func (s *session) getGroup(name string) (*nntp.Group, error) {
+	if s.access(name) < AccessRead {
+		return nil, ErrNoSuchGroup
+	}
+	return s.backend.GetGroup(name)
+}
+
+// readable reports whether the session may read an article, by being
+// able to read any of its newsgroups.
+func (s *session) readable(article *nntp.Article) bool {
+	if s.server.ACL == nil {
+		return true
+	}
+	for _, g := range SplitGroups(article.Header.Get("Newsgroups")) {
+		if s.access(g) >= AccessRead {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPostGroups refuses an article posted to a group the session may
+// not post to.
+func (s *session) checkPostGroups(article *nntp.Article) error {
+	if s.server.ACL == nil {
+		return nil
+	}
+	for _, g := range SplitGroups(article.Header.Get("Newsgroups")) {
+		if s.access(g) < AccessPost {
+			s.server.count("acl_post_denied")
+			return &NNTPError{441, "Posting to " + g + " not permitted"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package nntpserver
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-nntp"
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+var testACL = ACL{
+	{Groups: "*", Access: AccessRead},
+	{Groups: "local.*", Access: AccessHidden},
+	{Users: "staff*", Groups: "local.*", Access: AccessPost},
+	{Networks: []*net.IPNet{mustCIDR("10.0.0.0/8")}, Groups: "comp.*", Access: AccessPost},
+	{Users: "*", TLS: true, Groups: "secure.*", Access: AccessRead},
+}
+
+func TestACL(t *testing.T) {
+	anon := &ClientInfo{IP: net.ParseIP("192.0.2.1")}
+	inside := &ClientInfo{IP: net.ParseIP("10.1.2.3")}
+	staff := &ClientInfo{User: "staff1", IP: net.ParseIP("192.0.2.1")}
+	staffTLS := &ClientInfo{User: "staff1", TLS: true}
+	for _, test := range []struct {
+		c     *ClientInfo
+		group string
+		exp   Access
+	}{
+		{anon, "comp.lang.go", AccessRead},
+		{anon, "local.chat", AccessHidden},
+		{inside, "comp.lang.go", AccessPost},
+		{inside, "local.chat", AccessHidden},
+		{staff, "local.chat", AccessPost},
+		{staff, "comp.lang.go", AccessRead},
+		{staff, "secure.docs", AccessRead},
+		{&ClientInfo{TLS: true}, "secure.docs", AccessRead},
+		{staffTLS, "secure.docs", AccessRead},
+	} {
+		if got := testACL.Access(test.c, test.group); got != test.exp {
+			t.Errorf("%+v on %v: got %v, wanted %v", test.c, test.group, got, test.exp)
+		}
+	}
+	if testACL.MayPost(anon) || !testACL.MayPost(inside) || !testACL.MayPost(staff) {
+		t.Errorf("MayPost is wrong")
+	}
+	if (ACL{{Groups: "*", Access: AccessRead}}).Access(staffTLS, "secure.docs") != AccessRead {
+		t.Errorf("Rule without Users didn't match an authenticated client")
+	}
+}
+
+// aclBackend has a public group and a private one, with an article in
+// the private one.
+type aclBackend struct {
+	authBackend
+	posted []string
+}
+
+func (ab *aclBackend) ListGroups(max int) ([]*nntp.Group, error) {
+	return []*nntp.Group{
+		{Name: "comp.lang.go", Posting: nntp.PostingPermitted},
+		{Name: "local.chat", Posting: nntp.PostingPermitted},
+	}, nil
+}
+
+func (ab *aclBackend) GetGroup(name string) (*nntp.Group, error) {
+	return &nntp.Group{Name: name}, nil
+}
+
+func (ab *aclBackend) GetArticle(group *nntp.Group, id string) (*nntp.Article, error) {
+	return &nntp.Article{
+		Header: textproto.MIMEHeader{
+			"Message-Id": {id},
+			"Newsgroups": {"local.chat"},
+		},
+		Body: strings.NewReader("private\n"),
+	}, nil
+}
+
+func (ab *aclBackend) Post(article *nntp.Article) error {
+	ab.posted = append(ab.posted, article.Header.Get("Newsgroups"))
+	return nil
+}
+
+func TestACLSession(t *testing.T) {
+	b := &aclBackend{}
+	s := NewServer(b)
+	s.ACL = testACL
+	c, _ := startSession(t, s)
+	defer c.Close()
+
+	check := func(cmd string, code int) {
+		t.Helper()
+		c.PrintfLine(cmd)
+		if _, _, err := c.ReadCodeLine(code); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		if code == 220 {
+			c.ReadDotLines()
+		}
+	}
+	post := func(groups string, code int) {
+		t.Helper()
+		check("POST", 340)
+		dw := c.DotWriter()
+		io.WriteString(dw, "Newsgroups: "+groups+"\nSubject: test\n\nbody\n")
+		dw.Close()
+		if _, _, err := c.ReadCodeLine(code); err != nil {
+			t.Errorf("Post to %v: %v", groups, err)
+		}
+	}
+
+	if got := readLines(t, c, "LIST", 215); got != "comp.lang.go 0 0 n" {
+		t.Errorf("Anonymous LIST = %q", got)
+	}
+	if got := readLines(t, c, "CAPABILITIES", 101); strings.Contains(got, "|POST|") {
+		t.Errorf("Anonymous CAPABILITIES offers POST: %q", got)
+	}
+	check("GROUP local.chat", 411)
+	check("LISTGROUP local.chat", 411)
+	check("GROUP comp.lang.go", 211)
+	check("ARTICLE <private@x>", 430)
+	check("HDR Subject <private@x>", 430)
+	check("POST", 440)
+
+	check("AUTHINFO USER staff1", 350)
+	check("AUTHINFO PASS secret", 250)
+	if got := readLines(t, c, "LIST", 215); got != "comp.lang.go 0 0 n|local.chat 0 0 y" {
+		t.Errorf("Staff LIST = %q", got)
+	}
+	check("GROUP local.chat", 211)
+	check("ARTICLE <private@x>", 220)
+	post("local.chat,comp.lang.go", 441)
+	post("local.chat", 240)
+	if len(b.posted) != 1 || b.posted[0] != "local.chat" {
+		t.Errorf("Posted %v", b.posted)
+	}
+	if n := s.Stats.Get("acl_post_denied").String(); n != "1" {
+		t.Errorf("Expected 1 denied post, got %v", n)
+	}
+}
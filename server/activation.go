@@ -0,0 +1,132 @@
+package nntpserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The first file descriptor systemd passes (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+// SystemdListeners returns the listening sockets systemd passed to the
+// process by socket activation, in the order they're configured, or
+// none if it wasn't started that way.  The LISTEN_* environment
+// variables are cleared so child processes don't inherit them.
+func SystemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		// FileListener dups the descriptor, close-on-exec.
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket %v: %v", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// StdioConn returns a connection to a client on the process's standard
+// input and output, for running a single session under inetd or as an
+// ssh command.  Under inetd, standard input is the client's socket.
+// Otherwise the client's address is taken from SSH_CLIENT, if set.
+func StdioConn() net.Conn {
+	if nc, err := net.FileConn(os.Stdin); err == nil {
+		return nc
+	}
+	var remote net.Addr = stdioAddr("stdin")
+	if fields := strings.Fields(os.Getenv("SSH_CLIENT")); len(fields) == 3 {
+		port, _ := strconv.Atoi(fields[1])
+		if ip := net.ParseIP(fields[0]); ip != nil {
+			remote = &net.TCPAddr{IP: ip, Port: port}
+		}
+	}
+	return NewStreamConn(os.Stdin, os.Stdout, stdioAddr("stdout"), remote)
+}
+
+// NewStreamConn returns a net.Conn reading from r and writing to w, so
+// Process can serve a session over a pair of pipes or any other
+// streams.  Closing it closes r and w if they are io.Closers.
+// Deadlines are passed on to r and w if they support them, as *os.File
+// does for pipes.
+func NewStreamConn(r io.Reader, w io.Writer, local, remote net.Addr) net.Conn {
+	return &streamConn{r: r, w: w, local: local, remote: remote}
+}
+
+type streamConn struct {
+	r             io.Reader
+	w             io.Writer
+	local, remote net.Addr
+}
+
+type stdioAddr string
+
+func (a stdioAddr) Network() string { return "stdio" }
+func (a stdioAddr) String() string  { return string(a) }
+
+var errNoDeadline = errors.New("deadlines not supported")
+
+func (sc *streamConn) Read(p []byte) (int, error)  { return sc.r.Read(p) }
+func (sc *streamConn) Write(p []byte) (int, error) { return sc.w.Write(p) }
+func (sc *streamConn) LocalAddr() net.Addr         { return sc.local }
+func (sc *streamConn) RemoteAddr() net.Addr        { return sc.remote }
+
+func (sc *streamConn) Close() error {
+	var err error
+	for _, x := range []interface{}{sc.r, sc.w} {
+		if c, ok := x.(io.Closer); ok {
+			if e := c.Close(); err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func (sc *streamConn) SetDeadline(t time.Time) error {
+	if err := sc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return sc.SetWriteDeadline(t)
+}
+
+func (sc *streamConn) SetReadDeadline(t time.Time) error {
+	if d, ok := sc.r.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return errNoDeadline
+}
+
+func (sc *streamConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := sc.w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return errNoDeadline
+}
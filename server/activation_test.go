@@ -0,0 +1,74 @@
+package nntpserver
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStreamConn(t *testing.T) {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4711}
+	nc := NewStreamConn(inR, outW, stdioAddr("stdout"), remote)
+	if err := nc.SetDeadline(time.Now()); err != errNoDeadline {
+		t.Errorf("SetDeadline on io.Pipe = %v", err)
+	}
+
+	s := NewServer(&aclBackend{})
+	s.Logger = discardLogger
+	s.ACL = ACL{{Networks: []*net.IPNet{mustCIDR("192.0.2.0/24")}, Groups: "comp.*", Access: AccessRead}}
+	done := make(chan struct{})
+	go func() {
+		s.Process(nc)
+		close(done)
+	}()
+
+	c := textproto.NewConn(struct {
+		io.Reader
+		io.WriteCloser
+	}{outR, inW})
+	if _, _, err := c.ReadCodeLine(200); err != nil {
+		t.Fatalf("Error reading banner: %v", err)
+	}
+	// The ACL sees the client's address.
+	if got := readLines(t, c, "LIST", 215); got != "comp.lang.go 0 0 n" {
+		t.Errorf("LIST = %q", got)
+	}
+	c.PrintfLine("QUIT")
+	c.ReadCodeLine(205)
+	<-done
+	if _, err := inW.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("Session didn't close its input: %v", err)
+	}
+}
+
+func TestSystemdListeners(t *testing.T) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	if ls, err := SystemdListeners(); ls != nil || err != nil {
+		t.Errorf("Listeners for another process = %v, %v", ls, err)
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "x")
+	if _, err := SystemdListeners(); err == nil {
+		t.Errorf("Expected an error for bad LISTEN_FDS")
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "0")
+	if ls, err := SystemdListeners(); len(ls) != 0 || err != nil {
+		t.Errorf("No listeners = %v, %v", ls, err)
+	}
+	if os.Getenv("LISTEN_PID") != "" {
+		t.Errorf("LISTEN_PID wasn't cleared")
+	}
+}
@@ -0,0 +1,101 @@
+package nntpserver
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+
+	"github.com/dustin/go-nntp"
+)
+
+// ErrArticleTooLarge is returned when a posted article exceeds the
+// server's MaxArticleSize.  Reads from the article body fail with it
+// once the limit has been passed.
+var ErrArticleTooLarge = &NNTPError{441, "Article too large"}
+
+// ErrTransferFailed is returned to an IHAVE peer that should try the
+// article again later.
+var ErrTransferFailed = &NNTPError{436, "Transfer failed, try again later"}
+
+// ErrTransferRejected is returned to an IHAVE peer whose article was
+// refused and should not be offered again.
+var ErrTransferRejected = &NNTPError{437, "Transfer rejected, do not retry"}
+
+// An articleReader reads one dot-encoded article sent by a client,
+// enforcing the server's size limit, and makes sure the article is
+// consumed up to its terminating dot however much of it the backend
+// read.
+type articleReader struct {
+	dot io.Reader
+	max int64
+	// n counts the bytes read from dot, including any past max.
+	n        int64
+	tooLarge bool
+	// finished, if set, is called with the article's size once it has
+	// been read to the end.
+	finished func(n int64)
+}
+
+func (ar *articleReader) Read(p []byte) (int, error) {
+	if ar.tooLarge {
+		return 0, ErrArticleTooLarge
+	}
+	// Ask for at most one byte past the limit, which is enough to
+	// notice the article is too large.
+	if ar.max > 0 && int64(len(p)) > ar.max-ar.n+1 {
+		p = p[:ar.max-ar.n+1]
+	}
+	n, err := ar.dot.Read(p)
+	ar.n += int64(n)
+	if ar.max > 0 && ar.n > ar.max {
+		n -= int(ar.n - ar.max)
+		ar.tooLarge = true
+		return n, ErrArticleTooLarge
+	}
+	return n, err
+}
+
+// finish discards whatever is left of the article and settles on the
+// error to report for it.  An error reading the rest of the article
+// from the connection takes precedence, since the session can't go on.
+func (ar *articleReader) finish(err error) error {
+	// What the backend left is counted too, or refused articles would
+	// cost nothing.
+	drained, derr := io.Copy(ioutil.Discard, ar.dot)
+	ar.n += drained
+	if ar.finished != nil {
+		ar.finished(ar.n)
+		ar.finished = nil
+	}
+	if derr != nil {
+		return derr
+	}
+	if ar.tooLarge {
+		return ErrArticleTooLarge
+	}
+	return err
+}
+
+// readArticle reads the headers of an article being sent by the client
+// and returns the article with its body positioned after them.  The
+// returned articleReader is valid even on error, and its finish method
+// must be called before the next response is written.
+func (s *session) readArticle(c *textproto.Conn) (*nntp.Article, *articleReader, error) {
+	ar := &articleReader{dot: c.DotReader(), max: s.server.MaxArticleSize}
+	br := bufio.NewReader(ar)
+	h, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, ar, err
+	}
+	return &nntp.Article{Header: h, Body: br}, ar, nil
+}
+
+// ihaveError translates an error meant for a POST into the
+// corresponding IHAVE response.
+func ihaveError(err error) error {
+	if e, ok := err.(*NNTPError); ok && e.Code == 441 {
+		return &NNTPError{ErrTransferRejected.Code, e.Msg}
+	}
+	return err
+}
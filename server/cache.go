@@ -0,0 +1,487 @@
+package nntpserver
+
+import (
+	"bytes"
+	"container/list"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-nntp"
+)
+
+// A Cache is a Backend that keeps the results of a slower Backend.
+// Groups are kept for GroupTTL.  Articles, looked up by number or
+// message ID, and overview ranges are kept in memory, least recently
+// used first to go once MaxBytes is reached.  Posting an article
+// forgets what was cached about its newsgroups.
+//
+// Besides Backend, a Cache implements OverviewBackend, computing
+// overviews from GetArticles if the wrapped Backend can't.  Its
+// OverviewStreamer and ArticleStreamer methods stream from the wrapped
+// Backend when it can, bypassing the cache.  It passes on
+// ArticleChecker, ArticleDeleter, GroupCreator, GroupRemover and
+// ArticleExpirer calls, forgetting what they change.  The Backends
+// returned by Authenticate aren't cached.
+type Cache struct {
+	// Backend is the wrapped Backend.
+	Backend
+	// GroupTTL is how long groups are kept.  Zero disables group
+	// caching.
+	GroupTTL time.Duration
+	// MaxBytes limits the approximate size of the articles and
+	// overviews kept.  Zero disables their caching.
+	MaxBytes int64
+	// Stats counts hits and misses (e.g. "article_hits").
+	Stats *expvar.Map
+	// Now returns the current time.  It defaults to time.Now.
+	Now func() time.Time
+
+	mu sync.Mutex
+	// The whole group list, and when it was fetched.
+	list   []*nntp.Group
+	listAt time.Time
+	groups map[string]cachedGroup
+	lru    *list.List
+	items  map[string]*list.Element
+	size   int64
+	// Overview ranges are keyed by their group's generation, bumped
+	// when it changes, and by epoch, bumped when any group might have.
+	gens  map[string]int64
+	epoch int64
+	// changes counts the times anything was forgotten, so a group
+	// fetched meanwhile isn't cached.
+	changes int64
+}
+
+type cachedGroup struct {
+	g  *nntp.Group
+	at time.Time
+}
+
+type cacheItem struct {
+	key  string
+	size int64
+	// One of an article, the message ID of a numbered article, or an
+	// overview range.
+	article  *cachedArticle
+	id       string
+	overview []OverviewRecord
+}
+
+type cachedArticle struct {
+	header       textproto.MIMEHeader
+	body         []byte
+	bytes, lines int
+}
+
+// NewCache wraps b in a Cache with the given group TTL and size limit.
+func NewCache(b Backend, groupTTL time.Duration, maxBytes int64) *Cache {
+	return &Cache{
+		Backend:  b,
+		GroupTTL: groupTTL,
+		MaxBytes: maxBytes,
+		Stats:    new(expvar.Map).Init(),
+		Now:      time.Now,
+	}
+}
+
+func (c *Cache) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+func (c *Cache) count(kind string, hit bool) {
+	if c.Stats == nil {
+		return
+	}
+	if hit {
+		c.Stats.Add(kind+"_hits", 1)
+	} else {
+		c.Stats.Add(kind+"_misses", 1)
+	}
+}
+
+func copyGroups(groups []*nntp.Group) []*nntp.Group {
+	rv := make([]*nntp.Group, len(groups))
+	for i, g := range groups {
+		cp := *g
+		rv[i] = &cp
+	}
+	return rv
+}
+
+// ListGroups returns the wrapped Backend's groups, from the cache if
+// they were listed less than GroupTTL ago.
+func (c *Cache) ListGroups(max int) ([]*nntp.Group, error) {
+	c.mu.Lock()
+	if c.list != nil && c.now().Sub(c.listAt) < c.GroupTTL {
+		rv := c.list
+		c.mu.Unlock()
+		c.count("group", true)
+		if max > 0 && len(rv) > max {
+			rv = rv[:max]
+		}
+		return copyGroups(rv), nil
+	}
+	changes := c.changes
+	c.mu.Unlock()
+	c.count("group", false)
+
+	rv, err := c.Backend.ListGroups(-1)
+	if err != nil || c.GroupTTL <= 0 {
+		return rv, err
+	}
+	c.mu.Lock()
+	if changes == c.changes {
+		now := c.now()
+		c.list, c.listAt = copyGroups(rv), now
+		if c.groups == nil {
+			c.groups = map[string]cachedGroup{}
+		}
+		for _, g := range c.list {
+			c.groups[g.Name] = cachedGroup{g, now}
+		}
+	}
+	c.mu.Unlock()
+	if max > 0 && len(rv) > max {
+		rv = rv[:max]
+	}
+	return rv, nil
+}
+
+// GetGroup returns the named group, from the cache if it was fetched
+// less than GroupTTL ago.
+func (c *Cache) GetGroup(name string) (*nntp.Group, error) {
+	c.mu.Lock()
+	cg, ok := c.groups[name]
+	changes := c.changes
+	c.mu.Unlock()
+	if ok && c.now().Sub(cg.at) < c.GroupTTL {
+		c.count("group", true)
+		rv := *cg.g
+		return &rv, nil
+	}
+	c.count("group", false)
+
+	g, err := c.Backend.GetGroup(name)
+	if err != nil || c.GroupTTL <= 0 {
+		return g, err
+	}
+	cp := *g
+	c.mu.Lock()
+	if changes == c.changes {
+		if c.groups == nil {
+			c.groups = map[string]cachedGroup{}
+		}
+		c.groups[name] = cachedGroup{&cp, c.now()}
+	}
+	c.mu.Unlock()
+	return g, nil
+}
+
+// get returns the item with the given key, marking it used.
+func (c *Cache) get(key string) *cacheItem {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheItem)
+}
+
+// put stores an item, making room for it.  Items bigger than the cache
+// aren't stored.
+func (c *Cache) put(it *cacheItem) {
+	it.size += int64(len(it.key)) + 64
+	if it.size > c.MaxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru == nil {
+		c.lru = list.New()
+		c.items = map[string]*list.Element{}
+	}
+	if e, ok := c.items[it.key]; ok {
+		c.remove(e)
+	}
+	c.items[it.key] = c.lru.PushFront(it)
+	c.size += it.size
+	for c.size > c.MaxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops an item.  The caller must hold c.mu.
+func (c *Cache) remove(e *list.Element) {
+	it := c.lru.Remove(e).(*cacheItem)
+	delete(c.items, it.key)
+	c.size -= it.size
+}
+
+func (ca *cachedArticle) article() *nntp.Article {
+	h := make(textproto.MIMEHeader, len(ca.header))
+	for k, v := range ca.header {
+		h[k] = append([]string(nil), v...)
+	}
+	return &nntp.Article{
+		Header: h,
+		Body:   bytes.NewReader(ca.body),
+		Bytes:  ca.bytes,
+		Lines:  ca.lines,
+	}
+}
+
+// GetArticle returns an article by message ID, or by number in the
+// given group, from the cache if it's there.
+func (c *Cache) GetArticle(group *nntp.Group, id string) (*nntp.Article, error) {
+	key := "a " + id
+	if _, err := strconv.ParseInt(id, 10, 64); err == nil && group != nil {
+		key = "n " + group.Name + " " + id
+	}
+	if c.MaxBytes > 0 {
+		it := c.get(key)
+		if it != nil && it.id != "" {
+			it = c.get("a " + it.id)
+		}
+		if it != nil {
+			c.count("article", true)
+			return it.article.article(), nil
+		}
+	}
+	c.count("article", false)
+
+	a, err := c.Backend.GetArticle(group, id)
+	if err != nil || c.MaxBytes <= 0 {
+		return a, err
+	}
+	body, err := ioutil.ReadAll(a.Body)
+	if err != nil {
+		return nil, err
+	}
+	ca := &cachedArticle{header: a.Header, body: body, bytes: a.Bytes, lines: a.Lines}
+	size := int64(len(body))
+	for k, v := range a.Header {
+		size += int64(len(k))
+		for _, s := range v {
+			size += int64(len(s))
+		}
+	}
+	msgid := a.MessageID()
+	if msgid == "" {
+		msgid = id
+	}
+	c.put(&cacheItem{key: "a " + msgid, size: size, article: ca})
+	if key != "a "+msgid {
+		c.put(&cacheItem{key: key, size: int64(len(msgid)), id: msgid})
+	}
+	return ca.article(), nil
+}
+
+// GetOverview returns the overview of a group's articles numbered from
+// from to to, from the cache if the same range was asked for since the
+// group last changed.
+func (c *Cache) GetOverview(group *nntp.Group, from, to int64) ([]OverviewRecord, error) {
+	c.mu.Lock()
+	key := fmt.Sprintf("o %s %d %d %d %d", group.Name, c.epoch, c.gens[group.Name], from, to)
+	c.mu.Unlock()
+	if c.MaxBytes > 0 {
+		if it := c.get(key); it != nil {
+			c.count("overview", true)
+			return append([]OverviewRecord(nil), it.overview...), nil
+		}
+	}
+	c.count("overview", false)
+
+	var rv []OverviewRecord
+	if ob, ok := c.Backend.(OverviewBackend); ok {
+		var err error
+		if rv, err = ob.GetOverview(group, from, to); err != nil {
+			return nil, err
+		}
+	} else {
+		articles, err := c.Backend.GetArticles(group, from, to)
+		if err != nil {
+			return nil, err
+		}
+		rv = make([]OverviewRecord, 0, len(articles))
+		for _, a := range articles {
+			rv = append(rv, NewOverviewRecord(a.Num, a.Article))
+		}
+	}
+	// An open-ended range would be cached afresh after each post.
+	if c.MaxBytes > 0 && to != math.MaxInt64 {
+		size := int64(0)
+		for _, r := range rv {
+			size += int64(len(r.Subject)+len(r.From)+len(r.Date)+
+				len(r.MessageID)+len(r.References)+len(r.Xref)) + 64
+		}
+		c.put(&cacheItem{key: key, size: size, overview: append([]OverviewRecord(nil), rv...)})
+	}
+	return rv, nil
+}
+
+// EachOverview hands the overview of a group's articles numbered from
+// from to to to f, straight from the wrapped Backend if it is an
+// OverviewStreamer, or an ArticleStreamer without overview records of
+// its own, and otherwise from GetOverview.
+func (c *Cache) EachOverview(group *nntp.Group, from, to int64, f func(OverviewRecord) error) error {
+	switch b := c.Backend.(type) {
+	case OverviewStreamer:
+		return b.EachOverview(group, from, to, f)
+	case OverviewBackend:
+		// Its records are worth caching.
+	case ArticleStreamer:
+		return b.EachArticle(group, from, to, func(a NumberedArticle) error {
+			return f(NewOverviewRecord(a.Num, a.Article))
+		})
+	}
+	records, err := c.GetOverview(group, from, to)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err := f(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EachArticle hands a group's articles numbered from from to to to f,
+// straight from the wrapped Backend if it is an ArticleStreamer, or
+// else from GetArticles.
+func (c *Cache) EachArticle(group *nntp.Group, from, to int64, f func(NumberedArticle) error) error {
+	if as, ok := c.Backend.(ArticleStreamer); ok {
+		return as.EachArticle(group, from, to, f)
+	}
+	articles, err := c.Backend.GetArticles(group, from, to)
+	if err != nil {
+		return err
+	}
+	for _, a := range articles {
+		if err := f(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetGroups drops what's cached about the named groups.
+func (c *Cache) forgetGroups(names ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gens == nil {
+		c.gens = map[string]int64{}
+	}
+	for _, name := range names {
+		delete(c.groups, name)
+		c.gens[name]++
+	}
+	c.list = nil
+	c.changes++
+}
+
+// forgetAll drops what's cached about any group and message ID, for
+// changes that can't be pinned to a group.
+func (c *Cache) forgetAll(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.groups = nil
+	c.list = nil
+	c.epoch++
+	c.changes++
+	if e, ok := c.items["a "+id]; ok {
+		c.remove(e)
+	}
+}
+
+// Post posts the article to the wrapped Backend, and forgets what is
+// cached about its newsgroups.
+func (c *Cache) Post(article *nntp.Article) error {
+	groups := SplitGroups(article.Header.Get("Newsgroups"))
+	err := c.Backend.Post(article)
+	c.forgetGroups(groups...)
+	return err
+}
+
+// HasArticle reports whether the article with the given message ID is
+// cached, or else asks the wrapped Backend if it is an ArticleChecker.
+func (c *Cache) HasArticle(id string) (bool, error) {
+	c.mu.Lock()
+	_, ok := c.items["a "+id]
+	c.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+	ac, ok := c.Backend.(ArticleChecker)
+	if !ok {
+		return false, errCantCheck
+	}
+	return ac.HasArticle(id)
+}
+
+// DeleteArticle removes an article if the wrapped Backend is an
+// ArticleDeleter.
+func (c *Cache) DeleteArticle(id string) error {
+	d, ok := c.Backend.(ArticleDeleter)
+	if !ok {
+		return errControlUnsupported
+	}
+	err := d.DeleteArticle(id)
+	c.forgetAll(id)
+	return err
+}
+
+// CreateGroup creates or updates a group if the wrapped Backend is a
+// GroupCreator.
+func (c *Cache) CreateGroup(group *nntp.Group) error {
+	gc, ok := c.Backend.(GroupCreator)
+	if !ok {
+		return errControlUnsupported
+	}
+	err := gc.CreateGroup(group)
+	c.forgetGroups(group.Name)
+	return err
+}
+
+// RemoveGroup removes a group if the wrapped Backend is a GroupRemover.
+func (c *Cache) RemoveGroup(name string) error {
+	gr, ok := c.Backend.(GroupRemover)
+	if !ok {
+		return errControlUnsupported
+	}
+	err := gr.RemoveGroup(name)
+	c.forgetAll("")
+	return err
+}
+
+// ExpireArticles removes articles from a group if the wrapped Backend
+// is an ArticleExpirer.  Expired articles can still be found by
+// message ID until they age out of the cache.
+func (c *Cache) ExpireArticles(group *nntp.Group, nums []int64) error {
+	ae, ok := c.Backend.(ArticleExpirer)
+	if !ok {
+		return ErrExpiryUnsupported
+	}
+	err := ae.ExpireArticles(group, nums)
+	c.mu.Lock()
+	for _, n := range nums {
+		if e, ok := c.items["n "+group.Name+" "+strconv.FormatInt(n, 10)]; ok {
+			c.remove(e)
+		}
+	}
+	c.mu.Unlock()
+	c.forgetGroups(group.Name)
+	return err
+}
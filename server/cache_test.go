@@ -0,0 +1,208 @@
+package nntpserver
+
+import (
+	"io/ioutil"
+	"math"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-nntp"
+)
+
+// countingBackend is an overBackend that counts every call.
+type countingBackend struct {
+	overBackend
+	calls map[string]int
+	posts int
+}
+
+func (cb *countingBackend) ListGroups(max int) ([]*nntp.Group, error) {
+	cb.calls["ListGroups"]++
+	g, _ := cb.GetGroup("misc.test")
+	cb.calls["GetGroup"]--
+	return []*nntp.Group{g}, nil
+}
+
+func (cb *countingBackend) GetGroup(name string) (*nntp.Group, error) {
+	cb.calls["GetGroup"]++
+	return &nntp.Group{Name: name, Count: 3 + int64(cb.posts), Low: 1, High: 3 + int64(cb.posts)}, nil
+}
+
+func (cb *countingBackend) GetArticle(g *nntp.Group, id string) (*nntp.Article, error) {
+	cb.calls["GetArticle"]++
+	a, err := cb.overBackend.GetArticle(g, id)
+	if err != nil {
+		// By number.
+		as, _ := cb.overBackend.GetArticles(g, 1, 3)
+		for _, na := range as {
+			if id == string(rune('0'+na.Num)) {
+				a, err = na.Article, nil
+			}
+		}
+	}
+	if a != nil {
+		a.Body = strings.NewReader("body of " + a.MessageID())
+	}
+	return a, err
+}
+
+func (cb *countingBackend) GetArticles(g *nntp.Group, from, to int64) ([]NumberedArticle, error) {
+	cb.calls["GetArticles"]++
+	return cb.overBackend.GetArticles(g, from, to)
+}
+
+func (cb *countingBackend) Post(a *nntp.Article) error {
+	cb.posts++
+	return nil
+}
+
+func TestCache(t *testing.T) {
+	b := &countingBackend{calls: map[string]int{}}
+	now := time.Now()
+	c := NewCache(b, time.Minute, 1<<20)
+	c.Now = func() time.Time { return now }
+
+	// Groups are kept for the TTL, and ListGroups fills GetGroup's cache.
+	c.ListGroups(-1)
+	c.ListGroups(-1)
+	g, _ := c.GetGroup("misc.test")
+	if b.calls["ListGroups"] != 1 || b.calls["GetGroup"] != 0 {
+		t.Errorf("Groups fetched %v", b.calls)
+	}
+	now = now.Add(2 * time.Minute)
+	c.GetGroup("misc.test")
+	if b.calls["GetGroup"] != 1 {
+		t.Errorf("Expired group not refetched: %v", b.calls)
+	}
+
+	// Articles are the same by number and by message ID.
+	for _, id := range []string{"2", "<2@x>", "2", "<1@x>"} {
+		a, err := c.GetArticle(g, id)
+		if err != nil {
+			t.Fatalf("Error getting %v: %v", id, err)
+		}
+		body, _ := ioutil.ReadAll(a.Body)
+		if !strings.HasPrefix(a.MessageID(), "<") || string(body) != "body of "+a.MessageID() {
+			t.Errorf("%v: got %v %q", id, a.MessageID(), body)
+		}
+		a.Header.Set("Subject", "changed by the caller")
+	}
+	if b.calls["GetArticle"] != 2 {
+		t.Errorf("Articles fetched %d times", b.calls["GetArticle"])
+	}
+	if a, _ := c.GetArticle(g, "<2@x>"); a.Header.Get("Subject") != "Article\t<2@x>" {
+		t.Errorf("Cached header changed: %v", a.Header)
+	}
+
+	// Overviews are built from GetArticles, and kept until a post.
+	for i := 0; i < 2; i++ {
+		recs, _ := c.GetOverview(g, 1, 3)
+		if len(recs) != 3 || recs[2].MessageID != "<3@x>" {
+			t.Errorf("Got overview %+v", recs)
+		}
+	}
+	if b.calls["GetArticles"] != 1 {
+		t.Errorf("Overview fetched %d times", b.calls["GetArticles"])
+	}
+	c.Post(&nntp.Article{Header: textproto.MIMEHeader{"Newsgroups": {"misc.test"}}})
+	c.GetOverview(g, 1, 3)
+	if g, _ := c.GetGroup("misc.test"); g.High != 4 {
+		t.Errorf("Group not refreshed after post: %+v", g)
+	}
+	if b.calls["GetArticles"] != 2 || b.calls["GetGroup"] != 2 {
+		t.Errorf("Post didn't invalidate: %v", b.calls)
+	}
+
+	for k, exp := range map[string]string{
+		"group_hits":      "2",
+		"group_misses":    "3",
+		"article_hits":    "3",
+		"article_misses":  "2",
+		"overview_hits":   "1",
+		"overview_misses": "2",
+	} {
+		if v := c.Stats.Get(k); v == nil || v.String() != exp {
+			t.Errorf("%v = %v, expected %v", k, v, exp)
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	b := &countingBackend{calls: map[string]int{}}
+	// Room for about two articles.
+	c := NewCache(b, 0, 300)
+	g := &nntp.Group{Name: "misc.test"}
+	for _, id := range []string{"<1@x>", "<2@x>", "<1@x>", "<3@x>", "<1@x>", "<2@x>"} {
+		c.GetArticle(g, id)
+	}
+	// <2@x> was least recently used when <3@x> came in.
+	if b.calls["GetArticle"] != 4 {
+		t.Errorf("Articles fetched %d times", b.calls["GetArticle"])
+	}
+	if c.size > c.MaxBytes {
+		t.Errorf("Cache holds %d bytes", c.size)
+	}
+	// Groups aren't cached with no TTL.
+	c.GetGroup("misc.test")
+	c.GetGroup("misc.test")
+	if b.calls["GetGroup"] != 2 {
+		t.Errorf("Group fetched %d times", b.calls["GetGroup"])
+	}
+}
+
+// articleStreamBackend is a countingBackend that streams articles.
+type articleStreamBackend struct {
+	countingBackend
+	streamed int
+}
+
+func (ab *articleStreamBackend) EachArticle(g *nntp.Group, from, to int64, f func(NumberedArticle) error) error {
+	articles, _ := ab.overBackend.GetArticles(g, from, to)
+	for _, a := range articles {
+		ab.streamed++
+		if err := f(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestCacheStreaming(t *testing.T) {
+	sb := &streamBackend{sent: make(chan int64, 10)}
+	c := NewCache(sb, time.Minute, 1<<20)
+	g := &nntp.Group{Name: "misc.test"}
+	n := 0
+	err := c.EachOverview(g, 1, 3, func(r OverviewRecord) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 3 || len(sb.sent) != 3 {
+		t.Errorf("EachOverview gave %d records, backend sent %d: %v", n, len(sb.sent), err)
+	}
+
+	// Backends streaming only whole articles have them made into
+	// overview records one at a time.
+	as := &articleStreamBackend{countingBackend: countingBackend{calls: map[string]int{}}}
+	c = NewCache(as, time.Minute, 1<<20)
+	n = 0
+	err = c.EachOverview(g, 1, 3, func(r OverviewRecord) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 3 || as.streamed != 3 || as.calls["GetArticles"] != 0 {
+		t.Errorf("EachOverview gave %d records, backend streamed %d and was called %v: %v",
+			n, as.streamed, as.calls, err)
+	}
+
+	// Open-ended ranges aren't kept.
+	b := &countingBackend{calls: map[string]int{}}
+	c = NewCache(b, time.Minute, 1<<20)
+	for i := 0; i < 2; i++ {
+		c.GetOverview(g, 1, math.MaxInt64)
+	}
+	if b.calls["GetArticles"] != 2 {
+		t.Errorf("Open-ended overview fetched %d times", b.calls["GetArticles"])
+	}
+}
@@ -0,0 +1,459 @@
+package nntpserver
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-nntp"
+)
+
+// An ArticleDeleter is a Backend that can remove an article from every
+// group it appears in.  It is used to apply cancels and supersedes.
+type ArticleDeleter interface {
+	DeleteArticle(id string) error
+}
+
+// A GroupCreator is a Backend that can create groups, or update them if
+// they exist already.  It is used to apply newgroup and checkgroups.
+type GroupCreator interface {
+	CreateGroup(group *nntp.Group) error
+}
+
+// A GroupRemover is a Backend that can remove groups.  It is used to
+// apply rmgroup and checkgroups.
+type GroupRemover interface {
+	RemoveGroup(name string) error
+}
+
+// A ControlMessage is an RFC 5537 control message: an article with a
+// Control header, or one that supersedes another.
+type ControlMessage struct {
+	// Verb is the lower-cased control verb, e.g. "cancel" or
+	// "newgroup".  Articles with a Supersedes header have the verb
+	// "supersedes".
+	Verb string
+	// Args are the arguments following the verb.
+	Args   []string
+	Header textproto.MIMEHeader
+	Body   []byte
+}
+
+// Sender returns the address of the control message's sender.
+func (msg *ControlMessage) Sender() string {
+	v := msg.Header.Get("Sender")
+	if v == "" {
+		v = msg.Header.Get("From")
+	}
+	if a, err := mail.ParseAddress(v); err == nil {
+		return a.Address
+	}
+	return strings.TrimSpace(v)
+}
+
+// Groups returns the groups the control message acts on: the group
+// being created or removed, the groups listed by a checkgroups, or the
+// Newsgroups of anything else.
+func (msg *ControlMessage) Groups() []string {
+	switch msg.Verb {
+	case "newgroup", "rmgroup":
+		return msg.Args[:1]
+	case "checkgroups":
+		rv := []string{}
+		for name := range parseGroupLines(msg.Body) {
+			rv = append(rv, name)
+		}
+		sort.Strings(rv)
+		return rv
+	}
+	return SplitGroups(msg.Header.Get("Newsgroups"))
+}
+
+// parseControl recognises control messages.  It returns nil for
+// ordinary articles.
+func parseControl(h textproto.MIMEHeader) (*ControlMessage, error) {
+	var msg *ControlMessage
+	if ctl := strings.Fields(h.Get("Control")); len(ctl) > 0 {
+		msg = &ControlMessage{Verb: strings.ToLower(ctl[0]), Args: ctl[1:]}
+	} else if sup := strings.TrimSpace(h.Get("Supersedes")); sup != "" {
+		msg = &ControlMessage{Verb: "supersedes", Args: []string{sup}}
+	} else {
+		return nil, nil
+	}
+	msg.Header = h
+
+	switch msg.Verb {
+	case "cancel", "supersedes":
+		if len(msg.Args) != 1 || !validMessageID(msg.Args[0]) {
+			return nil, errMalformedControl
+		}
+	case "newgroup", "rmgroup":
+		if len(msg.Args) < 1 {
+			return nil, errMalformedControl
+		}
+	}
+	return msg, nil
+}
+
+var errMalformedControl = &NNTPError{441, "Malformed control message"}
+
+// A ControlAction says what to do with a control message.
+type ControlAction int
+
+// ControlAction values.
+const (
+	// ControlLog stores the article and logs what the control message
+	// would have done, without doing it.
+	ControlLog = ControlAction(iota)
+	// ControlDrop stores the article and ignores it.
+	ControlDrop
+	// ControlApply stores the article and carries out the control
+	// message.
+	ControlApply
+	// ControlReject refuses the article.
+	ControlReject
+)
+
+func (a ControlAction) String() string {
+	switch a {
+	case ControlLog:
+		return "log"
+	case ControlDrop:
+		return "drop"
+	case ControlApply:
+		return "apply"
+	case ControlReject:
+		return "reject"
+	}
+	return fmt.Sprintf("ControlAction(%d)", int(a))
+}
+
+// A ControlPolicy decides what to do with control messages.
+type ControlPolicy interface {
+	Authorize(msg *ControlMessage) ControlAction
+}
+
+// A ControlRule assigns an action to the control messages it matches.
+type ControlRule struct {
+	// Verbs is a wildmat matched against the control verb.
+	Verbs string
+	// Senders is a wildmat matched against the sender's address.
+	Senders string
+	// Groups is a wildmat every group the message acts on must match.
+	Groups string
+	Action ControlAction
+}
+
+func (r *ControlRule) matches(msg *ControlMessage) bool {
+	if !nntp.MatchWildmat(r.Verbs, msg.Verb) ||
+		!nntp.MatchWildmat(r.Senders, msg.Sender()) {
+		return false
+	}
+	for _, g := range msg.Groups() {
+		if !nntp.MatchWildmat(r.Groups, g) {
+			return false
+		}
+	}
+	return true
+}
+
+// ControlRules is a ControlPolicy in the style of INN's control.ctl:
+// the last matching rule decides.  Messages no rule matches are logged.
+type ControlRules []ControlRule
+
+// Authorize returns the action of the last rule matching msg.
+func (rules ControlRules) Authorize(msg *ControlMessage) ControlAction {
+	action := ControlLog
+	for i := range rules {
+		if rules[i].matches(msg) {
+			action = rules[i].Action
+		}
+	}
+	return action
+}
+
+// Controls handles control messages arriving by POST or IHAVE.
+//
+// Control messages are stored like any other article.  What happens
+// besides is decided by the Policy, and carried out with the optional
+// ArticleDeleter, GroupCreator and GroupRemover interfaces of the
+// session's backend.
+type Controls struct {
+	// Policy decides what to do with each control message.  If nil,
+	// control messages are only logged.
+	Policy ControlPolicy
+	// VerifyCancelKey requires cancels and supersedes of articles
+	// carrying a Cancel-Lock to present a matching Cancel-Key (RFC
+	// 8315).  Cancels without one, or whose target can't be found, are
+	// rejected; supersedes are stored without replacing the original.
+	VerifyCancelKey bool
+}
+
+func (ctl *Controls) authorize(msg *ControlMessage) ControlAction {
+	if ctl.Policy == nil {
+		return ControlLog
+	}
+	return ctl.Policy.Authorize(msg)
+}
+
+// post hands an article to the backend, acting on any control message
+// it carries.
+func (ctl *Controls) post(s *session, article *nntp.Article) error {
+	msg, err := parseControl(article.Header)
+	if err != nil {
+		return err
+	}
+	if msg == nil {
+		return s.backend.Post(article)
+	}
+
+	msg.Body, err = ioutil.ReadAll(article.Body)
+	if err != nil {
+		return err
+	}
+	article.Body = bytes.NewReader(msg.Body)
+
+	action := ctl.authorize(msg)
+	opens := true
+	if action == ControlApply && ctl.VerifyCancelKey {
+		if opens, err = cancelKeyOpens(s.backend, msg); err != nil {
+			s.server.logf("control: error finding the target of %s %v: %v",
+				msg.Verb, msg.Args, err)
+			return err
+		}
+	}
+	if !opens {
+		s.server.logf("control: %s %v from %s has no valid Cancel-Key",
+			msg.Verb, msg.Args, msg.Sender())
+		if msg.Verb == "cancel" {
+			return &NNTPError{441, "Cancel-Key does not match Cancel-Lock"}
+		}
+		action = ControlDrop
+	}
+	if action == ControlReject {
+		s.server.logf("control: rejected %s %v from %s",
+			msg.Verb, msg.Args, msg.Sender())
+		return &NNTPError{441, "Control message rejected"}
+	}
+
+	if err := s.backend.Post(article); err != nil {
+		return err
+	}
+
+	switch action {
+	case ControlLog:
+		s.server.logf("control: %s %v from %s (not applied)",
+			msg.Verb, msg.Args, msg.Sender())
+	case ControlApply:
+		if err := applyControl(s.backend, msg); err != nil {
+			s.server.logf("control: error applying %s %v from %s: %v",
+				msg.Verb, msg.Args, msg.Sender(), err)
+		} else {
+			s.server.logf("control: applied %s %v from %s",
+				msg.Verb, msg.Args, msg.Sender())
+		}
+	}
+	return nil
+}
+
+// post hands an article received by POST or IHAVE to the backend.
+func (s *session) post(article *nntp.Article) error {
+	if s.server.Controls == nil {
+		return s.backend.Post(article)
+	}
+	return s.server.Controls.post(s, article)
+}
+
+// cancelKeyOpens reports whether a cancel or supersedes may act on its
+// target article as far as Cancel-Lock is concerned.  Other control
+// messages, and targets without a Cancel-Lock, always may.  Targets
+// that can't be found may not: the cancel would still remove them
+// wherever they turn up.
+func cancelKeyOpens(b Backend, msg *ControlMessage) (bool, error) {
+	if msg.Verb != "cancel" && msg.Verb != "supersedes" {
+		return true, nil
+	}
+	target, err := findArticle(b, msg.Args[0])
+	if notFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	lock := target.Header.Get("Cancel-Lock")
+	return lock == "" || nntp.VerifyCancelKey(lock, msg.Header.Get("Cancel-Key")), nil
+}
+
+// findArticle looks an article up by message ID in whichever group it
+// was filed in.  Backends that can't look one up without a group have
+// each of their groups tried in turn.
+func findArticle(b Backend, id string) (*nntp.Article, error) {
+	a, err := b.GetArticle(nil, id)
+	if e, ok := err.(*NNTPError); !ok || e.Code != ErrNoGroupSelected.Code {
+		return a, err
+	}
+	groups, err := b.ListGroups(-1)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		a, err := b.GetArticle(g, id)
+		if err == nil {
+			return a, nil
+		}
+		if !notFound(err) {
+			return nil, err
+		}
+	}
+	return nil, ErrInvalidMessageID
+}
+
+// notFound reports whether err is a backend's answer that a group or
+// article doesn't exist, rather than a failure to look.
+func notFound(err error) bool {
+	e, ok := err.(*NNTPError)
+	return ok && (e.Code == ErrNoSuchGroup.Code ||
+		e.Code == ErrInvalidArticleNumber.Code ||
+		e.Code == ErrInvalidMessageID.Code)
+}
+
+var errControlUnsupported = errors.New("backend does not support this control message")
+
+func applyControl(b Backend, msg *ControlMessage) error {
+	switch msg.Verb {
+	case "cancel", "supersedes":
+		d, ok := b.(ArticleDeleter)
+		if !ok {
+			return errControlUnsupported
+		}
+		return d.DeleteArticle(msg.Args[0])
+	case "newgroup":
+		gc, ok := b.(GroupCreator)
+		if !ok {
+			return errControlUnsupported
+		}
+		g := &nntp.Group{
+			Name:        msg.Args[0],
+			Description: newgroupDescription(msg),
+			Posting:     nntp.PostingPermitted,
+		}
+		if len(msg.Args) > 1 && strings.ToLower(msg.Args[1]) == "moderated" {
+			g.Posting = nntp.PostingModerated
+		}
+		return gc.CreateGroup(g)
+	case "rmgroup":
+		gr, ok := b.(GroupRemover)
+		if !ok {
+			return errControlUnsupported
+		}
+		return gr.RemoveGroup(msg.Args[0])
+	case "checkgroups":
+		return applyCheckgroups(b, msg)
+	}
+	return errControlUnsupported
+}
+
+// newgroupDescription finds the group's line in the body of a newgroup
+// message, conventionally following "For your newsgroups file:".
+func newgroupDescription(msg *ControlMessage) string {
+	for name, desc := range parseGroupLines(msg.Body) {
+		if name == msg.Args[0] {
+			return desc
+		}
+	}
+	return ""
+}
+
+// parseGroupLines reads "name<whitespace>description" lines, skipping
+// anything that doesn't look like one.
+func parseGroupLines(body []byte) map[string]string {
+	rv := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.IndexAny(line, " \t")
+		if i < 1 || !strings.Contains(line[:i], ".") {
+			continue
+		}
+		rv[line[:i]] = strings.TrimSpace(line[i:])
+	}
+	return rv
+}
+
+// checkgroupsScope returns the hierarchies a checkgroups message covers,
+// as wildmat patterns.  Without an explicit scope, the top-level
+// hierarchies of the listed groups are used.
+func checkgroupsScope(msg *ControlMessage) []string {
+	rv := []string{}
+	for _, arg := range msg.Args {
+		if strings.HasPrefix(arg, "#") {
+			continue
+		}
+		neg := ""
+		if strings.HasPrefix(arg, "!") {
+			neg, arg = "!", arg[1:]
+		}
+		rv = append(rv, neg+arg, neg+arg+".*")
+	}
+	if len(rv) > 0 {
+		return rv
+	}
+	seen := map[string]bool{}
+	for name := range parseGroupLines(msg.Body) {
+		h := strings.SplitN(name, ".", 2)[0]
+		if !seen[h] {
+			seen[h] = true
+			rv = append(rv, h, h+".*")
+		}
+	}
+	return rv
+}
+
+func applyCheckgroups(b Backend, msg *ControlMessage) error {
+	gc, canCreate := b.(GroupCreator)
+	gr, canRemove := b.(GroupRemover)
+	if !canCreate && !canRemove {
+		return errControlUnsupported
+	}
+
+	scope := strings.Join(checkgroupsScope(msg), ",")
+	listed := parseGroupLines(msg.Body)
+	existing, err := b.ListGroups(-1)
+	if err != nil {
+		return err
+	}
+
+	have := map[string]bool{}
+	for _, g := range existing {
+		have[g.Name] = true
+		if _, ok := listed[g.Name]; !ok && canRemove &&
+			nntp.MatchWildmat(scope, g.Name) {
+			if err := gr.RemoveGroup(g.Name); err != nil {
+				return err
+			}
+		}
+	}
+	for name, desc := range listed {
+		if have[name] || !canCreate || !nntp.MatchWildmat(scope, name) {
+			continue
+		}
+		g := &nntp.Group{
+			Name:        name,
+			Description: desc,
+			Posting:     nntp.PostingPermitted,
+		}
+		if strings.HasSuffix(desc, "(Moderated)") {
+			g.Posting = nntp.PostingModerated
+		}
+		if err := gc.CreateGroup(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package nntpserver
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-nntp"
+)
+
+type controlBackend struct {
+	recordingBackend
+	deleted   []string
+	lookupErr error
+}
+
+func (cb *controlBackend) ListGroups(max int) ([]*nntp.Group, error) {
+	rv := []*nntp.Group{}
+	for _, g := range cb.groups {
+		rv = append(rv, g)
+	}
+	return rv, nil
+}
+
+func (cb *controlBackend) DeleteArticle(id string) error {
+	cb.deleted = append(cb.deleted, id)
+	return nil
+}
+
+func (cb *controlBackend) CreateGroup(g *nntp.Group) error {
+	cb.groups[g.Name] = g
+	return nil
+}
+
+func (cb *controlBackend) RemoveGroup(name string) error {
+	delete(cb.groups, name)
+	return nil
+}
+
+func (cb *controlBackend) names() string {
+	rv := []string{}
+	for name := range cb.groups {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return strings.Join(rv, " ")
+}
+
+func newControlSession(policy ControlPolicy) (*session, *controlBackend) {
+	cb := &controlBackend{}
+	cb.groups = map[string]*nntp.Group{
+		"comp.lang.go": {Name: "comp.lang.go"},
+		"comp.old":     {Name: "comp.old"},
+		"misc.test":    {Name: "misc.test"},
+	}
+	s := NewServer(cb)
+	s.Controls = &Controls{Policy: policy}
+	s.Logger = discardLogger
+	return &session{server: s, backend: cb}, cb
+}
+
+func controlArticle(body string, kv ...string) *nntp.Article {
+	return &nntp.Article{
+		Header: testHeader(kv...),
+		Body:   strings.NewReader(body),
+	}
+}
+
+func TestControlMessages(t *testing.T) {
+	s, cb := newControlSession(ControlRules{
+		{Verbs: "*", Senders: "*", Groups: "*", Action: ControlLog},
+		{Verbs: "cancel,newgroup,checkgroups", Senders: "*@example.com",
+			Groups: "comp.*", Action: ControlApply},
+		{Verbs: "rmgroup", Senders: "*", Groups: "*", Action: ControlReject},
+	})
+
+	err := s.post(controlArticle("", "From", "a@example.com",
+		"Newsgroups", "comp.lang.go", "Control", "cancel <x@y>"))
+	if err != nil || len(cb.deleted) != 1 || cb.deleted[0] != "<x@y>" {
+		t.Fatalf("Cancel not applied: %v %v", err, cb.deleted)
+	}
+
+	err = s.post(controlArticle("", "From", "a@elsewhere.com",
+		"Newsgroups", "comp.lang.go", "Supersedes", "<z@y>"))
+	if err != nil || len(cb.deleted) != 1 {
+		t.Fatalf("Unauthorised supersedes applied: %v %v", err, cb.deleted)
+	}
+
+	err = s.post(controlArticle("For your newsgroups file:\ncomp.new\tNew things.\n",
+		"From", "a@example.com", "Newsgroups", "comp.new",
+		"Control", "newgroup comp.new moderated"))
+	g := cb.groups["comp.new"]
+	if err != nil || g == nil || g.Description != "New things." ||
+		g.Posting != nntp.PostingModerated {
+		t.Fatalf("Newgroup not applied: %v %+v", err, g)
+	}
+
+	err = s.post(controlArticle("", "From", "a@example.com",
+		"Newsgroups", "misc.test", "Control", "rmgroup misc.test"))
+	if err == nil || cb.groups["misc.test"] == nil {
+		t.Fatalf("Rmgroup not rejected: %v", err)
+	}
+
+	err = s.post(controlArticle("comp.lang.go\tGo.\ncomp.lang.c\tC.\n",
+		"From", "a@example.com", "Newsgroups", "comp.admin",
+		"Control", "checkgroups"))
+	if err != nil {
+		t.Fatalf("Error posting checkgroups: %v", err)
+	}
+	if got := cb.names(); got != "comp.lang.c comp.lang.go misc.test" {
+		t.Fatalf("Checkgroups left %v", got)
+	}
+
+	if len(cb.posted) != 4 {
+		t.Errorf("Expected 4 control articles stored, got %v", len(cb.posted))
+	}
+}
+
+func TestMalformedControl(t *testing.T) {
+	s, _ := newControlSession(nil)
+	err := s.post(controlArticle("", "From", "a@example.com",
+		"Newsgroups", "misc.test", "Control", "cancel"))
+	if err != errMalformedControl {
+		t.Fatalf("Expected malformed control error, got %v", err)
+	}
+}
+
+func (cb *controlBackend) GetArticle(group *nntp.Group, id string) (*nntp.Article, error) {
+	if group == nil {
+		return nil, ErrNoGroupSelected
+	}
+	if cb.lookupErr != nil {
+		return nil, cb.lookupErr
+	}
+	for _, a := range cb.posted {
+		if a.MessageID() == id && strings.Contains(a.Header.Get("Newsgroups"), group.Name) {
+			return a, nil
+		}
+	}
+	return nil, ErrInvalidMessageID
+}
+
+func TestCancelLockVerification(t *testing.T) {
+	s, cb := newControlSession(ControlRules{
+		{Verbs: "*", Senders: "*", Groups: "*", Action: ControlApply},
+	})
+	s.server.Controls.VerifyCancelKey = true
+	s.server.Injector = NewInjector("news.example.com")
+	s.server.Injector.CancelLockSecret = []byte("sekrit")
+
+	h := testHeader("From", "a@example.com", "Subject", "hi",
+		"Newsgroups", "misc.test", "Message-Id", "<orig@example.com>")
+	if err := s.server.Injector.Inject(cb, nil, "alice", h); err != nil {
+		t.Fatalf("Error injecting: %v", err)
+	}
+	if err := s.post(&nntp.Article{Header: h, Body: strings.NewReader("")}); err != nil {
+		t.Fatalf("Error posting: %v", err)
+	}
+
+	wrong, _ := nntp.CancelKey(nntp.CancelLockSHA256, []byte("sekrit"),
+		"mallory", "<orig@example.com>")
+	err := s.post(controlArticle("", "From", "m@example.com",
+		"Newsgroups", "misc.test", "Control", "cancel <orig@example.com>",
+		"Cancel-Key", wrong))
+	if err == nil || len(cb.deleted) != 0 {
+		t.Fatalf("Cancel with the wrong key accepted: %v %v", err, cb.deleted)
+	}
+
+	// The target is found wherever the cancel was posted.
+	err = s.post(controlArticle("", "From", "m@example.com",
+		"Newsgroups", "comp.lang.go", "Control", "cancel <orig@example.com>"))
+	if err == nil || len(cb.deleted) != 0 {
+		t.Fatalf("Cancel posted elsewhere accepted: %v %v", err, cb.deleted)
+	}
+
+	err = s.post(controlArticle("", "From", "m@example.com",
+		"Newsgroups", "misc.test", "Control", "cancel <unknown@example.com>"))
+	if err == nil || len(cb.deleted) != 0 {
+		t.Fatalf("Cancel of an unknown article accepted: %v %v", err, cb.deleted)
+	}
+
+	cb.lookupErr = errors.New("disk on fire")
+	err = s.post(controlArticle("", "From", "m@example.com",
+		"Newsgroups", "misc.test", "Control", "cancel <orig@example.com>"))
+	if err != cb.lookupErr || len(cb.deleted) != 0 {
+		t.Fatalf("Cancel applied without finding its target: %v %v", err, cb.deleted)
+	}
+	cb.lookupErr = nil
+
+	right, _ := s.server.Injector.CancelKey("alice", "<orig@example.com>")
+	err = s.post(controlArticle("", "From", "a@example.com",
+		"Newsgroups", "misc.test", "Control", "cancel <orig@example.com>",
+		"Cancel-Key", right))
+	if err != nil || len(cb.deleted) != 1 {
+		t.Fatalf("Cancel with the right key not applied: %v %v", err, cb.deleted)
+	}
+}
@@ -0,0 +1,297 @@
+package nntpserver
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/mail"
+	"sort"
+	"time"
+
+	"github.com/dustin/go-nntp"
+)
+
+// An ArticleExpirer is a Backend that can remove articles from a group
+// by number.  Once the articles are gone, the group's Low and Count must
+// reflect the articles that remain.
+type ArticleExpirer interface {
+	ExpireArticles(group *nntp.Group, nums []int64) error
+}
+
+// ErrExpiryUnsupported is returned by Expirer.Expire for a backend that
+// isn't an ArticleExpirer.
+var ErrExpiryUnsupported = errors.New("backend does not support expiry")
+
+// A RetentionRule limits what is kept in the groups it matches.  Zero
+// limits are not enforced.
+type RetentionRule struct {
+	// Groups is a wildmat selecting the groups the rule applies to.
+	Groups string
+	// MaxAge is how long an article is kept after it was posted.
+	MaxAge time.Duration
+	// MaxCount is how many articles a group keeps.
+	MaxCount int
+	// MaxBytes is how many bytes of article bodies a group keeps.
+	MaxBytes int64
+	// HonorExpires lets an article's Expires header set when it
+	// expires, though never later than MaxAge allows.  The overview
+	// has no Expires, so this costs a GetArticle per article MaxAge
+	// hasn't already expired, on every run.
+	HonorExpires bool
+}
+
+// An Expiration describes an article that is, or would be, expired.
+type Expiration struct {
+	Group     string
+	Num       int64
+	MessageID string
+	// Reason is "age", "expires", "count" or "size".
+	Reason string
+}
+
+// An Expirer removes articles from a Backend according to retention
+// rules.  For each group the last rule matching it applies; groups no
+// rule matches are left alone.  Groups are scanned through the
+// backend's overview when it has one; see RetentionRule.HonorExpires
+// for what reading Expires headers costs then.
+type Expirer struct {
+	Backend Backend
+	Rules   []RetentionRule
+	// Logger receives the Expirer's log output.  If nil, the log
+	// package's standard logger is used.
+	Logger *log.Logger
+	// Now returns the current time.  It defaults to time.Now.
+	Now func() time.Time
+}
+
+func (e *Expirer) logf(format string, args ...interface{}) {
+	if e.Logger != nil {
+		e.Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func (e *Expirer) now() time.Time {
+	if e.Now != nil {
+		return e.Now()
+	}
+	return time.Now()
+}
+
+func (e *Expirer) rule(group string) *RetentionRule {
+	var rv *RetentionRule
+	for i := range e.Rules {
+		if nntp.MatchWildmat(e.Rules[i].Groups, group) {
+			rv = &e.Rules[i]
+		}
+	}
+	return rv
+}
+
+// postedAt returns when an article was injected, or failing that, the
+// date its poster gave it.
+func postedAt(a *nntp.Article) (time.Time, bool) {
+	for _, k := range []string{"Injection-Date", "Date"} {
+		if t, err := mail.ParseDate(a.Header.Get(k)); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// An expiryCandidate is what expiry needs to know of an article.
+// article is only set when the whole article was loaded.
+type expiryCandidate struct {
+	num     int64
+	id      string
+	bytes   int
+	posted  time.Time
+	dated   bool
+	article *nntp.Article
+}
+
+// candidates lists a group's articles in number order.  Backends with
+// overview records are read through them, so only the records are held
+// in memory, not the articles; their articles are dated by the
+// poster's Date, as the overview has no Injection-Date.
+func (e *Expirer) candidates(g *nntp.Group) ([]expiryCandidate, error) {
+	var rv []expiryCandidate
+	fromOverview := func(r OverviewRecord) error {
+		posted, err := mail.ParseDate(r.Date)
+		rv = append(rv, expiryCandidate{r.Num, r.MessageID, r.Bytes, posted, err == nil, nil})
+		return nil
+	}
+	var err error
+	switch b := e.Backend.(type) {
+	case OverviewStreamer:
+		err = b.EachOverview(g, 0, math.MaxInt64, fromOverview)
+	case OverviewBackend:
+		var recs []OverviewRecord
+		recs, err = b.GetOverview(g, 0, math.MaxInt64)
+		for _, r := range recs {
+			fromOverview(r)
+		}
+	default:
+		var articles []NumberedArticle
+		articles, err = e.Backend.GetArticles(g, 0, math.MaxInt64)
+		for _, a := range articles {
+			posted, ok := postedAt(a.Article)
+			rv = append(rv, expiryCandidate{a.Num, a.Article.MessageID(),
+				a.Article.Bytes, posted, ok, a.Article})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].num < rv[j].num
+	})
+	return rv, nil
+}
+
+// expires returns the date in an article's Expires header, loading the
+// article if only its overview was read.
+func (e *Expirer) expires(g *nntp.Group, c expiryCandidate) (time.Time, bool, error) {
+	a := c.article
+	if a == nil {
+		var err error
+		if a, err = e.Backend.GetArticle(g, c.id); notFound(err) {
+			return time.Time{}, false, nil
+		} else if err != nil {
+			return time.Time{}, false, err
+		}
+	}
+	exp, err := mail.ParseDate(a.Header.Get("Expires"))
+	return exp, err == nil, nil
+}
+
+func (e *Expirer) groupExpirations(g *nntp.Group, r *RetentionRule) ([]Expiration, error) {
+	articles, err := e.candidates(g)
+	if err != nil {
+		return nil, err
+	}
+
+	now := e.now()
+	rv := []Expiration{}
+	expire := func(a expiryCandidate, reason string) {
+		rv = append(rv, Expiration{g.Name, a.num, a.id, reason})
+	}
+
+	kept := make([]expiryCandidate, 0, len(articles))
+	for _, a := range articles {
+		if !a.dated {
+			kept = append(kept, a)
+			continue
+		}
+		var deadline time.Time
+		if r.MaxAge > 0 {
+			deadline = a.posted.Add(r.MaxAge)
+		}
+		reason := "age"
+		// Expires can only bring the deadline forward, so articles
+		// MaxAge already expires needn't be loaded to read it.
+		if r.HonorExpires && (deadline.IsZero() || !now.After(deadline)) {
+			exp, ok, err := e.expires(g, a)
+			if err != nil {
+				return nil, err
+			}
+			if ok && (deadline.IsZero() || exp.Before(deadline)) {
+				deadline = exp
+				reason = "expires"
+			}
+		}
+		if !deadline.IsZero() && now.After(deadline) {
+			expire(a, reason)
+		} else {
+			kept = append(kept, a)
+		}
+	}
+
+	if r.MaxCount > 0 && len(kept) > r.MaxCount {
+		for _, a := range kept[:len(kept)-r.MaxCount] {
+			expire(a, "count")
+		}
+		kept = kept[len(kept)-r.MaxCount:]
+	}
+
+	if r.MaxBytes > 0 {
+		var total int64
+		for _, a := range kept {
+			total += int64(a.bytes)
+		}
+		for len(kept) > 0 && total > r.MaxBytes {
+			expire(kept[0], "size")
+			total -= int64(kept[0].bytes)
+			kept = kept[1:]
+		}
+	}
+
+	return rv, nil
+}
+
+// Report works out which articles Expire would remove, without
+// removing anything.
+func (e *Expirer) Report() ([]Expiration, error) {
+	groups, err := e.Backend.ListGroups(-1)
+	if err != nil {
+		return nil, err
+	}
+	rv := []Expiration{}
+	for _, g := range groups {
+		r := e.rule(g.Name)
+		if r == nil {
+			continue
+		}
+		exps, err := e.groupExpirations(g, r)
+		if err != nil {
+			return rv, err
+		}
+		rv = append(rv, exps...)
+	}
+	return rv, nil
+}
+
+// Expire removes the articles Report lists and returns them.
+func (e *Expirer) Expire() ([]Expiration, error) {
+	ae, ok := e.Backend.(ArticleExpirer)
+	if !ok {
+		return nil, ErrExpiryUnsupported
+	}
+	exps, err := e.Report()
+	if err != nil {
+		return nil, err
+	}
+
+	byGroup := map[string][]int64{}
+	for _, x := range exps {
+		byGroup[x.Group] = append(byGroup[x.Group], x.Num)
+	}
+	for name, nums := range byGroup {
+		g, err := e.Backend.GetGroup(name)
+		if err != nil {
+			return exps, err
+		}
+		if err := ae.ExpireArticles(g, nums); err != nil {
+			return exps, err
+		}
+		e.logf("Expired %d articles from %s", len(nums), name)
+	}
+	return exps, nil
+}
+
+// Run expires articles every interval until stop is closed.
+func (e *Expirer) Run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if _, err := e.Expire(); err != nil {
+			e.logf("Error expiring articles: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
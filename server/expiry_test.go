@@ -0,0 +1,150 @@
+package nntpserver
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-nntp"
+)
+
+type expiryBackend struct {
+	groupsBackend
+	articles map[string][]NumberedArticle
+	expired  map[string][]int64
+}
+
+func (eb *expiryBackend) ListGroups(max int) ([]*nntp.Group, error) {
+	rv := []*nntp.Group{}
+	for _, g := range eb.groups {
+		rv = append(rv, g)
+	}
+	return rv, nil
+}
+
+func (eb *expiryBackend) GetArticles(g *nntp.Group, from, to int64) ([]NumberedArticle, error) {
+	return eb.articles[g.Name], nil
+}
+
+func (eb *expiryBackend) ExpireArticles(g *nntp.Group, nums []int64) error {
+	eb.expired[g.Name] = append(eb.expired[g.Name], nums...)
+	return nil
+}
+
+// overviewExpiryBackend serves expiryBackend's articles as overview
+// records, and counts the articles loaded whole.
+type overviewExpiryBackend struct {
+	*expiryBackend
+	loaded int
+}
+
+func (ob *overviewExpiryBackend) GetOverview(g *nntp.Group, from, to int64) ([]OverviewRecord, error) {
+	rv := []OverviewRecord{}
+	for _, a := range ob.articles[g.Name] {
+		rv = append(rv, OverviewRecord{Num: a.Num, Date: a.Article.Header.Get("Date"),
+			MessageID: fmt.Sprintf("<%d@%s>", a.Num, g.Name), Bytes: a.Article.Bytes})
+	}
+	return rv, nil
+}
+
+func (ob *overviewExpiryBackend) GetArticles(g *nntp.Group, from, to int64) ([]NumberedArticle, error) {
+	ob.loaded += len(ob.articles[g.Name])
+	return ob.expiryBackend.GetArticles(g, from, to)
+}
+
+func (ob *overviewExpiryBackend) GetArticle(g *nntp.Group, id string) (*nntp.Article, error) {
+	for _, a := range ob.articles[g.Name] {
+		if fmt.Sprintf("<%d@%s>", a.Num, g.Name) == id {
+			ob.loaded++
+			return a.Article, nil
+		}
+	}
+	return nil, ErrInvalidMessageID
+}
+
+func TestExpiry(t *testing.T) {
+	testExpiry(t, func(eb *expiryBackend) Backend { return eb })
+}
+
+func TestExpiryOverview(t *testing.T) {
+	var ob *overviewExpiryBackend
+	testExpiry(t, func(eb *expiryBackend) Backend {
+		ob = &overviewExpiryBackend{expiryBackend: eb}
+		return ob
+	})
+	// Only the two articles young enough for their Expires to matter,
+	// once by Report and again by Expire.
+	if ob.loaded != 4 {
+		t.Errorf("Loaded %d articles whole", ob.loaded)
+	}
+}
+
+func testExpiry(t *testing.T, wrap func(*expiryBackend) Backend) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	mk := func(num int64, age time.Duration, size int, kv ...string) NumberedArticle {
+		h := testHeader(kv...)
+		h.Set("Date", now.Add(-age).Format(time.RFC1123Z))
+		return NumberedArticle{num, &nntp.Article{Header: h, Bytes: size}}
+	}
+	eb := &expiryBackend{
+		groupsBackend: groupsBackend{groups: map[string]*nntp.Group{
+			"misc.test":    {Name: "misc.test"},
+			"misc.archive": {Name: "misc.archive"},
+			"alt.binaries": {Name: "alt.binaries"},
+			"comp.lang.go": {Name: "comp.lang.go"},
+		}},
+		articles: map[string][]NumberedArticle{
+			"misc.test": {
+				mk(1, 40*day, 10), mk(2, 10*day, 10,
+					"Expires", now.Add(-day).Format(time.RFC1123Z)),
+				mk(3, 1*day, 10),
+			},
+			"misc.archive": {mk(1, 400*day, 10)},
+			"alt.binaries": {
+				mk(1, 3*day, 500), mk(2, 2*day, 500), mk(3, 1*day, 500),
+			},
+			"comp.lang.go": {mk(5, 1*day, 1), mk(6, 1*day, 1), mk(7, 1*day, 1)},
+		},
+		expired: map[string][]int64{},
+	}
+	e := &Expirer{
+		Backend: wrap(eb),
+		Rules: []RetentionRule{
+			{Groups: "*", MaxAge: 30 * day, HonorExpires: true},
+			{Groups: "misc.archive", MaxAge: 0},
+			{Groups: "alt.binaries", MaxBytes: 1000},
+			{Groups: "comp.*", MaxCount: 2},
+		},
+		Now:    func() time.Time { return now },
+		Logger: discardLogger,
+	}
+
+	report, err := e.Report()
+	if err != nil {
+		t.Fatalf("Error reporting: %v", err)
+	}
+	if len(eb.expired) != 0 {
+		t.Fatalf("Report expired articles: %v", eb.expired)
+	}
+	reasons := map[string]int{}
+	for _, x := range report {
+		reasons[x.Reason]++
+	}
+	if !reflect.DeepEqual(reasons, map[string]int{"age": 1, "expires": 1, "size": 1, "count": 1}) {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+
+	if _, err := e.Expire(); err != nil {
+		t.Fatalf("Error expiring: %v", err)
+	}
+	exp := map[string][]int64{
+		"misc.test":    {1, 2},
+		"alt.binaries": {1},
+		"comp.lang.go": {5},
+	}
+	if !reflect.DeepEqual(eb.expired, exp) {
+		t.Fatalf("Expired %v, wanted %v", eb.expired, exp)
+	}
+}
@@ -0,0 +1,261 @@
+package nntpserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-nntp"
+)
+
+// A FilterVerdict is a filter's decision on an article.
+type FilterVerdict int
+
+const (
+	// FilterAccept lets the article through to the next filter.
+	FilterAccept FilterVerdict = iota
+	// FilterReject refuses the article for good.
+	FilterReject
+	// FilterDefer refuses the article for now.  Peers are asked to
+	// offer it again later.
+	FilterDefer
+)
+
+func (v FilterVerdict) String() string {
+	switch v {
+	case FilterAccept:
+		return "accept"
+	case FilterReject:
+		return "reject"
+	case FilterDefer:
+		return "defer"
+	}
+	return fmt.Sprintf("FilterVerdict(%d)", int(v))
+}
+
+// A FilteredArticle is what a Filter gets to see of an incoming
+// article.
+type FilteredArticle struct {
+	// Command is the command the article arrived by: "POST",
+	// "IHAVE" or "TAKETHIS".
+	Command string
+	// Remote is the client's address and User the name it
+	// authenticated as, if any.
+	Remote net.Addr
+	User   string
+	Header textproto.MIMEHeader
+	// Body holds at most the chain's BodyLimit bytes of the body.
+	Body []byte
+	// Truncated is set when the body is longer than Body.
+	Truncated bool
+}
+
+// A Filter inspects articles before they reach the backend.  A reason
+// given with a reject or defer verdict is sent to the client.
+type Filter interface {
+	Filter(article *FilteredArticle) (FilterVerdict, string)
+}
+
+// FilterFunc adapts an ordinary function to a Filter.
+type FilterFunc func(article *FilteredArticle) (FilterVerdict, string)
+
+// Filter calls f(article).
+func (f FilterFunc) Filter(article *FilteredArticle) (FilterVerdict, string) {
+	return f(article)
+}
+
+// DefaultFilterBodyLimit is how much of a body filters get to see
+// unless a FilterChain says otherwise.
+const DefaultFilterBodyLimit = 64 * 1024
+
+// A FilterChain runs articles received by POST, IHAVE and TAKETHIS
+// through its filters in order.  The first one to reject or defer an
+// article decides its fate.
+type FilterChain struct {
+	Filters []Filter
+	// BodyLimit is how many bytes of the body are read for the
+	// filters.  Zero means DefaultFilterBodyLimit.
+	BodyLimit int
+}
+
+// NewFilterChain builds a FilterChain running the given filters.
+func NewFilterChain(filters ...Filter) *FilterChain {
+	return &FilterChain{Filters: filters, BodyLimit: DefaultFilterBodyLimit}
+}
+
+// Check runs an article through the chain.
+func (fc *FilterChain) Check(article *FilteredArticle) (FilterVerdict, string) {
+	for _, f := range fc.Filters {
+		if v, reason := f.Filter(article); v != FilterAccept {
+			return v, reason
+		}
+	}
+	return FilterAccept, ""
+}
+
+// filter runs an article received by the given command through the
+// server's filters.  The start of the body is read for them and put
+// back, so the article can still be posted in full.  Rejected articles
+// get a 441 error and deferred ones a 436, except that POST has no way
+// to say "later" and gets a 441 for both.  IHAVE answers a 436 as is
+// and TAKETHIS with a 431.
+func (s *session) filter(command string, article *nntp.Article) error {
+	fc := s.server.Filters
+	if fc == nil || len(fc.Filters) == 0 {
+		return nil
+	}
+	limit := fc.BodyLimit
+	if limit <= 0 {
+		limit = DefaultFilterBodyLimit
+	}
+	buf := make([]byte, limit+1)
+	n, err := io.ReadFull(article.Body, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	buf = buf[:n]
+	article.Body = io.MultiReader(bytes.NewReader(buf), article.Body)
+
+	fa := &FilteredArticle{
+		Command: command,
+		Remote:  s.remote,
+		User:    s.user,
+		Header:  article.Header,
+		Body:    buf,
+	}
+	if len(buf) > limit {
+		fa.Body, fa.Truncated = buf[:limit], true
+	}
+
+	v, reason := fc.Check(fa)
+	if v == FilterAccept {
+		return nil
+	}
+	if reason == "" {
+		reason = "Article refused by filter"
+	}
+	s.server.logf("Filter verdict %v on %s from %v: %s", v, article.MessageID(),
+		s.remote, reason)
+	if v == FilterDefer {
+		s.server.count("filter_deferred")
+		if command != "POST" {
+			return &NNTPError{436, reason}
+		}
+	} else {
+		s.server.count("filter_rejected")
+	}
+	return &NNTPError{441, reason}
+}
+
+// MaxCrosspost rejects articles posted to more than max groups.
+func MaxCrosspost(max int) Filter {
+	return FilterFunc(func(a *FilteredArticle) (FilterVerdict, string) {
+		if n := len(SplitGroups(a.Header.Get("Newsgroups"))); n > max {
+			return FilterReject, fmt.Sprintf("Crossposted to %d groups, limit %d", n, max)
+		}
+		return FilterAccept, ""
+	})
+}
+
+// MaxBodySize rejects articles whose body is longer than max bytes.
+// Only the chain's BodyLimit bytes are read for filtering, and bodies
+// longer than that are rejected too, so max must be smaller than it.
+func MaxBodySize(max int) Filter {
+	return FilterFunc(func(a *FilteredArticle) (FilterVerdict, string) {
+		if len(a.Body) > max || a.Truncated {
+			return FilterReject, fmt.Sprintf("Body longer than %d bytes", max)
+		}
+		return FilterAccept, ""
+	})
+}
+
+// A HeaderRule gives its verdict on articles with a header matching
+// Pattern.
+type HeaderRule struct {
+	Header  string
+	Pattern *regexp.Regexp
+	Verdict FilterVerdict
+	Reason  string
+}
+
+// Filter applies the rule to an article.
+func (r HeaderRule) Filter(a *FilteredArticle) (FilterVerdict, string) {
+	for _, v := range a.Header[textproto.CanonicalMIMEHeaderKey(r.Header)] {
+		if r.Pattern.MatchString(v) {
+			return r.Verdict, r.Reason
+		}
+	}
+	return FilterAccept, ""
+}
+
+type bodySighting struct {
+	first time.Time
+	count int
+}
+
+// A DuplicateBodyFilter rejects excessive multiple postings (EMP): the
+// same body, give or take whitespace, arriving more than Threshold
+// times within Window.
+type DuplicateBodyFilter struct {
+	Threshold int
+	Window    time.Duration
+	// Now returns the current time.  It defaults to time.Now.
+	Now func() time.Time
+
+	mu     sync.Mutex
+	seen   map[[sha256.Size]byte]*bodySighting
+	pruned time.Time
+}
+
+// NewDuplicateBodyFilter builds a DuplicateBodyFilter.
+func NewDuplicateBodyFilter(threshold int, window time.Duration) *DuplicateBodyFilter {
+	return &DuplicateBodyFilter{
+		Threshold: threshold,
+		Window:    window,
+	}
+}
+
+func (d *DuplicateBodyFilter) now() time.Time {
+	if d.Now != nil {
+		return d.Now()
+	}
+	return time.Now()
+}
+
+// Filter counts the article's body and rejects it once it has been
+// seen too often.
+func (d *DuplicateBodyFilter) Filter(a *FilteredArticle) (FilterVerdict, string) {
+	sum := sha256.Sum256(bytes.Join(bytes.Fields(a.Body), []byte{' '}))
+	now := d.now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen == nil {
+		d.seen = map[[sha256.Size]byte]*bodySighting{}
+	}
+	if now.Sub(d.pruned) > d.Window {
+		for k, b := range d.seen {
+			if now.Sub(b.first) > d.Window {
+				delete(d.seen, k)
+			}
+		}
+		d.pruned = now
+	}
+
+	b := d.seen[sum]
+	if b == nil || now.Sub(b.first) > d.Window {
+		b = &bodySighting{first: now}
+		d.seen[sum] = b
+	}
+	b.count++
+	if b.count > d.Threshold {
+		return FilterReject, "EMP: duplicate body"
+	}
+	return FilterAccept, ""
+}
@@ -0,0 +1,110 @@
+package nntpserver
+
+import (
+	"io"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestFilters(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	emp := NewDuplicateBodyFilter(1, time.Hour)
+	emp.Now = func() time.Time { return now }
+	fc := NewFilterChain(
+		MaxCrosspost(2),
+		MaxBodySize(100),
+		HeaderRule{"Subject", regexp.MustCompile(`(?i)make money`), FilterReject, "Spam"},
+		HeaderRule{"Subject", regexp.MustCompile(`^later`), FilterDefer, ""},
+		emp,
+	)
+
+	tests := []struct {
+		groups, subject, body string
+		exp                   FilterVerdict
+	}{
+		{"a,b", "hello", "one", FilterAccept},
+		{"a,b,c", "hello", "two", FilterReject},
+		{"a", "hello", string(make([]byte, 101)), FilterReject},
+		{"a", "MAKE MONEY FAST", "three", FilterReject},
+		{"a", "later please", "four", FilterDefer},
+		{"a", "again", "  one\n", FilterReject},
+	}
+	for _, test := range tests {
+		fa := &FilteredArticle{
+			Header: testHeader("Newsgroups", test.groups, "Subject", test.subject),
+			Body:   []byte(test.body),
+		}
+		if v, reason := fc.Check(fa); v != test.exp {
+			t.Errorf("%q/%q: got %v (%s), wanted %v",
+				test.groups, test.subject, v, reason, test.exp)
+		}
+	}
+
+	truncated := &FilteredArticle{Header: testHeader(), Body: []byte("x"), Truncated: true}
+	if v, _ := MaxBodySize(100).Filter(truncated); v != FilterReject {
+		t.Errorf("Truncated body got %v", v)
+	}
+
+	now = now.Add(2 * time.Hour)
+	fa := &FilteredArticle{Header: testHeader(), Body: []byte("one")}
+	if v, _ := emp.Filter(fa); v != FilterAccept {
+		t.Errorf("Duplicate body still rejected after the window, got %v", v)
+	}
+}
+
+func TestDuplicateBodyFilterLiteral(t *testing.T) {
+	emp := &DuplicateBodyFilter{Threshold: 1, Window: time.Hour}
+	fa := &FilteredArticle{Header: testHeader(), Body: []byte("same")}
+	for _, exp := range []FilterVerdict{FilterAccept, FilterReject} {
+		if v, _ := emp.Filter(fa); v != exp {
+			t.Errorf("Got %v, wanted %v", v, exp)
+		}
+	}
+}
+
+func TestFilterResponses(t *testing.T) {
+	tests := []struct {
+		cmd     string
+		verdict FilterVerdict
+		code    int
+	}{
+		{"POST", FilterReject, 441},
+		{"POST", FilterDefer, 441},
+		{"IHAVE <a@b>", FilterReject, 437},
+		{"IHAVE <a@b>", FilterDefer, 436},
+		{"TAKETHIS <a@b>", FilterReject, 439},
+		{"TAKETHIS <a@b>", FilterDefer, 431},
+	}
+	for _, test := range tests {
+		h := mapHistory{}
+		s := NewServer(lazyBackend{})
+		s.History = h
+		verdict, seenBody := test.verdict, ""
+		s.Filters = NewFilterChain(FilterFunc(func(a *FilteredArticle) (FilterVerdict, string) {
+			seenBody = string(a.Body)
+			return verdict, "no thanks"
+		}))
+
+		c, _ := startSession(t, s)
+		c.PrintfLine(test.cmd)
+		if test.cmd[0] != 'T' {
+			if _, _, err := c.ReadCodeLine(3); err != nil {
+				t.Fatalf("%s: error starting transfer: %v", test.cmd, err)
+			}
+		}
+		dw := c.DotWriter()
+		io.WriteString(dw, "Message-ID: <a@b>\nNewsgroups: a\n\nbody\n")
+		dw.Close()
+		if _, _, err := c.ReadCodeLine(test.code); err != nil {
+			t.Errorf("%s (%v): %v", test.cmd, test.verdict, err)
+		}
+		if seenBody != "body\n" {
+			t.Errorf("%s: filter saw body %q", test.cmd, seenBody)
+		}
+		if remembered := h.Seen("<a@b>"); remembered != (test.code == 437 || test.code == 439) {
+			t.Errorf("%s (%v): remembered = %v", test.cmd, test.verdict, remembered)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,221 @@
+package nntpserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-nntp"
+)
+
+// An Injector turns an article received by POST into one fit for
+// storage, acting as the injecting agent described in RFC 5537
+// section 3.5.
+//
+// Articles are checked for the headers a poster must supply (From,
+// Subject and Newsgroups), Message-ID and Date are generated when
+// missing, the local host is prepended to Path and Injection-Date and
+// Injection-Info are added.  Every group in Newsgroups and Followup-To
+// must be known to the backend.  Articles that fail any of these checks
+// are rejected with a 441 carrying the reason.
+//
+// With a CancelLockSecret, a Cancel-Lock (RFC 8315) is added as well,
+// so the server can later cancel or supersede the article on the
+// poster's behalf with the key from CancelKey.  Cancels and Supersedes
+// posted by authenticated users get the matching Cancel-Key, opening
+// the locks on their own articles.
+type Injector struct {
+	// PathIdentity names this host in Path, Injection-Info and
+	// generated message IDs, e.g. "news.example.com".
+	PathIdentity string
+	// ComplaintsTo, if set, is advertised as mail-complaints-to in
+	// Injection-Info.
+	ComplaintsTo string
+	// CancelLockSecret, if set, is used to add a Cancel-Lock to each
+	// article.
+	CancelLockSecret []byte
+	// Now returns the current time.  It defaults to time.Now.
+	Now func() time.Time
+}
+
+// NewInjector builds an Injector identifying itself as pathIdentity.
+func NewInjector(pathIdentity string) *Injector {
+	return &Injector{PathIdentity: pathIdentity}
+}
+
+func injectionError(format string, args ...interface{}) error {
+	return &NNTPError{441, fmt.Sprintf(format, args...)}
+}
+
+func (in *Injector) now() time.Time {
+	if in.Now != nil {
+		return in.Now()
+	}
+	return time.Now()
+}
+
+// SplitGroups splits a Newsgroups or Followup-To header value into
+// group names.
+func SplitGroups(v string) []string {
+	rv := []string{}
+	for _, g := range strings.Split(v, ",") {
+		g = strings.TrimSpace(g)
+		if g != "" {
+			rv = append(rv, g)
+		}
+	}
+	return rv
+}
+
+func validMessageID(id string) bool {
+	if len(id) < 5 || len(id) > 250 || id[0] != '<' || id[len(id)-1] != '>' {
+		return false
+	}
+	at := strings.Index(id, "@")
+	return at > 1 && at < len(id)-2 && !strings.ContainsAny(id, " \t")
+}
+
+func (in *Injector) newMessageID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return fmt.Sprintf("<%s.%s@%s>",
+		strconv.FormatInt(in.now().UnixNano(), 36),
+		hex.EncodeToString(b), in.PathIdentity)
+}
+
+// Inject checks and completes the headers of a posted article.  Groups
+// are looked up with b, and remote, if known, is recorded as the
+// posting host.  user is the name the poster authenticated as, if any.
+func (in *Injector) Inject(b Backend, remote net.Addr, user string, h textproto.MIMEHeader) error {
+	for _, k := range []string{"From", "Subject", "Newsgroups"} {
+		if strings.TrimSpace(h.Get(k)) == "" {
+			return injectionError("Missing %s header", k)
+		}
+		if len(h[k]) > 1 {
+			return injectionError("Duplicate %s header", k)
+		}
+	}
+	if h.Get("Injection-Info") != "" || h.Get("Injection-Date") != "" {
+		return injectionError("Article already injected")
+	}
+
+	if err := in.checkGroups(b, "Newsgroups", h.Get("Newsgroups")); err != nil {
+		return err
+	}
+	if fu := h.Get("Followup-To"); fu != "" && strings.TrimSpace(fu) != "poster" {
+		if err := in.checkGroups(b, "Followup-To", fu); err != nil {
+			return err
+		}
+	}
+
+	now := in.now()
+
+	if id := h.Get("Message-Id"); id == "" {
+		h.Set("Message-Id", in.newMessageID())
+	} else if !validMessageID(id) {
+		return injectionError("Invalid Message-ID %s", id)
+	}
+
+	if d := h.Get("Date"); d == "" {
+		h.Set("Date", now.Format(time.RFC1123Z))
+	} else {
+		t, err := mail.ParseDate(d)
+		if err != nil {
+			return injectionError("Unparseable Date header")
+		}
+		if t.After(now.Add(24 * time.Hour)) {
+			return injectionError("Date is in the future")
+		}
+	}
+
+	path := strings.TrimSpace(h.Get("Path"))
+	if path == "" {
+		path = "not-for-mail"
+	}
+	h.Set("Path", in.PathIdentity+"!.POSTED!"+path)
+
+	h.Set("Injection-Date", now.Format(time.RFC1123Z))
+	info := in.PathIdentity
+	if remote != nil {
+		host := remote.String()
+		if hp, _, err := net.SplitHostPort(host); err == nil {
+			host = hp
+		}
+		info += fmt.Sprintf("; posting-host=%q", host)
+	}
+	if in.ComplaintsTo != "" {
+		info += fmt.Sprintf("; mail-complaints-to=%q", in.ComplaintsTo)
+	}
+	h.Set("Injection-Info", info)
+
+	if in.CancelLockSecret != nil {
+		lock, err := nntp.CancelLock(nntp.CancelLockSHA256,
+			in.CancelLockSecret, user, h.Get("Message-Id"))
+		if err != nil {
+			return err
+		}
+		if locks := h.Get("Cancel-Lock"); locks != "" {
+			lock = locks + " " + lock
+		}
+		h.Set("Cancel-Lock", lock)
+		if user != "" {
+			if err := in.addCancelKey(user, h); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// addCancelKey adds the Cancel-Key opening the lock on the article a
+// cancel or Supersedes replaces, so posters can withdraw their own
+// articles without computing keys themselves.
+func (in *Injector) addCancelKey(user string, h textproto.MIMEHeader) error {
+	target := strings.TrimSpace(h.Get("Supersedes"))
+	if f := strings.Fields(h.Get("Control")); len(f) == 2 && strings.EqualFold(f[0], "cancel") {
+		target = f[1]
+	}
+	if !validMessageID(target) {
+		return nil
+	}
+	key, err := in.CancelKey(user, target)
+	if err != nil {
+		return err
+	}
+	if keys := h.Get("Cancel-Key"); keys != "" {
+		key = keys + " " + key
+	}
+	h.Set("Cancel-Key", key)
+	return nil
+}
+
+// CancelKey returns the Cancel-Key that opens the Cancel-Lock added to
+// the article with message ID msgid, posted by user.
+func (in *Injector) CancelKey(user, msgid string) (string, error) {
+	return nntp.CancelKey(nntp.CancelLockSHA256, in.CancelLockSecret,
+		user, msgid)
+}
+
+func (in *Injector) checkGroups(b Backend, header, v string) error {
+	groups := SplitGroups(v)
+	if len(groups) == 0 {
+		return injectionError("Empty %s header", header)
+	}
+	for _, name := range groups {
+		g, err := b.GetGroup(name)
+		if err != nil {
+			return injectionError("No such newsgroup in %s: %s", header, name)
+		}
+		if header == "Newsgroups" && g.Posting == nntp.PostingNotPermitted {
+			return injectionError("Posting not permitted to %s", name)
+		}
+	}
+	return nil
+}
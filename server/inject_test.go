@@ -0,0 +1,114 @@
+package nntpserver
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-nntp"
+)
+
+type groupsBackend struct {
+	Backend
+	groups map[string]*nntp.Group
+}
+
+func (gb groupsBackend) GetGroup(name string) (*nntp.Group, error) {
+	if g, ok := gb.groups[name]; ok {
+		return g, nil
+	}
+	return nil, ErrNoSuchGroup
+}
+
+var testGroups = groupsBackend{groups: map[string]*nntp.Group{
+	"misc.test": {Name: "misc.test", Posting: nntp.PostingPermitted},
+	"alt.test":  {Name: "alt.test", Posting: nntp.PostingNotPermitted},
+}}
+
+func testHeader(kv ...string) textproto.MIMEHeader {
+	h := textproto.MIMEHeader{}
+	for i := 0; i < len(kv); i += 2 {
+		h.Add(kv[i], kv[i+1])
+	}
+	return h
+}
+
+func TestInject(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	in := NewInjector("news.example.com")
+	in.Now = func() time.Time { return now }
+
+	h := testHeader("From", "a@example.com", "Subject", "hi",
+		"Newsgroups", "misc.test", "Path", "elsewhere")
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	if err := in.Inject(testGroups, remote, "", h); err != nil {
+		t.Fatalf("Error injecting: %v", err)
+	}
+	if !validMessageID(h.Get("Message-Id")) {
+		t.Errorf("Bad generated message ID: %q", h.Get("Message-Id"))
+	}
+	if got := h.Get("Path"); got != "news.example.com!.POSTED!elsewhere" {
+		t.Errorf("Path = %q", got)
+	}
+	if got := h.Get("Date"); got != now.Format(time.RFC1123Z) {
+		t.Errorf("Date = %q", got)
+	}
+	if got := h.Get("Injection-Info"); !strings.Contains(got, `posting-host="192.0.2.1"`) {
+		t.Errorf("Injection-Info = %q", got)
+	}
+}
+
+func TestInjectRejects(t *testing.T) {
+	in := NewInjector("news.example.com")
+	tests := []textproto.MIMEHeader{
+		testHeader("Subject", "hi", "Newsgroups", "misc.test"),
+		testHeader("From", "a@b", "Subject", "hi", "Newsgroups", "no.such"),
+		testHeader("From", "a@b", "Subject", "hi", "Newsgroups", "alt.test"),
+		testHeader("From", "a@b", "Subject", "hi", "Newsgroups", "misc.test",
+			"Followup-To", "no.such"),
+		testHeader("From", "a@b", "Subject", "hi", "Newsgroups", "misc.test",
+			"Message-Id", "garbage"),
+		testHeader("From", "a@b", "Subject", "hi", "Newsgroups", "misc.test",
+			"Injection-Info", "elsewhere"),
+	}
+	for _, h := range tests {
+		err := in.Inject(testGroups, nil, "", h)
+		if e, ok := err.(*NNTPError); !ok || e.Code != 441 {
+			t.Errorf("Expected 441 for %v, got %v", h, err)
+		}
+	}
+}
+
+func TestInjectCancelKey(t *testing.T) {
+	in := NewInjector("news.example.com")
+	in.CancelLockSecret = []byte("sekrit")
+	h := testHeader("From", "a@b", "Subject", "hi", "Newsgroups", "misc.test")
+	if err := in.Inject(testGroups, nil, "alice", h); err != nil {
+		t.Fatalf("Error injecting: %v", err)
+	}
+	id := h.Get("Message-Id")
+	lock := h.Get("Cancel-Lock")
+
+	for _, test := range []struct {
+		user  string
+		h     textproto.MIMEHeader
+		opens bool
+	}{
+		{"alice", testHeader("Control", "cancel "+id), true},
+		{"alice", testHeader("Supersedes", id), true},
+		{"bob", testHeader("Control", "cancel "+id), false},
+		{"", testHeader("Control", "cancel "+id), false},
+	} {
+		for _, k := range []string{"From", "Subject", "Newsgroups"} {
+			test.h.Set(k, h.Get(k))
+		}
+		if err := in.Inject(testGroups, nil, test.user, test.h); err != nil {
+			t.Fatalf("Error injecting %v: %v", test.h, err)
+		}
+		if got := nntp.VerifyCancelKey(lock, test.h.Get("Cancel-Key")); got != test.opens {
+			t.Errorf("Cancel-Key from %q for %v opens the lock: %v", test.user, test.h, got)
+		}
+	}
+}
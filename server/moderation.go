@@ -0,0 +1,246 @@
+package nntpserver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-nntp"
+)
+
+// A ModerationSubmitter receives posts to moderated groups that carry
+// no approval, for example to mail them to the groups' moderators.
+type ModerationSubmitter interface {
+	// Submit the article for moderation in the given groups.
+	Submit(groups []string, article *nntp.Article) error
+}
+
+// A QueuedArticle is a post held for moderation.
+type QueuedArticle struct {
+	// Moderated groups the article was posted to.
+	Groups   []string
+	Header   textproto.MIMEHeader
+	Body     []byte
+	Received time.Time
+
+	// Posts the article once approved, as if it had just been posted
+	// without needing approval.
+	post func(article *nntp.Article) error
+}
+
+// MessageID provides convenient access to the article's Message ID.
+func (qa *QueuedArticle) MessageID() string {
+	return qa.Header.Get("Message-Id")
+}
+
+// Moderation handles posts to groups whose posting status is
+// nntp.PostingModerated.
+//
+// A post to a moderated group with an Approved header is accepted only
+// if the poster authenticated as an authorised moderator of every
+// moderated group it is posted to.  Posts without an Approved header
+// are handed to the Submitter, or held in a queue for List, Approve and
+// Reject if there is none.
+type Moderation struct {
+	// Moderators maps each moderated group to the users allowed to
+	// approve posts to it, by the addresses or names they
+	// authenticate as.
+	Moderators map[string][]string
+	// Submitter, if set, receives unapproved posts instead of the
+	// queue.
+	Submitter ModerationSubmitter
+
+	backend Backend
+	mu      sync.Mutex
+	queue   map[string]*QueuedArticle
+}
+
+// NewModeration builds a Moderation that posts approved articles to b,
+// unless they were held by a session, which then posts them itself.
+func NewModeration(b Backend, moderators map[string][]string) *Moderation {
+	return &Moderation{
+		Moderators: moderators,
+		backend:    b,
+		queue:      make(map[string]*QueuedArticle),
+	}
+}
+
+// Authorised reports whether addr may approve posts to group.
+func (m *Moderation) Authorised(group, addr string) bool {
+	addr = strings.TrimSpace(addr)
+	if a, err := mail.ParseAddress(addr); err == nil {
+		addr = a.Address
+	}
+	for _, mod := range m.Moderators[group] {
+		if strings.EqualFold(mod, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// moderatedGroups returns the groups in the article's Newsgroups header
+// that are moderated.
+func moderatedGroups(b Backend, article *nntp.Article) []string {
+	rv := []string{}
+	for _, name := range SplitGroups(article.Header.Get("Newsgroups")) {
+		g, err := b.GetGroup(name)
+		if err == nil && g.Posting == nntp.PostingModerated {
+			rv = append(rv, name)
+		}
+	}
+	return rv
+}
+
+// check decides what to do with a post by the given user, who is ""
+// if the poster didn't authenticate.  It returns true if the article
+// was held for moderation and must not be posted; post then posts it
+// once it's approved.
+func (m *Moderation) check(b Backend, user string, article *nntp.Article, post func(*nntp.Article) error) (bool, error) {
+	groups := moderatedGroups(b, article)
+	if len(groups) == 0 {
+		return false, nil
+	}
+
+	// Anyone can write an Approved header; only moderators may post
+	// one.
+	if article.Header.Get("Approved") != "" {
+		for _, g := range groups {
+			if user == "" || !m.Authorised(g, user) {
+				return false, &NNTPError{441,
+					fmt.Sprintf("Not approved by a moderator of %s", g)}
+			}
+		}
+		return false, nil
+	}
+
+	if m.Submitter != nil {
+		return true, m.Submitter.Submit(groups, article)
+	}
+	return true, m.enqueue(groups, article, post)
+}
+
+func (m *Moderation) enqueue(groups []string, article *nntp.Article, post func(*nntp.Article) error) error {
+	body, err := ioutil.ReadAll(article.Body)
+	if err != nil {
+		return err
+	}
+
+	id := article.MessageID()
+	if id == "" {
+		return &NNTPError{441, "Message-ID required for moderation"}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.queue[id]; exists {
+		return &NNTPError{441, "Article already awaiting moderation"}
+	}
+	m.queue[id] = &QueuedArticle{
+		Groups:   groups,
+		Header:   article.Header,
+		Body:     body,
+		Received: time.Now(),
+		post:     post,
+	}
+	return nil
+}
+
+// List returns the articles awaiting moderation, oldest first.
+func (m *Moderation) List() []*QueuedArticle {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rv := make([]*QueuedArticle, 0, len(m.queue))
+	for _, qa := range m.queue {
+		rv = append(rv, qa)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Received.Before(rv[j].Received)
+	})
+	return rv
+}
+
+// Approve the queued article with the given message ID on behalf of
+// moderator, and post it.  Articles held by a session are posted as
+// that session would have, acting on control messages and passing them
+// to its history and AcceptHook.  The article stays queued if posting
+// fails.
+func (m *Moderation) Approve(id, moderator string) error {
+	// The article leaves the queue while it's posted, so it can't be
+	// approved twice.
+	m.mu.Lock()
+	qa, ok := m.queue[id]
+	if !ok {
+		m.mu.Unlock()
+		return ErrInvalidMessageID
+	}
+	for _, g := range qa.Groups {
+		if !m.Authorised(g, moderator) {
+			m.mu.Unlock()
+			return &NNTPError{441,
+				fmt.Sprintf("%s is not a moderator of %s", moderator, g)}
+		}
+	}
+	delete(m.queue, id)
+	m.mu.Unlock()
+
+	header := make(textproto.MIMEHeader, len(qa.Header)+1)
+	for k, v := range qa.Header {
+		header[k] = v
+	}
+	header.Set("Approved", moderator)
+	post := m.backend.Post
+	if qa.post != nil {
+		post = qa.post
+	}
+	err := post(&nntp.Article{
+		Header: header,
+		Body:   bytes.NewReader(qa.Body),
+		Bytes:  len(qa.Body),
+		Lines:  bytes.Count(qa.Body, []byte{'\n'}),
+	})
+	if err != nil {
+		m.mu.Lock()
+		if _, exists := m.queue[id]; !exists {
+			m.queue[id] = qa
+		}
+		m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// publish posts an article the way handlePost does once the backend
+// has it: through the server's Controls, into history and on to the
+// AcceptHook.
+func (s *session) publish(article *nntp.Article) error {
+	if err := s.post(article); err != nil {
+		return err
+	}
+	s.remember(article.MessageID(), article, nil)
+	s.accepted(article)
+	return nil
+}
+
+// publisher returns publish for the session as it is now, for posts
+// approved after it has moved on to another backend or ended.
+func (s *session) publisher() func(*nntp.Article) error {
+	held := *s
+	return held.publish
+}
+
+// Reject drops the queued article with the given message ID.
+func (m *Moderation) Reject(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.queue[id]; !ok {
+		return ErrInvalidMessageID
+	}
+	delete(m.queue, id)
+	return nil
+}
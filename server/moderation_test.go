@@ -0,0 +1,143 @@
+package nntpserver
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-nntp"
+)
+
+type recordingBackend struct {
+	groupsBackend
+	posted []*nntp.Article
+	err    error
+}
+
+func (rb *recordingBackend) Post(article *nntp.Article) error {
+	if rb.err != nil {
+		return rb.err
+	}
+	rb.posted = append(rb.posted, article)
+	return nil
+}
+
+func TestModerationQueue(t *testing.T) {
+	rb := &recordingBackend{groupsBackend: groupsBackend{groups: map[string]*nntp.Group{
+		"misc.test":      {Name: "misc.test", Posting: nntp.PostingPermitted},
+		"misc.moderated": {Name: "misc.moderated", Posting: nntp.PostingModerated},
+	}}}
+	// Held articles are posted to the backend they were held for.
+	other := &recordingBackend{}
+	m := NewModeration(other, map[string][]string{
+		"misc.moderated": {"mod@example.com"},
+	})
+
+	plain := &nntp.Article{Header: testHeader("Newsgroups", "misc.test")}
+	if held, err := m.check(rb, "", plain, rb.Post); held || err != nil {
+		t.Fatalf("Unmoderated post held=%v err=%v", held, err)
+	}
+
+	bogus := &nntp.Article{Header: testHeader(
+		"Newsgroups", "misc.test,misc.moderated",
+		"Approved", "mod@example.com")}
+	if _, err := m.check(rb, "someone@example.com", bogus, rb.Post); err == nil {
+		t.Fatalf("Accepted approval from non-moderator")
+	}
+	if _, err := m.check(rb, "", bogus, rb.Post); err == nil {
+		t.Fatalf("Accepted approval from anonymous poster")
+	}
+
+	approved := &nntp.Article{Header: testHeader(
+		"Newsgroups", "misc.moderated",
+		"Approved", "Mod <mod@example.com>")}
+	if held, err := m.check(rb, "MOD@example.com", approved, rb.Post); held || err != nil {
+		t.Fatalf("Approved post held=%v err=%v", held, err)
+	}
+
+	noID := &nntp.Article{
+		Header: testHeader("Newsgroups", "misc.moderated"),
+		Body:   strings.NewReader("hello\n"),
+	}
+	if _, err := m.check(rb, "", noID, rb.Post); err == nil {
+		t.Fatalf("Queued an article without a Message-ID")
+	}
+
+	post := &nntp.Article{
+		Header: testHeader("Newsgroups", "misc.moderated",
+			"Message-Id", "<1@example.com>"),
+		Body: strings.NewReader("hello\n"),
+	}
+	if held, err := m.check(rb, "", post, rb.Post); !held || err != nil {
+		t.Fatalf("Unapproved post held=%v err=%v", held, err)
+	}
+	if q := m.List(); len(q) != 1 || q[0].MessageID() != "<1@example.com>" {
+		t.Fatalf("Unexpected queue: %v", q)
+	}
+
+	if err := m.Approve("<1@example.com>", "someone@example.com"); err == nil {
+		t.Fatalf("Non-moderator approved an article")
+	}
+	rb.err = ErrPostingFailed
+	if err := m.Approve("<1@example.com>", "mod@example.com"); err == nil || len(m.List()) != 1 {
+		t.Fatalf("Failed approval: %v, queue %v", err, m.List())
+	}
+	rb.err = nil
+	if err := m.Approve("<1@example.com>", "mod@example.com"); err != nil {
+		t.Fatalf("Error approving: %v", err)
+	}
+	if err := m.Approve("<1@example.com>", "mod@example.com"); err != ErrInvalidMessageID {
+		t.Fatalf("Approved twice: %v", err)
+	}
+	if len(m.List()) != 0 || len(rb.posted) != 1 || len(other.posted) != 0 {
+		t.Fatalf("Approved article not posted")
+	}
+	if got := rb.posted[0].Header.Get("Approved"); got != "mod@example.com" {
+		t.Errorf("Approved header = %q", got)
+	}
+	if b, _ := ioutil.ReadAll(rb.posted[0].Body); string(b) != "hello\n" {
+		t.Errorf("Posted body = %q", b)
+	}
+}
+
+func TestModerationApprovePublishes(t *testing.T) {
+	rb := &recordingBackend{groupsBackend: groupsBackend{
+		Backend: lazyBackend{},
+		groups: map[string]*nntp.Group{
+			"misc.moderated": {Name: "misc.moderated", Posting: nntp.PostingModerated},
+		},
+	}}
+	h := mapHistory{}
+	var accepted []string
+	s := NewServer(rb)
+	s.Logger = discardLogger
+	s.History = h
+	s.AcceptHook = func(a *nntp.Article) { accepted = append(accepted, a.MessageID()) }
+	s.Moderation = NewModeration(rb, map[string][]string{
+		"misc.moderated": {"mod@example.com"},
+	})
+
+	c, _ := startSession(t, s)
+	c.PrintfLine("POST")
+	c.ReadCodeLine(340)
+	dw := c.DotWriter()
+	io.WriteString(dw, "Message-ID: <1@example.com>\nNewsgroups: misc.moderated\n\nhello\n")
+	dw.Close()
+	if _, _, err := c.ReadCodeLine(240); err != nil {
+		t.Fatalf("Error posting: %v", err)
+	}
+	c.Close()
+	if len(rb.posted) != 0 || h.Seen("<1@example.com>") || len(accepted) != 0 {
+		t.Fatalf("Held article published")
+	}
+
+	if err := s.Moderation.Approve("<1@example.com>", "mod@example.com"); err != nil {
+		t.Fatalf("Error approving: %v", err)
+	}
+	if len(rb.posted) != 1 || !h.Seen("<1@example.com>") ||
+		len(accepted) != 1 || accepted[0] != "<1@example.com>" {
+		t.Errorf("Approved article posted %d times, seen %v, accepted %v",
+			len(rb.posted), h.Seen("<1@example.com>"), accepted)
+	}
+}
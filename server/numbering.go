@@ -0,0 +1,113 @@
+package nntpserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-nntp"
+)
+
+// An XrefEntry is an article's number in one group.
+type XrefEntry struct {
+	Group string
+	Num   int64
+}
+
+// A Numberer allocates article numbers for a Backend.
+//
+// An article crossposted to several groups is numbered in all of them
+// in one step, so concurrent posts can never interleave, and the
+// resulting Xref header records every number it was given.  A Numberer
+// is safe for concurrent use.
+type Numberer struct {
+	// PathIdentity names this host in Xref headers.
+	PathIdentity string
+
+	mu   sync.Mutex
+	high map[string]int64
+}
+
+// NewNumberer builds a Numberer writing Xref headers for pathIdentity.
+func NewNumberer(pathIdentity string) *Numberer {
+	return &Numberer{
+		PathIdentity: pathIdentity,
+		high:         make(map[string]int64),
+	}
+}
+
+// Seed tells the Numberer the highest number already used in a group,
+// e.g. when a backend loads its state.  Numbers lower than one already
+// allocated are ignored, so seeding from a stale cache is harmless.
+func (n *Numberer) Seed(group string, high int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if high > n.high[group] {
+		n.high[group] = high
+	}
+}
+
+// High returns the highest number allocated in a group.
+func (n *Numberer) High(group string) int64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.high[group]
+}
+
+// Assign allocates the next number in each of the given groups.
+// Groups listed more than once are numbered once.
+func (n *Numberer) Assign(groups []string) []XrefEntry {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	rv := make([]XrefEntry, 0, len(groups))
+	seen := make(map[string]bool, len(groups))
+	for _, g := range groups {
+		if seen[g] {
+			continue
+		}
+		seen[g] = true
+		n.high[g]++
+		rv = append(rv, XrefEntry{g, n.high[g]})
+	}
+	return rv
+}
+
+// Xref formats an Xref header value for the given entries.
+func (n *Numberer) Xref(entries []XrefEntry) string {
+	parts := make([]string, 0, len(entries)+1)
+	parts = append(parts, n.PathIdentity)
+	for _, e := range entries {
+		parts = append(parts, fmt.Sprintf("%s:%d", e.Group, e.Num))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Number allocates numbers for an article in the given groups and sets
+// its Xref header, replacing any Xref it arrived with.
+func (n *Numberer) Number(article *nntp.Article, groups []string) []XrefEntry {
+	entries := n.Assign(groups)
+	article.Header.Set("Xref", n.Xref(entries))
+	return entries
+}
+
+// ParseXref parses an Xref header value, ignoring the host name.
+func ParseXref(v string) []XrefEntry {
+	fields := strings.Fields(v)
+	if len(fields) < 2 {
+		return nil
+	}
+	rv := make([]XrefEntry, 0, len(fields)-1)
+	for _, f := range fields[1:] {
+		i := strings.LastIndex(f, ":")
+		if i < 1 {
+			continue
+		}
+		num, err := strconv.ParseInt(f[i+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		rv = append(rv, XrefEntry{f[:i], num})
+	}
+	return rv
+}
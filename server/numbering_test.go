@@ -0,0 +1,56 @@
+package nntpserver
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/dustin/go-nntp"
+)
+
+func TestNumberer(t *testing.T) {
+	n := NewNumberer("news.example.com")
+	n.Seed("misc.test", 10)
+	n.Seed("misc.test", 5)
+
+	a := &nntp.Article{Header: testHeader("Xref", "elsewhere misc.test:99")}
+	got := n.Number(a, []string{"misc.test", "alt.test", "misc.test"})
+	exp := []XrefEntry{{"misc.test", 11}, {"alt.test", 1}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("Got %v, wanted %v", got, exp)
+	}
+	if x := a.Header.Get("Xref"); x != "news.example.com misc.test:11 alt.test:1" {
+		t.Fatalf("Xref = %q", x)
+	}
+	if p := ParseXref(a.Header.Get("Xref")); !reflect.DeepEqual(p, exp) {
+		t.Fatalf("ParseXref = %v", p)
+	}
+}
+
+func TestNumbererConcurrentCrossposts(t *testing.T) {
+	n := NewNumberer("news.example.com")
+	var wg sync.WaitGroup
+	results := make(chan []XrefEntry, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- n.Assign([]string{"a", "b"})
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	seen := map[int64]bool{}
+	for r := range results {
+		// Every crosspost gets the same number in both groups, since
+		// nothing else posts to just one of them.
+		if r[0].Num != r[1].Num || seen[r[0].Num] {
+			t.Fatalf("Bad allocation %v", r)
+		}
+		seen[r[0].Num] = true
+	}
+	if n.High("a") != 100 || n.High("b") != 100 {
+		t.Fatalf("High marks %d %d", n.High("a"), n.High("b"))
+	}
+}
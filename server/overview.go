@@ -0,0 +1,170 @@
+package nntpserver
+
+import (
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-nntp"
+)
+
+// An OverviewRecord holds the overview data of an article: the fields
+// OVER returns, plus its Xref.
+type OverviewRecord struct {
+	Num        int64
+	Subject    string
+	From       string
+	Date       string
+	MessageID  string
+	References string
+	Bytes      int
+	Lines      int
+	Xref       string
+}
+
+// An OverviewBackend is a Backend that can return overview records
+// without loading whole articles.  OVER, XOVER, HDR and LISTGROUP use
+// it when the backend provides it.  The overview package provides an
+// index backends can keep for this.
+type OverviewBackend interface {
+	GetOverview(group *nntp.Group, from, to int64) ([]OverviewRecord, error)
+}
+
+var errNoArticlesInRange = &NNTPError{423, "No articles in that range"}
+
+// overviewField cleans a header value for the overview, where tabs and
+// line breaks aren't allowed.
+func overviewField(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '\t', '\r', '\n':
+			return ' '
+		}
+		return r
+	}, v)
+}
+
+// NewOverviewRecord builds the overview record of an article with the
+// given number.  The article's body is not read.
+func NewOverviewRecord(num int64, a *nntp.Article) OverviewRecord {
+	return OverviewRecord{
+		Num:        num,
+		Subject:    overviewField(a.Header.Get("Subject")),
+		From:       overviewField(a.Header.Get("From")),
+		Date:       overviewField(a.Header.Get("Date")),
+		MessageID:  overviewField(a.Header.Get("Message-Id")),
+		References: overviewField(a.Header.Get("References")),
+		Bytes:      a.Bytes,
+		Lines:      a.Lines,
+		Xref:       overviewField(a.Header.Get("Xref")),
+	}
+}
+
+// Field returns the value of an overview field by header name, or
+// metadata item such as ":bytes".  ok is false if the field isn't in
+// the overview.
+func (r *OverviewRecord) Field(name string) (v string, ok bool) {
+	switch strings.ToLower(name) {
+	case "subject":
+		return r.Subject, true
+	case "from":
+		return r.From, true
+	case "date":
+		return r.Date, true
+	case "message-id":
+		return r.MessageID, true
+	case "references":
+		return r.References, true
+	case ":bytes", "bytes":
+		return strconv.Itoa(r.Bytes), true
+	case ":lines", "lines":
+		return strconv.Itoa(r.Lines), true
+	case "xref":
+		return r.Xref, true
+	}
+	return "", false
+}
+
+/*
+   Syntax
+     HDR field message-id
+     HDR field range
+     HDR field
+
+   First form (message-id specified)
+     225    Headers follow (multi-line)
+     430    No article with that message-id
+
+   Second form (range specified)
+     225    Headers follow (multi-line)
+     412    No newsgroup selected
+     423    No articles in that range
+
+   Third form (current article number used)
+     225    Headers follow (multi-line)
+     412    No newsgroup selected
+     420    Current article number is invalid
+*/
+
+func handleHdr(args []string, s *session, c *textproto.Conn) error {
+	return sendHdr(225, args, s, c)
+}
+
+// XHDR is HDR's predecessor, which answers with 221.
+func handleXHdr(args []string, s *session, c *textproto.Conn) error {
+	return sendHdr(221, args, s, c)
+}
+
+func sendHdr(code int, args []string, s *session, c *textproto.Conn) error {
+	if len(args) < 1 {
+		return ErrSyntax
+	}
+	field := args[0]
+	if len(args) < 2 {
+		if s.group == nil {
+			return ErrNoGroupSelected
+		}
+		return ErrNoCurrentArticle
+	}
+
+	if strings.HasPrefix(args[1], "<") {
+		article, err := s.fetchArticle(args[1])
+		if err != nil {
+			return err
+		}
+		r := NewOverviewRecord(0, article)
+		v, ok := r.Field(field)
+		if !ok {
+			v = overviewField(article.Header.Get(field))
+		}
+		c.PrintfLine("%d Headers follow", code)
+		dw := c.DotWriter()
+		defer dw.Close()
+		_, err = fmt.Fprintf(dw, "0 %s\n", v)
+		return err
+	}
+
+	if s.group == nil {
+		return ErrNoGroupSelected
+	}
+	from, to := parseRange(args[1])
+
+	l := &listing{c: c, status: fmt.Sprintf("%d Headers follow", code)}
+	var err error
+	probe := OverviewRecord{}
+	if _, ok := probe.Field(field); ok {
+		err = s.eachOverview(from, to, func(r OverviewRecord) error {
+			v, _ := r.Field(field)
+			return l.Printf("%d %s\n", r.Num, v)
+		})
+	} else {
+		err = s.eachArticle(from, to, func(a NumberedArticle) error {
+			return l.Printf("%d %s\n", a.Num, overviewField(a.Article.Header.Get(field)))
+		})
+	}
+	if err == nil && l.n == 0 {
+		return errNoArticlesInRange
+	}
+	return l.finish(err)
+}
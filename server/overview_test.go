@@ -0,0 +1,124 @@
+package nntpserver
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-nntp"
+)
+
+// overBackend holds three articles in one group.
+type overBackend struct {
+	Backend
+	loads int
+}
+
+func (ob *overBackend) GetGroup(name string) (*nntp.Group, error) {
+	return &nntp.Group{Name: name, Count: 3, Low: 1, High: 3}, nil
+}
+
+func (ob *overBackend) GetArticles(g *nntp.Group, from, to int64) ([]NumberedArticle, error) {
+	ob.loads++
+	rv := []NumberedArticle{}
+	for n := from; n <= to && n <= 3; n++ {
+		if n < 1 {
+			continue
+		}
+		id := "<" + string(rune('0'+n)) + "@x>"
+		rv = append(rv, NumberedArticle{n, &nntp.Article{
+			Header: textproto.MIMEHeader{
+				"Subject":    {"Article\t" + id},
+				"Message-Id": {id},
+				"X-Extra":    {"extra " + id},
+			},
+			Bytes: 100,
+			Lines: 2,
+		}})
+	}
+	return rv, nil
+}
+
+func (ob *overBackend) GetArticle(g *nntp.Group, id string) (*nntp.Article, error) {
+	as, _ := ob.GetArticles(g, 1, 3)
+	ob.loads--
+	for _, a := range as {
+		if a.Article.MessageID() == id {
+			return a.Article, nil
+		}
+	}
+	return nil, ErrInvalidMessageID
+}
+
+// indexedBackend answers overview requests without loading articles.
+type indexedBackend struct {
+	overBackend
+}
+
+func (ib *indexedBackend) GetOverview(g *nntp.Group, from, to int64) ([]OverviewRecord, error) {
+	as, _ := ib.overBackend.GetArticles(g, from, to)
+	ib.loads--
+	rv := []OverviewRecord{}
+	for _, a := range as {
+		rv = append(rv, NewOverviewRecord(a.Num, a.Article))
+	}
+	return rv, nil
+}
+
+func readLines(t *testing.T, c *textproto.Conn, cmd string, code int) string {
+	t.Helper()
+	c.PrintfLine(cmd)
+	if _, _, err := c.ReadCodeLine(code); err != nil {
+		t.Fatalf("%s: %v", cmd, err)
+	}
+	lines, err := c.ReadDotLines()
+	if err != nil {
+		t.Fatalf("%s: error reading lines: %v", cmd, err)
+	}
+	return strings.Join(lines, "|")
+}
+
+func TestOverviewCommands(t *testing.T) {
+	for _, b := range []interface {
+		Backend
+		loaded() int
+	}{&overBackend{}, &indexedBackend{}} {
+		c, _ := startSession(t, NewServer(b))
+		c.PrintfLine("GROUP misc.test")
+		c.ReadCodeLine(211)
+
+		for _, test := range []struct {
+			cmd  string
+			code int
+			exp  string
+		}{
+			{"OVER 2-", 224, "2\tArticle <2@x>\t\t\t<2@x>\t\t100\t2|3\tArticle <3@x>\t\t\t<3@x>\t\t100\t2"},
+			{"HDR Subject 1-2", 225, "1 Article <1@x>|2 Article <2@x>"},
+			{"HDR :lines 3", 225, "3 2"},
+			{"XHDR Message-ID 3-", 221, "3 <3@x>"},
+			{"HDR X-Extra <2@x>", 225, "0 extra <2@x>"},
+			{"LISTGROUP misc.test 2-3", 211, "2|3"},
+		} {
+			if got := readLines(t, c, test.cmd, test.code); got != test.exp {
+				t.Errorf("%T %s: got %q, wanted %q", b, test.cmd, got, test.exp)
+			}
+		}
+		c.PrintfLine("HDR Subject 10-20")
+		if _, _, err := c.ReadCodeLine(423); err != nil {
+			t.Errorf("Expected an empty range refused, got %v", err)
+		}
+		c.Close()
+
+		// OVER, HDR Subject, HDR :lines, XHDR, LISTGROUP and the
+		// empty range each load articles without an index.
+		exp := 6
+		if _, ok := b.(OverviewBackend); ok {
+			exp = 0
+		}
+		if b.loaded() != exp {
+			t.Errorf("%T loaded articles %d times, expected %d", b, b.loaded(), exp)
+		}
+	}
+}
+
+func (ob *overBackend) loaded() int { return ob.loads }
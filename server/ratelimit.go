@@ -0,0 +1,219 @@
+package nntpserver
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned for a post from a user or address that has
+// exceeded its posting rate.
+var ErrRateLimited = &NNTPError{441, "Posting rate exceeded, try again later"}
+
+// ErrAuthRateLimited is sent, before the connection is closed, to a
+// client that has failed to authenticate too often.
+var ErrAuthRateLimited = &NNTPError{400, "Too many authentication failures"}
+
+// A Limit allows N events per Per, in bursts of up to N.  The zero
+// Limit allows everything.
+type Limit struct {
+	N   float64
+	Per time.Duration
+}
+
+func (l Limit) enabled() bool {
+	return l.N > 0 && l.Per > 0
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// A RateLimiter keeps token buckets for each authenticated user and
+// each client IP address.  A post must find tokens in both the user's
+// and the address's buckets.
+type RateLimiter struct {
+	// Posts limits the number of articles posted.
+	Posts Limit
+	// Bytes limits the size of the articles posted.  Articles are
+	// charged once read, so a client may overdraw its bucket by one
+	// article, and has to wait for it to refill.
+	Bytes Limit
+	// AuthFailures limits failed AUTHINFO attempts, counted against
+	// both the address and the user name tried.  Clients past the
+	// limit are disconnected.
+	AuthFailures Limit
+	// Tarpit delays the answer to each failed AUTHINFO attempt.
+	Tarpit time.Duration
+	// Now returns the current time.  It defaults to time.Now.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*bucket
+	pruned  time.Time
+}
+
+// NewRateLimiter builds a RateLimiter with the given post and byte
+// limits.
+func NewRateLimiter(posts, bytes Limit) *RateLimiter {
+	return &RateLimiter{
+		Posts: posts,
+		Bytes: bytes,
+		Now:   time.Now,
+	}
+}
+
+// refill returns the bucket of the given kind for key, topped up to
+// now.  The caller must hold rl.mu.
+func (rl *RateLimiter) refill(kind string, l Limit, key string, now time.Time) *bucket {
+	if rl.buckets == nil {
+		rl.buckets = map[string]map[string]*bucket{}
+	}
+	m := rl.buckets[kind]
+	if m == nil {
+		m = map[string]*bucket{}
+		rl.buckets[kind] = m
+	}
+	b := m[key]
+	if b == nil {
+		b = &bucket{tokens: l.N, at: now}
+		m[key] = b
+	}
+	b.tokens += l.N * float64(now.Sub(b.at)) / float64(l.Per)
+	if b.tokens > l.N {
+		b.tokens = l.N
+	}
+	b.at = now
+	return b
+}
+
+// prune forgets buckets that have refilled, which are no different
+// from new ones.  The caller must hold rl.mu.
+func (rl *RateLimiter) prune(now time.Time) {
+	if now.Sub(rl.pruned) < time.Minute {
+		return
+	}
+	rl.pruned = now
+	for kind, l := range map[string]Limit{
+		"posts": rl.Posts,
+		"bytes": rl.Bytes,
+		"auth":  rl.AuthFailures,
+	} {
+		for key := range rl.buckets[kind] {
+			if rl.refill(kind, l, key, now).tokens >= l.N {
+				delete(rl.buckets[kind], key)
+			}
+		}
+	}
+}
+
+func (rl *RateLimiter) now() time.Time {
+	if rl.Now != nil {
+		return rl.Now()
+	}
+	return time.Now()
+}
+
+// allowPost takes a post token from each key's bucket if all of them
+// have posts and bytes left, and reports whether it did.
+func (rl *RateLimiter) allowPost(keys []string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	rl.prune(now)
+	for _, k := range keys {
+		if rl.Posts.enabled() && rl.refill("posts", rl.Posts, k, now).tokens < 1 {
+			return false
+		}
+		if rl.Bytes.enabled() && rl.refill("bytes", rl.Bytes, k, now).tokens <= 0 {
+			return false
+		}
+	}
+	if rl.Posts.enabled() {
+		for _, k := range keys {
+			rl.buckets["posts"][k].tokens--
+		}
+	}
+	return true
+}
+
+// chargeBytes takes n byte tokens from each key's bucket.
+func (rl *RateLimiter) chargeBytes(keys []string, n int64) {
+	if !rl.Bytes.enabled() {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	for _, k := range keys {
+		rl.refill("bytes", rl.Bytes, k, now).tokens -= float64(n)
+	}
+}
+
+// allowAuth reports whether the keys have any authentication failures
+// left.
+func (rl *RateLimiter) allowAuth(keys []string) bool {
+	if !rl.AuthFailures.enabled() {
+		return true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	rl.prune(now)
+	for _, k := range keys {
+		if rl.refill("auth", rl.AuthFailures, k, now).tokens < 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// authFailed charges a failed authentication to the keys, then waits
+// out the tarpit.
+func (rl *RateLimiter) authFailed(keys []string) {
+	if rl.AuthFailures.enabled() {
+		rl.mu.Lock()
+		now := rl.now()
+		for _, k := range keys {
+			rl.refill("auth", rl.AuthFailures, k, now).tokens--
+		}
+		rl.mu.Unlock()
+	}
+	time.Sleep(rl.Tarpit)
+}
+
+// Var returns an expvar.Var showing, by kind and key, the tokens each
+// bucket had left when last used.  Publish it with expvar.Publish.
+func (rl *RateLimiter) Var() expvar.Var {
+	return expvar.Func(func() interface{} {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		rv := map[string]map[string]float64{}
+		for kind, m := range rl.buckets {
+			rv[kind] = map[string]float64{}
+			for key, b := range m {
+				rv[kind][key] = b.tokens
+			}
+		}
+		return rv
+	})
+}
+
+// limitKeys returns the rate limiter keys for the session's client: its
+// IP address, and the user name it authenticated as or is trying to.
+func (s *session) limitKeys(user string) []string {
+	host := ""
+	if s.remote != nil {
+		host = s.remote.String()
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	keys := []string{"ip:" + host}
+	if user != "" {
+		keys = append(keys, "user:"+user)
+	}
+	return keys
+}
@@ -0,0 +1,123 @@
+package nntpserver
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+type authBackend struct {
+	lazyBackend
+}
+
+func (authBackend) Authorized() bool { return false }
+
+func (authBackend) Authenticate(user, pass string) (Backend, error) {
+	if pass != "secret" {
+		return nil, ErrAuthRejected
+	}
+	return nil, nil
+}
+
+func TestRateLimitPosts(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	rl := NewRateLimiter(Limit{2, time.Minute}, Limit{1000, time.Minute})
+	rl.Now = func() time.Time { return now }
+	s := NewServer(authBackend{})
+	s.RateLimiter = rl
+	c, _ := startSession(t, s)
+	defer c.Close()
+
+	post := func(size, code int) {
+		t.Helper()
+		c.PrintfLine("POST")
+		if _, _, err := c.ReadCodeLine(340); err != nil {
+			t.Fatalf("Error starting post: %v", err)
+		}
+		dw := c.DotWriter()
+		io.WriteString(dw, "Subject: test\n\n")
+		dw.Write(make([]byte, size))
+		dw.Close()
+		if _, _, err := c.ReadCodeLine(code); err != nil {
+			t.Fatalf("Post of %d bytes at %v: %v", size, now, err)
+		}
+	}
+
+	post(10, 240)
+	post(10, 240)
+	post(10, 441)
+	now = now.Add(30 * time.Second)
+	// A post token has come back, but this overdraws the bytes.
+	post(1500, 240)
+	now = now.Add(30 * time.Second)
+	post(10, 441)
+	now = now.Add(time.Minute)
+	post(10, 240)
+
+	if n := s.Stats.Get("ratelimit_posts").String(); n != "2" {
+		t.Errorf("Expected 2 rate limited posts, got %v", n)
+	}
+}
+
+func TestRateLimitAuth(t *testing.T) {
+	rl := &RateLimiter{AuthFailures: Limit{2, time.Hour}}
+	s := NewServer(authBackend{})
+	s.RateLimiter = rl
+	c, done := startSession(t, s)
+	defer c.Close()
+
+	for _, test := range []struct {
+		pass string
+		code int
+	}{
+		{"wrong", 452},
+		{"wrong", 452},
+	} {
+		c.PrintfLine("AUTHINFO USER fred")
+		if _, _, err := c.ReadCodeLine(350); err != nil {
+			t.Fatalf("Error starting auth: %v", err)
+		}
+		c.PrintfLine("AUTHINFO PASS %s", test.pass)
+		if _, _, err := c.ReadCodeLine(test.code); err != nil {
+			t.Fatalf("AUTHINFO PASS %s: %v", test.pass, err)
+		}
+	}
+
+	c.PrintfLine("AUTHINFO USER fred")
+	if _, _, err := c.ReadCodeLine(400); err != nil {
+		t.Fatalf("Expected disconnection after too many failures, got %v", err)
+	}
+	<-done
+}
+
+func TestRateLimitRefusedBytes(t *testing.T) {
+	// More than the headers' read buffer holds.
+	rl := NewRateLimiter(Limit{10, time.Minute}, Limit{8000, time.Minute})
+	s := NewServer(authBackend{})
+	s.RateLimiter = rl
+	s.Injector = NewInjector("news.example.com")
+	c, _ := startSession(t, s)
+	defer c.Close()
+
+	post := func(header string, size, code int) {
+		t.Helper()
+		c.PrintfLine("POST")
+		if _, _, err := c.ReadCodeLine(340); err != nil {
+			t.Fatalf("Error starting post: %v", err)
+		}
+		dw := c.DotWriter()
+		io.WriteString(dw, header+"\n")
+		dw.Write(make([]byte, size))
+		dw.Close()
+		if _, _, err := c.ReadCodeLine(code); err != nil {
+			t.Fatalf("Post of %d bytes: %v", size, err)
+		}
+	}
+
+	// Refused for its headers, with the body left unread.
+	post("Subject: test\n", 20000, 441)
+	post("From: a@example.com\nNewsgroups: misc.test\nSubject: test\n", 10, 441)
+	if n := s.Stats.Get("ratelimit_posts"); n == nil || n.String() != "1" {
+		t.Errorf("Expected the refused post's bytes charged, got %v rate limited", n)
+	}
+}
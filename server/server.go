@@ -2,15 +2,19 @@
 package nntpserver
 
 import (
+	"crypto/tls"
+	"expvar"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"net"
 	"net/textproto"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dustin/go-nntp"
 )
@@ -66,6 +70,14 @@ var ErrAuthRejected = &NNTPError{452, "authorization rejected"}
 // authentication, but authentication was not provided.
 var ErrNotAuthenticated = &NNTPError{480, "authentication required"}
 
+// ErrAlreadyAuthenticated is returned for AUTHINFO once the session
+// has authenticated.
+var ErrAlreadyAuthenticated = &NNTPError{502, "Already authenticated"}
+
+// ErrInternalFault is sent to a client before its connection is
+// dropped because a handler or the backend panicked.
+var ErrInternalFault = &NNTPError{403, "internal fault"}
+
 // Handler is a low-level protocol handler
 type Handler func(args []string, s *session, c *textproto.Conn) error
 
@@ -90,10 +102,31 @@ type Backend interface {
 	Post(article *nntp.Article) error
 }
 
+// An Authenticator checks AUTHINFO passwords, like
+// Backend.Authenticate.
+type Authenticator interface {
+	Authenticate(user, pass string) (Backend, error)
+}
+
 type session struct {
 	server  *Server
 	backend Backend
 	group   *nntp.Group
+	remote  net.Addr
+	// The connection, which STARTTLS replaces.
+	nc   net.Conn
+	conn *textproto.Conn
+	// The user name the session authenticated as, if any.
+	user string
+	// Whether the connection is encrypted.
+	tls bool
+	// The user the client's certificate maps to, if any, and the
+	// Backend to switch to once AUTHINFO SASL EXTERNAL authenticates
+	// the session as them.
+	certUser    string
+	certBackend Backend
+	// The site the client connected to, if the server has several.
+	site *Site
 }
 
 // The Server handle.
@@ -102,6 +135,61 @@ type Server struct {
 	Handlers map[string]Handler
 	// The backend (your code) that provides data
 	Backend Backend
+	// Logger receives the server's log output.  If nil, the log
+	// package's standard logger is used.
+	Logger *log.Logger
+	// PanicHook, if set, is called after a panic in a session has been
+	// recovered, with the client's address, the panic value and the
+	// stack trace.  The session is closed once it returns.
+	PanicHook func(remote net.Addr, v interface{}, stack []byte)
+	// Stats counts notable events (e.g. "panics").  Publish it with
+	// expvar.Publish to export it.
+	Stats *expvar.Map
+	// Injector, if set, checks and completes articles received by POST
+	// before they are handed to the backend.
+	Injector *Injector
+	// MaxArticleSize limits the size in bytes of articles received by
+	// POST and IHAVE, headers included.  Zero means no limit.
+	MaxArticleSize int64
+	// RateLimiter, if set, limits how fast each user and address
+	// may post and fail to authenticate.
+	RateLimiter *RateLimiter
+	// Filters, if set, vets articles received by POST, IHAVE and
+	// TAKETHIS before they are handed to the backend.
+	Filters *FilterChain
+	// Moderation, if set, holds posts to moderated groups that haven't
+	// been approved.
+	Moderation *Moderation
+	// Controls, if set, acts on control messages received by POST and
+	// IHAVE.  Otherwise they are stored as ordinary articles.
+	Controls *Controls
+	// History, if set, is used to refuse articles offered by IHAVE,
+	// CHECK and TAKETHIS that the server has seen before.
+	History History
+	// AcceptHook, if set, is called with each article the backend
+	// has accepted, e.g. to feed it to peers.  The article's body has
+	// been consumed by then.
+	AcceptHook func(article *nntp.Article)
+	// ACL, if set, limits which groups each client may see, read
+	// and post to.  It doesn't apply to IHAVE and TAKETHIS.
+	ACL ACL
+	// TLSConfig, if set, lets clients upgrade their connections with
+	// STARTTLS.
+	TLSConfig *tls.Config
+	// Authenticator, if set, checks AUTHINFO passwords instead of the
+	// Backend's Authenticate method, even if the Backend is Authorized.
+	Authenticator Authenticator
+	// CertAuth, if set, lets clients presenting a verified certificate
+	// over TLS, whether implicit or by STARTTLS, authenticate with
+	// AUTHINFO SASL EXTERNAL.
+	CertAuth CertAuthenticator
+	// HandshakeTimeout limits how long a TLS handshake may take.  It
+	// defaults to DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+	// Sites, if set, are the news sites the server serves besides its
+	// own Backend; each connection is served by the first site that
+	// answers to it, or the server's Backend if none does.
+	Sites []*Site
 	// The currently selected group.
 	group *nntp.Group
 }
@@ -111,6 +199,7 @@ func NewServer(backend Backend) *Server {
 	rv := Server{
 		Handlers: make(map[string]Handler),
 		Backend:  backend,
+		Stats:    new(expvar.Map).Init(),
 	}
 	rv.Handlers[""] = handleDefault
 	rv.Handlers["quit"] = handleQuit
@@ -122,12 +211,17 @@ func NewServer(backend Backend) *Server {
 	rv.Handlers["article"] = handleArticle
 	rv.Handlers["post"] = handlePost
 	rv.Handlers["ihave"] = handleIHave
+	rv.Handlers["check"] = handleCheck
+	rv.Handlers["takethis"] = handleTakeThis
 	rv.Handlers["capabilities"] = handleCap
 	rv.Handlers["mode"] = handleMode
 	rv.Handlers["authinfo"] = handleAuthInfo
+	rv.Handlers["starttls"] = handleStartTLS
 	rv.Handlers["newgroups"] = handleNewGroups
 	rv.Handlers["over"] = handleOver
 	rv.Handlers["xover"] = handleOver
+	rv.Handlers["hdr"] = handleHdr
+	rv.Handlers["xhdr"] = handleXHdr
 	return &rv
 }
 
@@ -135,9 +229,44 @@ func (e *NNTPError) Error() string {
 	return fmt.Sprintf("%d %s", e.Code, e.Msg)
 }
 
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func (s *Server) count(name string) {
+	if s.Stats != nil {
+		s.Stats.Add(name, 1)
+	}
+}
+
+// recoverSession turns a panic in a session into a 403 for that client
+// only.  It must be deferred directly by Process.
+func (s *Server) recoverSession(sess *session) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	stack := debug.Stack()
+	s.logf("Panic in session from %v, dropping conn: %v\n%s",
+		sess.remote, v, stack)
+	s.count("panics")
+	if s.PanicHook != nil {
+		s.PanicHook(sess.remote, v, stack)
+	}
+	sess.conn.PrintfLine(ErrInternalFault.Error())
+}
+
 func (s *session) dispatchCommand(cmd string, args []string,
 	c *textproto.Conn) (err error) {
 
+	if capability, ok := commandCapabilities[strings.ToLower(cmd)]; ok &&
+		!s.offers(capability) {
+		return ErrUnknownCommand
+	}
 	handler, found := s.server.Handlers[strings.ToLower(cmd)]
 	if !found {
 		handler, found = s.server.Handlers[""]
@@ -151,23 +280,37 @@ func (s *session) dispatchCommand(cmd string, args []string,
 // Process an NNTP session.
 func (s *Server) Process(nc net.Conn) {
 	defer nc.Close()
-	c := textproto.NewConn(nc)
-
 	sess := &session{
 		server:  s,
 		backend: s.Backend,
 		group:   nil,
+		remote:  nc.RemoteAddr(),
+		nc:      nc,
+		conn:    textproto.NewConn(nc),
+	}
+	defer s.recoverSession(sess)
+	sess.setSite(s.siteFor(func(site *Site) bool {
+		return site.answersOn(nc.LocalAddr())
+	}))
+
+	if tc, ok := nc.(*tls.Conn); ok {
+		if err := sess.startTLS(tc); err != nil {
+			s.logf("TLS handshake with %v failed, dropping conn: %v",
+				sess.remote, err)
+			return
+		}
 	}
 
-	c.PrintfLine("200 Hello!")
+	sess.conn.PrintfLine("200 %s", sess.banner())
 	for {
+		c := sess.conn
 		l, err := c.ReadLine()
 		if err != nil {
-			log.Printf("Error reading from client, dropping conn: %v", err)
+			s.logf("Error reading from client, dropping conn: %v", err)
 			return
 		}
 		cmd := strings.Split(l, " ")
-		log.Printf("Got cmd:  %+v", cmd)
+		s.logf("Got cmd:  %+v", cmd)
 		args := []string{}
 		if len(cmd) > 1 {
 			args = cmd[1:]
@@ -182,7 +325,7 @@ func (s *Server) Process(nc net.Conn) {
 			case isNNTPError:
 				c.PrintfLine(err.Error())
 			default:
-				log.Printf("Error dispatching command, dropping conn: %v",
+				s.logf("Error dispatching command, dropping conn: %v",
 					err)
 				return
 			}
@@ -190,17 +333,30 @@ func (s *Server) Process(nc net.Conn) {
 	}
 }
 
+// Serve accepts connections on l and processes each in its own
+// goroutine.  It returns when l fails to accept one.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.Process(nc)
+	}
+}
+
 func parseRange(spec string) (low, high int64) {
 	if spec == "" {
 		return 0, math.MaxInt64
 	}
 	parts := strings.Split(spec, "-")
 	if len(parts) == 1 {
-		h, err := strconv.ParseInt(parts[0], 10, 64)
+		// A single number is just that article.
+		n, err := strconv.ParseInt(parts[0], 10, 64)
 		if err != nil {
-			h = math.MaxInt64
+			return 0, math.MaxInt64
 		}
-		return 0, h
+		return n, n
 	}
 	l, _ := strconv.ParseInt(parts[0], 10, 64)
 	h, err := strconv.ParseInt(parts[1], 10, 64)
@@ -225,24 +381,16 @@ func handleOver(args []string, s *session, c *textproto.Conn) error {
 	if s.group == nil {
 		return ErrNoGroupSelected
 	}
-	from, to := parseRange(args[0])
-	articles, err := s.backend.GetArticles(s.group, from, to)
-	if err != nil {
-		return err
-	}
-	c.PrintfLine("224 here it comes")
-	dw := c.DotWriter()
-	defer dw.Close()
-	for _, a := range articles {
-		fmt.Fprintf(dw, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", a.Num,
-			a.Article.Header.Get("Subject"),
-			a.Article.Header.Get("From"),
-			a.Article.Header.Get("Date"),
-			a.Article.Header.Get("Message-Id"),
-			a.Article.Header.Get("References"),
-			a.Article.Bytes, a.Article.Lines)
+	if len(args) < 1 {
+		return ErrNoCurrentArticle
 	}
-	return nil
+	from, to := parseRange(args[0])
+	l := &listing{c: c, status: "224 here it comes"}
+	return l.finish(s.eachOverview(from, to, func(r OverviewRecord) error {
+		return l.Printf("%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", r.Num,
+			r.Subject, r.From, r.Date, r.MessageID, r.References,
+			r.Bytes, r.Lines)
+	}))
 }
 
 func handleListOverviewFmt(c *textproto.Conn) error {
@@ -262,6 +410,21 @@ References:
 	return err
 }
 
+// HDR can return any header, though only those in the overview are
+// fast.
+func handleListHeaders(c *textproto.Conn) error {
+	err := c.PrintfLine("215 Headers and metadata items supported:")
+	if err != nil {
+		return err
+	}
+	dw := c.DotWriter()
+	defer dw.Close()
+	_, err = fmt.Fprintln(dw, `:
+:bytes
+:lines`)
+	return err
+}
+
 func handleList(args []string, s *session, c *textproto.Conn) error {
 	ltype := "active"
 	if len(args) > 0 {
@@ -271,6 +434,9 @@ func handleList(args []string, s *session, c *textproto.Conn) error {
 	if ltype == "overview.fmt" {
 		return handleListOverviewFmt(c)
 	}
+	if ltype == "headers" {
+		return handleListHeaders(c)
+	}
 
 	groups, err := s.backend.ListGroups(-1)
 	if err != nil {
@@ -280,10 +446,18 @@ func handleList(args []string, s *session, c *textproto.Conn) error {
 	dw := c.DotWriter()
 	defer dw.Close()
 	for _, g := range groups {
+		access := s.access(g.Name)
+		if access < AccessRead {
+			continue
+		}
 		switch ltype {
 		case "active":
+			posting := g.Posting
+			if access < AccessPost {
+				posting = nntp.PostingNotPermitted
+			}
 			fmt.Fprintf(dw, "%s %d %d %v\r\n",
-				g.Name, g.High, g.Low, g.Posting)
+				g.Name, g.High, g.Low, posting)
 		case "newsgroups":
 			fmt.Fprintf(dw, "%s %s\r\n", g.Name, g.Description)
 		}
@@ -312,7 +486,7 @@ func handleGroup(args []string, s *session, c *textproto.Conn) error {
 		return ErrNoSuchGroup
 	}
 
-	group, err := s.backend.GetGroup(args[0])
+	group, err := s.getGroup(args[0])
 	if err != nil {
 		return err
 	}
@@ -388,7 +562,7 @@ func handleListGroup(args []string, s *session, c *textproto.Conn) error {
 		// no group selected at this point? user passed a group in.
 		// we need to fetch it.
 		var err error
-		group, err = s.backend.GetGroup(args[0])
+		group, err = s.getGroup(args[0])
 		if err != nil {
 			return err
 		}
@@ -398,19 +572,15 @@ func handleListGroup(args []string, s *session, c *textproto.Conn) error {
 		s.group = group
 	}
 
-	articles, err := s.backend.GetArticles(s.group, from, to)
-	if err != nil {
-		return err
-	}
-
-	c.PrintfLine("211 %d %d %d %s list follows",
-		group.Count, group.Low, group.High, group.Name)
+	l := &listing{c: c, status: fmt.Sprintf("211 %d %d %d %s list follows",
+		group.Count, group.Low, group.High, group.Name)}
 
 	// Same as in OVER, except we only provide article's num.
-	dw := c.DotWriter()
-	defer dw.Close()
-	for _, a := range articles {
-		fmt.Fprintf(dw, "%d\n", a.Num)
+	err := s.eachOverview(from, to, func(r OverviewRecord) error {
+		return l.Printf("%d\n", r.Num)
+	})
+	if err = l.finish(err); err != nil {
+		return err
 	}
 
 	// like GROUP, this is meant to select the first article as the current
@@ -444,7 +614,20 @@ func (s *session) getArticle(args []string) (*nntp.Article, error) {
 		return nil, ErrNoCurrentArticle
 	}
 
-	return s.backend.GetArticle(s.group, args[0])
+	return s.fetchArticle(args[0])
+}
+
+// fetchArticle gets an article by number in the selected group, or by
+// message ID if the session may read it.
+func (s *session) fetchArticle(id string) (*nntp.Article, error) {
+	article, err := s.backend.GetArticle(s.group, id)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(id, "<") && !s.readable(article) {
+		return nil, ErrInvalidMessageID
+	}
+	return article, nil
 }
 
 func sendHeaders(dw io.Writer, article *nntp.Article) {
@@ -628,48 +811,108 @@ func handleArticle(args []string, s *session, c *textproto.Conn) error {
 */
 
 func handlePost(args []string, s *session, c *textproto.Conn) error {
-	if !s.backend.AllowPost() {
+	if !s.mayPost() {
 		return ErrPostingNotPermitted
 	}
 
 	c.PrintfLine("340 Go ahead")
-	var err error
-	var article nntp.Article
-	article.Header, err = c.ReadMIMEHeader()
+	article, ar, err := s.readArticle(c)
+	if rl := s.server.RateLimiter; rl != nil {
+		keys := s.limitKeys(s.user)
+		// The bytes are charged before the response is sent.
+		ar.finished = func(n int64) { rl.chargeBytes(keys, n) }
+		if err == nil && !rl.allowPost(keys) {
+			s.server.count("ratelimit_posts")
+			return ar.finish(ErrRateLimited)
+		}
+	}
 	if err != nil {
-		return ErrPostingFailed
+		return ar.finish(ErrPostingFailed)
 	}
-	article.Body = c.DotReader()
-	err = s.backend.Post(&article)
+	if in := s.injector(); in != nil {
+		err = in.Inject(s.backend, s.remote, s.user, article.Header)
+		if err != nil {
+			return ar.finish(err)
+		}
+	}
+	if err := s.checkPostGroups(article); err != nil {
+		return ar.finish(err)
+	}
+	if err := s.filter("POST", article); err != nil {
+		return ar.finish(err)
+	}
+	if m := s.moderation(); m != nil {
+		held, err := m.check(s.backend, s.user, article, s.publisher())
+		if err != nil {
+			return ar.finish(err)
+		}
+		if held {
+			if err := ar.finish(nil); err != nil {
+				return err
+			}
+			c.PrintfLine("240 article forwarded to moderator")
+			return nil
+		}
+	}
+	err = ar.finish(s.post(article))
 	if err != nil {
 		return err
 	}
+	s.remember(article.MessageID(), article, nil)
+	s.accepted(article)
 	c.PrintfLine("240 article received OK")
 	return nil
 }
 
+/*
+   Syntax
+     IHAVE message-id
+
+   Responses
+
+   Initial responses
+     335    Send article to be transferred
+     435    Article not wanted
+     436    Transfer not possible; try again later
+
+   Subsequent responses
+     235    Article transferred OK
+     436    Transfer failed; try again later
+     437    Transfer rejected; do not retry
+*/
+
 func handleIHave(args []string, s *session, c *textproto.Conn) error {
 	if !s.backend.AllowPost() {
 		return ErrNotWanted
 	}
+	if len(args) < 1 {
+		return ErrSyntax
+	}
 
-	// XXX:  See if we have it.
-	article, err := s.backend.GetArticle(nil, args[0])
-	if article != nil {
+	switch seen, ok := s.offerable(args[0]); {
+	case !ok:
+		return ErrTransferFailed
+	case seen:
 		return ErrNotWanted
 	}
 
 	c.PrintfLine("335 send it")
-	article = &nntp.Article{}
-	article.Header, err = c.ReadMIMEHeader()
+	article, ar, err := s.readArticle(c)
 	if err != nil {
-		return ErrPostingFailed
+		err = ar.finish(ErrTransferRejected)
+		s.remember(args[0], nil, err)
+		return err
+	}
+	err = s.filter("IHAVE", article)
+	if err == nil {
+		err = s.post(article)
 	}
-	article.Body = c.DotReader()
-	err = s.backend.Post(article)
+	err = ihaveError(ar.finish(err))
+	s.remember(args[0], article, err)
 	if err != nil {
 		return err
 	}
+	s.accepted(article)
 	c.PrintfLine("235 article received OK")
 	return nil
 }
@@ -679,20 +922,52 @@ func handleCap(args []string, s *session, c *textproto.Conn) error {
 	dw := c.DotWriter()
 	defer dw.Close()
 
-	fmt.Fprintf(dw, "VERSION 2\n")
-	fmt.Fprintf(dw, "READER\n")
+	offer := func(capability string) {
+		name := strings.Fields(capability)[0]
+		if c, ok := commandCapabilities[strings.ToLower(name)]; ok {
+			name = c
+		}
+		if s.offers(name) {
+			fmt.Fprintf(dw, "%s\n", capability)
+		}
+	}
+	offer("VERSION 2")
+	offer("READER")
+	if s.mayPost() {
+		offer("POST")
+	}
 	if s.backend.AllowPost() {
-		fmt.Fprintf(dw, "POST\n")
-		fmt.Fprintf(dw, "IHAVE\n")
+		offer("IHAVE")
+		offer("STREAMING")
+	}
+	offer("OVER")
+	offer("XOVER")
+	offer("HDR")
+	offer("LIST ACTIVE NEWSGROUPS OVERVIEW.FMT HEADERS")
+	if s.server.TLSConfig != nil && !s.tls && s.user == "" {
+		offer("STARTTLS")
+	}
+	// Authentication is only offered until it's done (RFC 4643,
+	// 2.2).
+	if s.user == "" {
+		if s.certUser != "" {
+			offer("AUTHINFO USER SASL")
+			offer("SASL EXTERNAL")
+		} else {
+			offer("AUTHINFO USER")
+		}
 	}
-	fmt.Fprintf(dw, "OVER\n")
-	fmt.Fprintf(dw, "XOVER\n")
-	fmt.Fprintf(dw, "LIST ACTIVE NEWSGROUPS OVERVIEW.FMT\n")
 	return nil
 }
 
 func handleMode(args []string, s *session, c *textproto.Conn) error {
-	if s.backend.AllowPost() {
+	if len(args) > 0 && strings.ToLower(args[0]) == "stream" {
+		if !s.backend.AllowPost() || !s.offers("STREAMING") {
+			return ErrUnknownCommand
+		}
+		return c.PrintfLine("203 Streaming permitted")
+	}
+	if s.mayPost() {
 		c.PrintfLine("200 Posting allowed")
 	} else {
 		c.PrintfLine("201 Posting prohibited")
@@ -704,26 +979,57 @@ func handleAuthInfo(args []string, s *session, c *textproto.Conn) error {
 	if len(args) < 2 {
 		return ErrSyntax
 	}
-	if strings.ToLower(args[0]) != "user" {
+	if s.user != "" {
+		return ErrAlreadyAuthenticated
+	}
+	switch strings.ToLower(args[0]) {
+	case "user":
+	case "sasl":
+		return handleAuthInfoSASL(args, s, c)
+	default:
 		return ErrSyntax
 	}
 
-	if s.backend.Authorized() {
+	var auth Authenticator = s.backend
+	if s.server.Authenticator != nil {
+		auth = s.server.Authenticator
+	} else if s.backend.Authorized() {
 		return c.PrintfLine("250 authenticated")
 	}
 
+	rl := s.server.RateLimiter
+	var keys []string
+	if rl != nil {
+		keys = s.limitKeys(args[1])
+		if !rl.allowAuth(keys) {
+			s.server.count("ratelimit_auth")
+			c.PrintfLine(ErrAuthRateLimited.Error())
+			return io.EOF
+		}
+	}
+
 	c.PrintfLine("350 Continue")
 	a, err := c.ReadLine()
+	if err != nil {
+		return err
+	}
 	parts := strings.SplitN(a, " ", 3)
-	if strings.ToLower(parts[0]) != "authinfo" || strings.ToLower(parts[1]) != "pass" {
+	if len(parts) < 3 || strings.ToLower(parts[0]) != "authinfo" ||
+		strings.ToLower(parts[1]) != "pass" {
 		return ErrSyntax
 	}
-	b, err := s.backend.Authenticate(args[1], parts[2])
-	if err == nil {
-		c.PrintfLine("250 authenticated")
-		if b != nil {
-			s.backend = b
+	b, err := auth.Authenticate(args[1], parts[2])
+	if err != nil {
+		s.server.count("auth_failures")
+		if rl != nil {
+			rl.authFailed(keys)
 		}
+		return err
 	}
-	return err
+	c.PrintfLine("250 authenticated")
+	s.user = args[1]
+	if b != nil {
+		s.backend = b
+	}
+	return nil
 }
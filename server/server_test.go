@@ -1,8 +1,16 @@
 package nntpserver
 
 import (
+	"io"
+	"io/ioutil"
+	"log"
 	"math"
+	"net"
+	"net/textproto"
+	"strings"
 	"testing"
+
+	"github.com/dustin/go-nntp"
 )
 
 type rangeExpectation struct {
@@ -15,6 +23,7 @@ var rangeExpectations = []rangeExpectation{
 	rangeExpectation{"", 0, math.MaxInt64},
 	rangeExpectation{"73-", 73, math.MaxInt64},
 	rangeExpectation{"73-1845", 73, 1845},
+	rangeExpectation{"73", 73, 73},
 }
 
 func TestRangeEmpty(t *testing.T) {
@@ -30,3 +39,114 @@ func TestRangeEmpty(t *testing.T) {
 		}
 	}
 }
+
+type panickyBackend struct {
+	Backend
+}
+
+func (panickyBackend) GetGroup(name string) (*nntp.Group, error) {
+	panic("boom")
+}
+
+var discardLogger = log.New(ioutil.Discard, "", 0)
+
+// startSession runs s on one end of a pipe and returns a client
+// connection to it with the banner already read.  The returned channel
+// is closed when the session ends.
+func startSession(t *testing.T, s *Server) (*textproto.Conn, chan struct{}) {
+	if s.Logger == nil {
+		s.Logger = discardLogger
+	}
+	srv, cli := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.Process(srv)
+		close(done)
+	}()
+
+	c := textproto.NewConn(cli)
+	if _, _, err := c.ReadCodeLine(200); err != nil {
+		t.Fatalf("Error reading banner: %v", err)
+	}
+	return c, done
+}
+
+func TestPanicRecovery(t *testing.T) {
+	s := NewServer(panickyBackend{})
+	var hooked interface{}
+	s.PanicHook = func(remote net.Addr, v interface{}, stack []byte) {
+		hooked = v
+	}
+
+	c, done := startSession(t, s)
+	defer c.Close()
+	c.PrintfLine("GROUP misc.test")
+	if _, _, err := c.ReadCodeLine(403); err != nil {
+		t.Fatalf("Expected internal fault, got %v", err)
+	}
+	<-done
+	if hooked != "boom" {
+		t.Errorf("Panic hook got %v, wanted boom", hooked)
+	}
+	if v := s.Stats.Get("panics"); v == nil || v.String() != "1" {
+		t.Errorf("Expected one panic counted, got %v", v)
+	}
+}
+
+// lazyBackend accepts posts and IHAVE offers but reads only the first
+// few bytes of each article body.
+type lazyBackend struct {
+	Backend
+	err error
+}
+
+func (lazyBackend) AllowPost() bool { return true }
+
+func (lazyBackend) HasArticle(id string) (bool, error) { return false, nil }
+
+func (lazyBackend) GetArticle(group *nntp.Group, id string) (*nntp.Article, error) {
+	return nil, ErrInvalidMessageID
+}
+
+func (lb lazyBackend) Post(article *nntp.Article) error {
+	article.Body.Read(make([]byte, 4))
+	return lb.err
+}
+
+func TestPostDrainsBody(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		max  int64
+		err  error
+		code int
+	}{
+		{"POST", 0, nil, 240},
+		{"POST", 0, ErrPostingFailed, 441},
+		{"POST", 50, nil, 441},
+		{"IHAVE <a@b>", 0, nil, 235},
+		{"IHAVE <a@b>", 0, ErrPostingFailed, 437},
+		{"IHAVE <a@b>", 50, nil, 437},
+	}
+	for _, test := range tests {
+		s := NewServer(lazyBackend{err: test.err})
+		s.MaxArticleSize = test.max
+		c, _ := startSession(t, s)
+		c.PrintfLine(test.cmd)
+		if _, _, err := c.ReadCodeLine(3); err != nil {
+			t.Fatalf("%s: error starting transfer: %v", test.cmd, err)
+		}
+		dw := c.DotWriter()
+		io.WriteString(dw, "Subject: test\n\n"+strings.Repeat("body line\n", 20))
+		dw.Close()
+		if _, _, err := c.ReadCodeLine(test.code); err != nil {
+			t.Errorf("%s (max=%d, err=%v): %v",
+				test.cmd, test.max, test.err, err)
+		}
+		c.PrintfLine("QUIT")
+		if _, _, err := c.ReadCodeLine(205); err != nil {
+			t.Errorf("%s: session out of sync after article: %v",
+				test.cmd, err)
+		}
+		c.Close()
+	}
+}
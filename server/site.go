@@ -0,0 +1,166 @@
+package nntpserver
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+
+	"github.com/dustin/go-nntp"
+)
+
+// A Site is one of several news sites a Server serves, chosen for each
+// connection by the address it arrived at or, with TLS, the server name
+// the client asked for (SNI).  Fields left unset fall back to the
+// Server's.
+type Site struct {
+	// Names are the host names the site answers to over TLS.
+	Names []string
+	// Addrs are the local addresses the site answers on, as
+	// "ip:port", "ip" or ":port".
+	Addrs []string
+	// Backend provides the site's groups and articles.
+	Backend Backend
+	// Banner is sent after the status code in the greeting.
+	Banner string
+	// Certificate is presented to clients asking for one of Names.
+	// See Server.GetCertificate.
+	Certificate *tls.Certificate
+	// Injector completes articles posted to the site, e.g. with its
+	// own Path identity.
+	Injector *Injector
+	// History remembers the message IDs the site has seen.
+	History History
+	// Moderation holds posts to the site's moderated groups.
+	Moderation *Moderation
+	// AcceptHook is called with each article the site's backend has
+	// accepted.
+	AcceptHook func(article *nntp.Article)
+	// Disable lists capabilities, such as "POST", "IHAVE",
+	// "STREAMING", "OVER", "HDR" or "STARTTLS", the site doesn't
+	// offer.  Their commands are refused as unknown.
+	Disable []string
+}
+
+// The capability each command belongs to, for Site.Disable.
+var commandCapabilities = map[string]string{
+	"post":     "POST",
+	"ihave":    "IHAVE",
+	"check":    "STREAMING",
+	"takethis": "STREAMING",
+	"over":     "OVER",
+	"xover":    "OVER",
+	"hdr":      "HDR",
+	"xhdr":     "HDR",
+	"starttls": "STARTTLS",
+}
+
+func (site *Site) answersTo(name string) bool {
+	for _, n := range site.Names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (site *Site) answersOn(addr net.Addr) bool {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	for _, a := range site.Addrs {
+		h, p, err := net.SplitHostPort(a)
+		if err != nil {
+			h, p = a, ""
+		}
+		if (h == "" || net.ParseIP(h).Equal(net.ParseIP(host))) &&
+			(p == "" || p == port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (site *Site) disabled(capability string) bool {
+	for _, d := range site.Disable {
+		if strings.EqualFold(d, capability) {
+			return true
+		}
+	}
+	return false
+}
+
+// siteFor returns the first of the server's sites for which match is
+// true, or nil.
+func (s *Server) siteFor(match func(*Site) bool) *Site {
+	for _, site := range s.Sites {
+		if match(site) {
+			return site
+		}
+	}
+	return nil
+}
+
+// GetCertificate returns the certificate of the site a TLS client asked
+// for, or nil.  Set it as a tls.Config's GetCertificate to serve each
+// site with its own, falling back to the config's Certificates.
+func (s *Server) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	site := s.siteFor(func(site *Site) bool {
+		return site.Certificate != nil && site.answersTo(hello.ServerName)
+	})
+	if site == nil {
+		return nil, nil
+	}
+	return site.Certificate, nil
+}
+
+// setSite makes site the session's, if it isn't nil.
+func (s *session) setSite(site *Site) {
+	if site == nil {
+		return
+	}
+	s.site = site
+	if site.Backend != nil {
+		s.backend = site.Backend
+	}
+}
+
+func (s *session) banner() string {
+	if s.site != nil && s.site.Banner != "" {
+		return s.site.Banner
+	}
+	return "Hello!"
+}
+
+func (s *session) injector() *Injector {
+	if s.site != nil && s.site.Injector != nil {
+		return s.site.Injector
+	}
+	return s.server.Injector
+}
+
+func (s *session) history() History {
+	if s.site != nil && s.site.History != nil {
+		return s.site.History
+	}
+	return s.server.History
+}
+
+func (s *session) moderation() *Moderation {
+	if s.site != nil && s.site.Moderation != nil {
+		return s.site.Moderation
+	}
+	return s.server.Moderation
+}
+
+func (s *session) acceptHook() func(article *nntp.Article) {
+	if s.site != nil && s.site.AcceptHook != nil {
+		return s.site.AcceptHook
+	}
+	return s.server.AcceptHook
+}
+
+// offers reports whether the session's site offers a capability.
+func (s *session) offers(capability string) bool {
+	return s.site == nil || !s.site.disabled(capability)
+}
@@ -0,0 +1,165 @@
+package nntpserver
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-nntp"
+)
+
+// siteBackend has one group, named after its site, and records the
+// Path of each article posted to it.
+type siteBackend struct {
+	aclBackend
+	name  string
+	paths []string
+}
+
+func (sb *siteBackend) ListGroups(max int) ([]*nntp.Group, error) {
+	return []*nntp.Group{{Name: sb.name + ".general", Posting: nntp.PostingPermitted}}, nil
+}
+
+func (sb *siteBackend) Post(article *nntp.Article) error {
+	sb.paths = append(sb.paths, article.Header.Get("Path"))
+	return nil
+}
+
+func TestSiteAddrs(t *testing.T) {
+	site := &Site{Addrs: []string{"192.0.2.1:119", ":563", "2001:db8::1"}}
+	for _, test := range []struct {
+		addr string
+		exp  bool
+	}{
+		{"192.0.2.1:119", true},
+		{"192.0.2.1:433", false},
+		{"192.0.2.2:119", false},
+		{"192.0.2.2:563", true},
+		{"[2001:db8::1]:119", true},
+	} {
+		addr, _ := net.ResolveTCPAddr("tcp", test.addr)
+		if got := site.answersOn(addr); got != test.exp {
+			t.Errorf("answersOn(%v) = %v", test.addr, got)
+		}
+	}
+}
+
+func TestSites(t *testing.T) {
+	ts := newTLSSetup(t)
+	ca := makeCert(t, "Site CA", nil)
+	alphaCert := makeCert(t, "news.alpha.example", &ca)
+	alpha := &siteBackend{name: "alpha"}
+	beta := &siteBackend{name: "beta"}
+	s := NewServer(&siteBackend{name: "default"})
+	s.Logger = discardLogger
+	s.History = mapHistory{}
+	var accepted []string
+	s.AcceptHook = func(a *nntp.Article) { accepted = append(accepted, "default") }
+	s.Sites = []*Site{
+		{
+			Names:       []string{"news.alpha.example"},
+			Backend:     alpha,
+			Banner:      "Alpha News",
+			Certificate: &alphaCert,
+			Injector:    NewInjector("news.alpha.example"),
+			History:     mapHistory{"<seen@alpha>": time.Now()},
+			AcceptHook:  func(a *nntp.Article) { accepted = append(accepted, "alpha") },
+		},
+		{
+			Names:    []string{"News.Beta.Example"},
+			Backend:  beta,
+			Injector: NewInjector("news.beta.example"),
+			Disable:  []string{"OVER", "post"},
+		},
+	}
+	config := ts.server.Clone()
+	config.GetCertificate = s.GetCertificate
+
+	connect := func(name string) (*textproto.Conn, string) {
+		t.Helper()
+		srv, cli := net.Pipe()
+		go s.Process(tls.Server(srv, config))
+		client := ts.client.Clone()
+		client.ServerName = name
+		client.InsecureSkipVerify = true
+		tc := tls.Client(cli, client)
+		c := textproto.NewConn(tc)
+		_, banner, err := c.ReadCodeLine(200)
+		if err != nil {
+			t.Fatalf("%s: error reading banner: %v", name, err)
+		}
+		if cn := tc.ConnectionState().PeerCertificates[0].Subject.CommonName; name == "news.alpha.example" && cn != name {
+			t.Errorf("%s presented a certificate for %v", name, cn)
+		}
+		return c, banner
+	}
+	post := func(c *textproto.Conn, group string) {
+		t.Helper()
+		c.PrintfLine("POST")
+		if _, _, err := c.ReadCodeLine(340); err != nil {
+			t.Fatalf("POST: %v", err)
+		}
+		dw := c.DotWriter()
+		io.WriteString(dw, "From: a@example.com\nNewsgroups: "+group+
+			"\nSubject: test\n\nbody\n")
+		dw.Close()
+		if _, _, err := c.ReadCodeLine(240); err != nil {
+			t.Errorf("Post to %v: %v", group, err)
+		}
+	}
+
+	c, banner := connect("news.alpha.example")
+	if banner != "Alpha News" {
+		t.Errorf("Alpha banner = %q", banner)
+	}
+	if got := readLines(t, c, "LIST", 215); got != "alpha.general 0 0 y" {
+		t.Errorf("Alpha LIST = %q", got)
+	}
+	post(c, "alpha.general")
+	if len(alpha.paths) != 1 || !strings.HasPrefix(alpha.paths[0], "news.alpha.example!") {
+		t.Errorf("Alpha paths = %v", alpha.paths)
+	}
+	if len(accepted) != 1 || accepted[0] != "alpha" {
+		t.Errorf("Accept hooks called: %v", accepted)
+	}
+	c.PrintfLine("CHECK <seen@alpha>")
+	if _, _, err := c.ReadCodeLine(438); err != nil {
+		t.Errorf("Alpha CHECK: %v", err)
+	}
+	c.Close()
+
+	c, banner = connect("news.beta.example")
+	if banner != "Hello!" {
+		t.Errorf("Beta banner = %q", banner)
+	}
+	if got := readLines(t, c, "LIST", 215); got != "beta.general 0 0 y" {
+		t.Errorf("Beta LIST = %q", got)
+	}
+	if got := readLines(t, c, "CAPABILITIES", 101); strings.Contains(got, "|OVER|") ||
+		strings.Contains(got, "|POST|") || strings.Contains(got, "|XOVER|") ||
+		!strings.Contains(got, "|HDR|") {
+		t.Errorf("Beta CAPABILITIES = %q", got)
+	}
+	// Beta has the server's history, which hasn't seen alpha's article.
+	c.PrintfLine("CHECK <seen@alpha>")
+	if _, _, err := c.ReadCodeLine(238); err != nil {
+		t.Errorf("Beta CHECK: %v", err)
+	}
+	for _, cmd := range []string{"OVER", "XOVER 1-2", "POST"} {
+		c.PrintfLine(cmd)
+		if _, _, err := c.ReadCodeLine(500); err != nil {
+			t.Errorf("Beta %v: %v", cmd, err)
+		}
+	}
+	c.Close()
+
+	c, _ = connect("news.gamma.example")
+	if got := readLines(t, c, "LIST", 215); got != "default.general 0 0 y" {
+		t.Errorf("Default LIST = %q", got)
+	}
+	c.Close()
+}
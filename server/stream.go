@@ -0,0 +1,118 @@
+package nntpserver
+
+import (
+	"fmt"
+	"io"
+	"net/textproto"
+
+	"github.com/dustin/go-nntp"
+)
+
+// An ArticleStreamer is a Backend that can hand a group's articles to a
+// callback one at a time, instead of gathering them all first as
+// GetArticles does.  EachArticle calls f for each article numbered from
+// from to to, in order, and stops with f's error if it returns one.
+type ArticleStreamer interface {
+	EachArticle(group *nntp.Group, from, to int64, f func(NumberedArticle) error) error
+}
+
+// An OverviewStreamer is an OverviewBackend that can hand overview
+// records to a callback one at a time.  EachOverview calls f for each
+// record numbered from from to to, in order, and stops with f's error
+// if it returns one.
+type OverviewStreamer interface {
+	EachOverview(group *nntp.Group, from, to int64, f func(OverviewRecord) error) error
+}
+
+// eachOverview calls f with the overview record of each of the
+// selected group's articles numbered from from to to, using the
+// cheapest way the backend offers.
+func (s *session) eachOverview(from, to int64, f func(OverviewRecord) error) error {
+	switch b := s.backend.(type) {
+	case OverviewStreamer:
+		return b.EachOverview(s.group, from, to, f)
+	case OverviewBackend:
+		records, err := b.GetOverview(s.group, from, to)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			if err := f(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return s.eachArticle(from, to, func(a NumberedArticle) error {
+		return f(NewOverviewRecord(a.Num, a.Article))
+	})
+}
+
+// eachArticle calls f with each of the selected group's articles
+// numbered from from to to.
+func (s *session) eachArticle(from, to int64, f func(NumberedArticle) error) error {
+	if as, ok := s.backend.(ArticleStreamer); ok {
+		return as.EachArticle(s.group, from, to, f)
+	}
+	articles, err := s.backend.GetArticles(s.group, from, to)
+	if err != nil {
+		return err
+	}
+	for _, a := range articles {
+		if err := f(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A listing is a multi-line response written as its lines are found.
+// Its status line goes out with the first line, so an error found
+// before then can still be sent instead.
+type listing struct {
+	c      *textproto.Conn
+	status string
+	dw     io.WriteCloser
+	// The number of lines written.
+	n int
+}
+
+func (l *listing) start() error {
+	if l.dw != nil {
+		return nil
+	}
+	if err := l.c.PrintfLine("%s", l.status); err != nil {
+		return err
+	}
+	l.dw = l.c.DotWriter()
+	return nil
+}
+
+// Printf writes a line.  It fails once the client has gone.
+func (l *listing) Printf(format string, args ...interface{}) error {
+	if err := l.start(); err != nil {
+		return err
+	}
+	l.n++
+	_, err := fmt.Fprintf(l.dw, format, args...)
+	return err
+}
+
+// finish ends the response, given the error the listing stopped with.
+// Once lines have been sent an error can't be reported to the client,
+// so it ends the session instead.
+func (l *listing) finish(err error) error {
+	if err != nil {
+		if l.dw == nil {
+			return err
+		}
+		if _, ok := err.(*NNTPError); ok {
+			return fmt.Errorf("listing interrupted: %v", err)
+		}
+		return err
+	}
+	if err := l.start(); err != nil {
+		return err
+	}
+	return l.dw.Close()
+}
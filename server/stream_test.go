@@ -0,0 +1,92 @@
+package nntpserver
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-nntp"
+)
+
+// streamBackend has an effectively endless group, and counts the
+// records it is asked for.
+type streamBackend struct {
+	overBackend
+	sent chan int64
+	// fail, if set, is returned in place of the record numbered 3.
+	fail error
+}
+
+func (sb *streamBackend) GetGroup(name string) (*nntp.Group, error) {
+	return &nntp.Group{Name: name, Count: math.MaxInt32, Low: 1, High: math.MaxInt32}, nil
+}
+
+func (sb *streamBackend) EachOverview(g *nntp.Group, from, to int64, f func(OverviewRecord) error) error {
+	for n := from; n <= to; n++ {
+		if n == 3 && sb.fail != nil {
+			return sb.fail
+		}
+		if err := f(OverviewRecord{Num: n, Subject: "streamed"}); err != nil {
+			close(sb.sent)
+			return err
+		}
+		sb.sent <- n
+	}
+	close(sb.sent)
+	return nil
+}
+
+func TestStreamingStopsOnDisconnect(t *testing.T) {
+	b := &streamBackend{sent: make(chan int64, 1<<16)}
+	c, done := startSession(t, NewServer(b))
+	c.PrintfLine("GROUP misc.test")
+	c.ReadCodeLine(211)
+	c.PrintfLine("OVER 1-")
+	if _, _, err := c.ReadCodeLine(224); err != nil {
+		t.Fatalf("Error starting OVER: %v", err)
+	}
+	c.ReadLine()
+	c.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Session kept streaming after the client left")
+	}
+	var last int64
+	for n := range b.sent {
+		last = n
+	}
+	if last == 0 || last > 1<<16 {
+		t.Errorf("Streamed %d records", last)
+	}
+	if b.loaded() != 0 {
+		t.Errorf("Loaded articles %d times", b.loaded())
+	}
+}
+
+func TestStreamingErrors(t *testing.T) {
+	b := &streamBackend{sent: make(chan int64, 10), fail: ErrNoSuchGroup}
+	c, done := startSession(t, NewServer(b))
+	defer c.Close()
+	c.PrintfLine("GROUP misc.test")
+	c.ReadCodeLine(211)
+
+	// An error before any record is sent is reported as usual.
+	c.PrintfLine("OVER 3-5")
+	if _, _, err := c.ReadCodeLine(411); err != nil {
+		t.Errorf("Expected the error reported, got %v", err)
+	}
+
+	// Once records have gone out it can't be, so the session ends.
+	c.PrintfLine("OVER 1-5")
+	c.ReadCodeLine(224)
+	if _, err := c.ReadDotLines(); err == nil {
+		t.Errorf("Expected an unterminated response")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Session continued after a failed response")
+	}
+}
@@ -0,0 +1,167 @@
+package nntpserver
+
+import (
+	"errors"
+	"net/mail"
+	"net/textproto"
+	"time"
+
+	"github.com/dustin/go-nntp"
+)
+
+// A History remembers the message IDs of articles the server has
+// accepted or refused, so that IHAVE, CHECK and TAKETHIS can turn them
+// down without asking the backend, even after the articles are gone.
+// The history package provides an on-disk implementation.
+type History interface {
+	// Seen reports whether a message ID has been recorded.
+	Seen(id string) bool
+	// Add records a message ID, its article's arrival time and, if
+	// known, when the article expires.
+	Add(id string, arrived, expires time.Time) error
+}
+
+// An ArticleChecker is a Backend that can tell whether it has an
+// article by message ID alone.  Without a History, IHAVE, CHECK and
+// TAKETHIS ask it whether they already have the articles offered.
+type ArticleChecker interface {
+	// HasArticle reports whether the backend has the article with the
+	// given message ID.  An error means it can't tell.
+	HasArticle(id string) (bool, error)
+}
+
+// errCantCheck is returned when there's no way to tell whether an
+// article offered by a peer is a duplicate.
+var errCantCheck = errors.New("no history, and the backend can't look up message IDs")
+
+// seen reports whether the server already has, or has refused, the
+// article with the given message ID.  Articles are only taken if it
+// returns no error.
+func (s *session) seen(id string) (bool, error) {
+	if h := s.history(); h != nil {
+		return h.Seen(id), nil
+	}
+	if ac, ok := s.backend.(ArticleChecker); ok {
+		return ac.HasArticle(id)
+	}
+	return false, errCantCheck
+}
+
+// offerable reports whether an offered article may be sent, logging
+// why not if it can't tell.
+func (s *session) offerable(id string) (seen, ok bool) {
+	seen, err := s.seen(id)
+	if err != nil {
+		s.server.logf("Can't check for %s: %v", id, err)
+		return false, false
+	}
+	return seen, true
+}
+
+// remember records the outcome of a transfer in the history.  Accepted
+// and permanently refused articles are recorded; ones that may be tried
+// again are not.
+func (s *session) remember(id string, article *nntp.Article, err error) {
+	h := s.history()
+	if h == nil {
+		return
+	}
+	if e, ok := err.(*NNTPError); err != nil && (!ok || e.Code == 436 || e.Code == 431) {
+		return
+	}
+	var expires time.Time
+	if article != nil {
+		expires, _ = mail.ParseDate(article.Header.Get("Expires"))
+	}
+	if err := h.Add(id, time.Now(), expires); err != nil {
+		s.server.logf("Error adding %s to history: %v", id, err)
+	}
+}
+
+// accepted passes an article the backend took to the AcceptHook.
+func (s *session) accepted(article *nntp.Article) {
+	if hook := s.acceptHook(); hook != nil {
+		hook(article)
+	}
+}
+
+/*
+   Syntax
+     CHECK message-id
+
+   Responses
+     238 message-id   Send article to be transferred
+     431 message-id   Transfer not possible; try again later
+     438 message-id   Article not wanted
+*/
+
+func handleCheck(args []string, s *session, c *textproto.Conn) error {
+	if len(args) < 1 {
+		return ErrSyntax
+	}
+	id := args[0]
+	if !s.backend.AllowPost() {
+		return c.PrintfLine("431 %s", id)
+	}
+	switch seen, ok := s.offerable(id); {
+	case !ok:
+		return c.PrintfLine("431 %s", id)
+	case seen:
+		return c.PrintfLine("438 %s", id)
+	}
+	return c.PrintfLine("238 %s", id)
+}
+
+/*
+   Syntax
+     TAKETHIS message-id
+
+   Responses
+     239 message-id   Article transferred OK
+     431 message-id   Transfer not possible; try again later
+     439 message-id   Transfer rejected; do not retry
+*/
+
+func handleTakeThis(args []string, s *session, c *textproto.Conn) error {
+	if len(args) < 1 {
+		return ErrSyntax
+	}
+	id := args[0]
+
+	// The article follows whether we want it or not.
+	article, ar, err := s.readArticle(c)
+	seen, ok := false, false
+	if err == nil && s.backend.AllowPost() {
+		seen, ok = s.offerable(id)
+	}
+	switch {
+	case err != nil:
+		err = ErrTransferRejected
+	case !ok:
+		// As with CHECK, an article that can't be checked now may
+		// be offered again later.
+		err = ErrTransferFailed
+	case seen:
+		err = ErrNotWanted
+	default:
+		if err = s.filter("TAKETHIS", article); err == nil {
+			err = s.post(article)
+		}
+	}
+	if err = ar.finish(err); err != nil {
+		if _, ok := err.(*NNTPError); !ok {
+			return err
+		}
+		if err != ErrNotWanted {
+			// Deferred articles may be offered again.
+			s.remember(id, article, ihaveError(err))
+		}
+		if err.(*NNTPError).Code == ErrTransferFailed.Code {
+			return c.PrintfLine("431 %s", id)
+		}
+		return c.PrintfLine("439 %s", id)
+	}
+	s.remember(id, article, nil)
+	s.accepted(article)
+	return c.PrintfLine("239 %s", id)
+}
@@ -0,0 +1,93 @@
+package nntpserver
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+type mapHistory map[string]time.Time
+
+func (h mapHistory) Seen(id string) bool {
+	_, ok := h[id]
+	return ok
+}
+
+func (h mapHistory) Add(id string, arrived, expires time.Time) error {
+	h[id] = arrived
+	return nil
+}
+
+func TestStreaming(t *testing.T) {
+	h := mapHistory{"<old@example.com>": time.Now()}
+	s := NewServer(lazyBackend{})
+	s.History = h
+	c, _ := startSession(t, s)
+	defer c.Close()
+
+	c.PrintfLine("MODE STREAM")
+	if _, _, err := c.ReadCodeLine(203); err != nil {
+		t.Fatalf("Error entering streaming mode: %v", err)
+	}
+
+	c.PrintfLine("CHECK <old@example.com>")
+	if _, msg, err := c.ReadCodeLine(438); err != nil || msg != "<old@example.com>" {
+		t.Fatalf("Expected old article unwanted, got %v %v", msg, err)
+	}
+	c.PrintfLine("CHECK <new@example.com>")
+	if _, _, err := c.ReadCodeLine(238); err != nil {
+		t.Fatalf("Expected new article wanted, got %v", err)
+	}
+
+	for _, test := range []struct {
+		id   string
+		code int
+	}{
+		{"<new@example.com>", 239},
+		{"<old@example.com>", 439},
+	} {
+		// net.Pipe is unbuffered, so unlike a real peer we can't
+		// send the next article before reading this response.
+		c.PrintfLine("TAKETHIS %s", test.id)
+		dw := c.DotWriter()
+		io.WriteString(dw, "Message-ID: "+test.id+"\n\nbody\n")
+		dw.Close()
+		if _, msg, err := c.ReadCodeLine(test.code); err != nil || msg != test.id {
+			t.Fatalf("TAKETHIS %s: got %v %v", test.id, msg, err)
+		}
+	}
+	if !h.Seen("<new@example.com>") {
+		t.Errorf("New article not recorded in history")
+	}
+
+	c.PrintfLine("IHAVE <new@example.com>")
+	if _, _, err := c.ReadCodeLine(435); err != nil {
+		t.Fatalf("Expected IHAVE of a taken article refused, got %v", err)
+	}
+}
+
+// uncheckedBackend can't look up articles by message ID.
+type uncheckedBackend struct {
+	Backend
+}
+
+func TestStreamingWithoutHistory(t *testing.T) {
+	c, _ := startSession(t, NewServer(uncheckedBackend{lazyBackend{}}))
+	defer c.Close()
+
+	c.PrintfLine("CHECK <new@example.com>")
+	if _, _, err := c.ReadCodeLine(431); err != nil {
+		t.Errorf("CHECK without a history: %v", err)
+	}
+	c.PrintfLine("IHAVE <new@example.com>")
+	if _, _, err := c.ReadCodeLine(436); err != nil {
+		t.Errorf("IHAVE without a history: %v", err)
+	}
+	c.PrintfLine("TAKETHIS <new@example.com>")
+	dw := c.DotWriter()
+	io.WriteString(dw, "Message-ID: <new@example.com>\n\nbody\n")
+	dw.Close()
+	if _, _, err := c.ReadCodeLine(431); err != nil {
+		t.Errorf("TAKETHIS without a history: %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package nntpserver
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// ErrTLSActive is returned for STARTTLS on a connection that's already
+// encrypted, or once the client has authenticated.
+var ErrTLSActive = &NNTPError{502, "Command unavailable"}
+
+// ErrTLSUnavailable is returned for STARTTLS when the server has no
+// TLS configuration.
+var ErrTLSUnavailable = &NNTPError{580, "Can not initiate TLS negotiation"}
+
+// ErrSASLMechanism is returned for AUTHINFO SASL with a mechanism the
+// server doesn't offer.
+var ErrSASLMechanism = &NNTPError{503, "Mechanism not recognized"}
+
+// ErrSASLFailed is returned when AUTHINFO SASL fails or is cancelled.
+var ErrSASLFailed = &NNTPError{481, "Authentication failed"}
+
+// A CertAuthenticator authenticates clients by their TLS certificates.
+type CertAuthenticator interface {
+	// AuthenticateCert is called with a client's certificate once the
+	// TLS configuration has verified it.  Like Backend.Authenticate,
+	// it may return a Backend for the session to switch to, or nil to
+	// keep the current one; the switch happens when the client
+	// authenticates with AUTHINFO SASL EXTERNAL.  An error leaves
+	// EXTERNAL unavailable; ErrAuthRejected means the certificate
+	// isn't known, and isn't logged.
+	AuthenticateCert(cert *x509.Certificate) (user string, b Backend, err error)
+}
+
+// CertIdentities returns the names a certificate can be known by, most
+// specific first:
+//
+//	sha256:<hex SHA-256 fingerprint of the certificate>
+//	email:<each email address in its subject alternative names>
+//	dns:<each DNS name in its subject alternative names>
+//	cn:<its subject's common name>
+func CertIdentities(cert *x509.Certificate) []string {
+	sum := sha256.Sum256(cert.Raw)
+	ids := []string{"sha256:" + hex.EncodeToString(sum[:])}
+	for _, e := range cert.EmailAddresses {
+		ids = append(ids, "email:"+e)
+	}
+	for _, d := range cert.DNSNames {
+		ids = append(ids, "dns:"+d)
+	}
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, "cn:"+cert.Subject.CommonName)
+	}
+	return ids
+}
+
+// CertUsers maps certificate identities, as returned by CertIdentities,
+// to user names.  Sessions authenticated by it keep their Backend.
+type CertUsers map[string]string
+
+// AuthenticateCert implements CertAuthenticator, using the first of the
+// certificate's identities found in the map.
+func (m CertUsers) AuthenticateCert(cert *x509.Certificate) (string, Backend, error) {
+	for _, id := range CertIdentities(cert) {
+		if user, ok := m[id]; ok {
+			return user, nil, nil
+		}
+	}
+	return "", nil, ErrAuthRejected
+}
+
+// DefaultHandshakeTimeout is how long a TLS handshake may take when
+// the Server's HandshakeTimeout isn't set.
+const DefaultHandshakeTimeout = 30 * time.Second
+
+// startTLS completes the handshake on tc and makes it the session's
+// connection.  The session switches to the site the client asked for,
+// if the server has it, and looks up the client's certificate, if any.
+func (s *session) startTLS(tc *tls.Conn) error {
+	timeout := s.server.HandshakeTimeout
+	if timeout == 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	// Connections that can't have deadlines get none.
+	tc.SetDeadline(time.Now().Add(timeout))
+	err := tc.Handshake()
+	tc.SetDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	s.nc, s.conn, s.tls = tc, textproto.NewConn(tc), true
+	state := tc.ConnectionState()
+	if state.ServerName != "" {
+		s.setSite(s.server.siteFor(func(site *Site) bool {
+			return site.answersTo(state.ServerName)
+		}))
+	}
+	s.authenticateCert(state)
+	return nil
+}
+
+// authenticateCert looks up the user its client's certificate maps to,
+// which AUTHINFO SASL EXTERNAL then authenticates the session as.
+// Certificates the TLS configuration didn't verify are ignored.
+func (s *session) authenticateCert(state tls.ConnectionState) {
+	if s.server.CertAuth == nil || len(state.VerifiedChains) == 0 {
+		return
+	}
+	cert := state.VerifiedChains[0][0]
+	user, b, err := s.server.CertAuth.AuthenticateCert(cert)
+	if err != nil {
+		if err != ErrAuthRejected {
+			s.server.logf("Error authenticating certificate %q from %v: %v",
+				cert.Subject, s.remote, err)
+		}
+		s.server.count("cert_auth_failures")
+		return
+	}
+	s.certUser, s.certBackend = user, b
+}
+
+func handleStartTLS(args []string, s *session, c *textproto.Conn) error {
+	if s.tls || s.user != "" {
+		return ErrTLSActive
+	}
+	if s.server.TLSConfig == nil {
+		return ErrTLSUnavailable
+	}
+	// Anything the client sent after STARTTLS would be read as if it
+	// had come over TLS.
+	if c.R.Buffered() > 0 {
+		return errors.New("client pipelined commands after STARTTLS")
+	}
+	c.PrintfLine("382 Continue with TLS negotiation")
+	// Nothing from before the upgrade is trusted (RFC 4642, 2.2.2).
+	s.group = nil
+	return s.startTLS(tls.Server(s.nc, s.server.TLSConfig))
+}
+
+// handleAuthInfoSASL handles AUTHINFO SASL.  Only EXTERNAL is offered,
+// to clients whose certificates map to a user, so all it does is
+// confirm the identity (RFC 4422, appendix A) and authenticate the
+// session as that user.
+func handleAuthInfoSASL(args []string, s *session, c *textproto.Conn) error {
+	if !strings.EqualFold(args[1], "EXTERNAL") || s.certUser == "" {
+		return ErrSASLMechanism
+	}
+	var resp string
+	if len(args) > 2 {
+		resp = args[2]
+	} else {
+		c.PrintfLine("383 =")
+		l, err := c.ReadLine()
+		if err != nil {
+			return err
+		}
+		resp = l
+	}
+	if resp == "*" {
+		return ErrSASLFailed
+	}
+	// The response is the identity to act as, or "=" for the
+	// certificate's own.
+	if resp != "=" {
+		authzid, err := base64.StdEncoding.DecodeString(resp)
+		if err != nil {
+			return ErrSASLFailed
+		}
+		if len(authzid) > 0 && string(authzid) != s.certUser {
+			s.server.count("auth_failures")
+			return ErrSASLFailed
+		}
+	}
+	s.user = s.certUser
+	if s.certBackend != nil {
+		s.backend = s.certBackend
+	}
+	return c.PrintfLine("281 Authentication accepted")
+}
@@ -0,0 +1,207 @@
+package nntpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeCert returns a certificate for name signed by parent, or
+// self-signed if parent is nil.
+func makeCert(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+type tlsSetup struct {
+	server, client *tls.Config
+	peer           *x509.Certificate
+}
+
+func newTLSSetup(t *testing.T) *tlsSetup {
+	ca := makeCert(t, "Test CA", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	srv := makeCert(t, "news.example.com", &ca)
+	peer := makeCert(t, "peer.example.net", &ca)
+	return &tlsSetup{
+		server: &tls.Config{
+			Certificates: []tls.Certificate{srv},
+			ClientCAs:    pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		},
+		client: &tls.Config{
+			Certificates: []tls.Certificate{peer},
+			RootCAs:      pool,
+			ServerName:   "news.example.com",
+		},
+		peer: peer.Leaf,
+	}
+}
+
+// peerBackend is what sessions authenticated as "peer" switch to.
+type peerBackend struct {
+	authBackend
+}
+
+func (peerBackend) Authorized() bool { return true }
+
+type testCertAuth struct{}
+
+func (testCertAuth) AuthenticateCert(cert *x509.Certificate) (string, Backend, error) {
+	user, _, err := CertUsers{"dns:peer.example.net": "peer"}.AuthenticateCert(cert)
+	return user, peerBackend{}, err
+}
+
+func TestCertIdentities(t *testing.T) {
+	ts := newTLSSetup(t)
+	ids := CertIdentities(ts.peer)
+	if len(ids) != 3 || !strings.HasPrefix(ids[0], "sha256:") ||
+		ids[1] != "dns:peer.example.net" || ids[2] != "cn:peer.example.net" {
+		t.Errorf("Got identities %v", ids)
+	}
+	if user, _, err := (CertUsers{ids[0]: "fp"}).AuthenticateCert(ts.peer); user != "fp" || err != nil {
+		t.Errorf("Fingerprint lookup = %q, %v", user, err)
+	}
+	if _, _, err := (CertUsers{"cn:other": "x"}).AuthenticateCert(ts.peer); err != ErrAuthRejected {
+		t.Errorf("Expected unknown certificate rejected, got %v", err)
+	}
+}
+
+func TestImplicitTLS(t *testing.T) {
+	ts := newTLSSetup(t)
+	s := NewServer(authBackend{})
+	s.Logger = discardLogger
+	s.CertAuth = testCertAuth{}
+	srv, cli := net.Pipe()
+	go s.Process(tls.Server(srv, ts.server))
+
+	c := textproto.NewConn(tls.Client(cli, ts.client))
+	defer c.Close()
+	if _, _, err := c.ReadCodeLine(200); err != nil {
+		t.Fatalf("Error reading banner: %v", err)
+	}
+	got := readLines(t, c, "CAPABILITIES", 101)
+	// The certificate alone doesn't authenticate the session.
+	if !strings.Contains(got, "|AUTHINFO USER SASL|SASL EXTERNAL") || strings.Contains(got, "STARTTLS") {
+		t.Errorf("CAPABILITIES = %q", got)
+	}
+	c.PrintfLine("AUTHINFO SASL EXTERNAL")
+	c.ReadCodeLine(383)
+	c.PrintfLine("b3RoZXI=")
+	if _, _, err := c.ReadCodeLine(481); err != nil {
+		t.Errorf("SASL EXTERNAL as other: %v", err)
+	}
+	c.PrintfLine("AUTHINFO SASL EXTERNAL cGVlcg==")
+	if _, _, err := c.ReadCodeLine(281); err != nil {
+		t.Errorf("SASL EXTERNAL as peer: %v", err)
+	}
+	if got := readLines(t, c, "CAPABILITIES", 101); strings.Contains(got, "AUTHINFO") ||
+		strings.Contains(got, "SASL") {
+		t.Errorf("CAPABILITIES after SASL EXTERNAL = %q", got)
+	}
+	// The session switched to peerBackend, and can't authenticate again.
+	c.PrintfLine("AUTHINFO USER anyone")
+	if _, _, err := c.ReadCodeLine(502); err != nil {
+		t.Errorf("AUTHINFO USER: %v", err)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	ts := newTLSSetup(t)
+	s := NewServer(authBackend{})
+	s.Logger = discardLogger
+	s.HandshakeTimeout = 10 * time.Millisecond
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	done := make(chan struct{})
+	go func() {
+		s.Process(tls.Server(srv, ts.server))
+		close(done)
+	}()
+	// The client never sends its hello.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Session still waiting for a handshake")
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	ts := newTLSSetup(t)
+	s := NewServer(authBackend{})
+	s.Logger = discardLogger
+	s.CertAuth = testCertAuth{}
+
+	// Without a TLS configuration there's no STARTTLS.
+	c, _ := startSession(t, s)
+	c.PrintfLine("STARTTLS")
+	if _, _, err := c.ReadCodeLine(580); err != nil {
+		t.Errorf("STARTTLS without config: %v", err)
+	}
+	c.Close()
+
+	s.TLSConfig = ts.server
+	srv, cli := net.Pipe()
+	go s.Process(srv)
+	c = textproto.NewConn(cli)
+	c.ReadCodeLine(200)
+	if got := readLines(t, c, "CAPABILITIES", 101); !strings.HasSuffix(got, "|STARTTLS|AUTHINFO USER") {
+		t.Errorf("CAPABILITIES = %q", got)
+	}
+	c.PrintfLine("AUTHINFO SASL EXTERNAL =")
+	if _, _, err := c.ReadCodeLine(503); err != nil {
+		t.Errorf("SASL EXTERNAL before TLS: %v", err)
+	}
+	c.PrintfLine("STARTTLS")
+	if _, _, err := c.ReadCodeLine(382); err != nil {
+		t.Fatalf("STARTTLS: %v", err)
+	}
+	c = textproto.NewConn(tls.Client(cli, ts.client))
+	defer c.Close()
+	if got := readLines(t, c, "CAPABILITIES", 101); strings.Contains(got, "STARTTLS") ||
+		!strings.Contains(got, "|AUTHINFO USER SASL|SASL EXTERNAL") {
+		t.Errorf("CAPABILITIES after STARTTLS = %q", got)
+	}
+	c.PrintfLine("AUTHINFO SASL EXTERNAL =")
+	if _, _, err := c.ReadCodeLine(281); err != nil {
+		t.Errorf("SASL EXTERNAL: %v", err)
+	}
+	c.PrintfLine("STARTTLS")
+	if _, _, err := c.ReadCodeLine(502); err != nil {
+		t.Errorf("Second STARTTLS: %v", err)
+	}
+}
@@ -0,0 +1,855 @@
+// Package spool provides an nntpserver.Backend storing articles on
+// local disk, with no other dependencies.
+//
+// A spool directory holds:
+//
+//	active              the groups, one per line: name, posting status
+//	                    and description
+//	articles/xx/<hash>  one file per article, named by a SHA-1 hash of
+//	                    its message ID; a crossposted article is stored
+//	                    once
+//	groups/<name>       each group's index, a log of the articles added
+//	                    to and removed from it
+//	overview/           the overview index, see the overview package
+//	tmp/                files being written
+//
+// Writes are ordered so a crash can't leave an index pointing at an
+// article that isn't there: an article's file is synced and renamed
+// into place before its index entries are appended and synced.  A crash
+// in between leaves an unreferenced file, which Compact removes along
+// with the index entries of removed articles.  The message-ID index is
+// built in memory from the group indexes when the spool is opened.
+//
+// Readers don't wait for writers to sync: writes are serialized among
+// themselves, and hold the lock readers share only while publishing
+// their result.
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-nntp"
+	"github.com/dustin/go-nntp/overview"
+	"github.com/dustin/go-nntp/server"
+)
+
+type meta struct {
+	// The number of groups the article is in.
+	refs  int
+	bytes int
+	lines int
+}
+
+type group struct {
+	info nntp.Group
+	// Article numbers in ascending order, and their message IDs.
+	nums []int64
+	ids  map[int64]string
+	// The index file, open for appending, and how many of its
+	// entries Compact could drop.
+	idx  *os.File
+	dead int
+}
+
+// A Spool is an on-disk Backend.  It is safe for concurrent use.
+//
+// Besides Backend, a Spool implements nntpserver.OverviewBackend,
+// OverviewStreamer, ArticleStreamer, ArticleChecker, ArticleDeleter,
+// GroupCreator, GroupRemover and ArticleExpirer.
+type Spool struct {
+	// Logger receives the Spool's log output.  If nil, the log
+	// package's standard logger is used.
+	Logger *log.Logger
+
+	dir string
+	// wmu serializes writers, which may read the indexes without mu.
+	wmu      sync.Mutex
+	mu       sync.RWMutex
+	groups   map[string]*group
+	articles map[string]*meta
+	numberer *nntpserver.Numberer
+	overview *overview.Index
+}
+
+// Open loads the spool in dir, creating it if needed.  Articles are
+// numbered with Xref headers naming pathIdentity.
+func Open(dir, pathIdentity string) (*Spool, error) {
+	for _, d := range []string{"articles", "groups", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	// Anything left in tmp was being written when we stopped.
+	if tmps, err := ioutil.ReadDir(filepath.Join(dir, "tmp")); err == nil {
+		for _, fi := range tmps {
+			os.Remove(filepath.Join(dir, "tmp", fi.Name()))
+		}
+	}
+
+	s := &Spool{
+		dir:      dir,
+		groups:   map[string]*group{},
+		articles: map[string]*meta{},
+		numberer: nntpserver.NewNumberer(pathIdentity),
+	}
+	groups, err := s.readActive()
+	if err != nil {
+		return nil, err
+	}
+	if s.overview, err = overview.Open(filepath.Join(dir, "overview")); err != nil {
+		return nil, err
+	}
+	for _, info := range groups {
+		if err := s.loadGroup(info); err != nil {
+			s.Close()
+			return nil, err
+		}
+		if err := s.checkOverview(info.Name); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// checkOverview rebuilds a group's overview if it doesn't match the
+// group's index, as after a crash.
+func (s *Spool) checkOverview(name string) error {
+	g := s.groups[name]
+	if s.overview.Len(name) == len(g.nums) {
+		return nil
+	}
+	s.logf("Rebuilding overview of %s", name)
+	if err := s.overview.RemoveGroup(name); err != nil {
+		return err
+	}
+	for _, num := range g.nums {
+		a, err := s.readArticle(g.ids[num])
+		if err != nil {
+			return err
+		}
+		if err := s.overview.Put(name, nntpserver.NewOverviewRecord(num, a)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the group indexes.
+func (s *Spool) Close() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	var rv error
+	for _, g := range s.groups {
+		if err := g.idx.Close(); err != nil && rv == nil {
+			rv = err
+		}
+	}
+	if err := s.overview.Close(); err != nil && rv == nil {
+		rv = err
+	}
+	return rv
+}
+
+func (s *Spool) logf(format string, args ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func (s *Spool) articlePath(id string) string {
+	sum := sha1.Sum([]byte(id))
+	h := hex.EncodeToString(sum[:])
+	return filepath.Join(s.dir, "articles", h[:2], h)
+}
+
+func (s *Spool) indexPath(name string) string {
+	return filepath.Join(s.dir, "groups", name)
+}
+
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeFile atomically replaces path with the output of write, synced
+// to disk.
+func (s *Spool) writeFile(path string, write func(w io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Join(s.dir, "tmp"), "write")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func (s *Spool) readActive() ([]nntp.Group, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, "active"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rv := []nntp.Group{}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) < 2 || len(parts[1]) != 1 {
+			continue
+		}
+		g := nntp.Group{Name: parts[0], Posting: nntp.PostingStatus(parts[1][0])}
+		if len(parts) == 3 {
+			g.Description = parts[2]
+		}
+		rv = append(rv, g)
+	}
+	return rv, nil
+}
+
+// writeActive saves the list of groups.  The caller must hold s.wmu.
+func (s *Spool) writeActive() error {
+	names := make([]string, 0, len(s.groups))
+	for name := range s.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return s.writeFile(filepath.Join(s.dir, "active"), func(w io.Writer) error {
+		for _, name := range names {
+			g := s.groups[name].info
+			if _, err := fmt.Fprintf(w, "%s %c %s\n", g.Name, g.Posting, g.Description); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// loadGroup replays a group's index.  A line torn by a crash at the end
+// of the index is cut off.
+func (s *Spool) loadGroup(info nntp.Group) error {
+	f, err := os.OpenFile(s.indexPath(info.Name), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	g := &group{info: info, ids: map[int64]string{}, idx: f}
+	sizes := map[int64][2]int{}
+
+	var high, good int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		good += int64(len(line))
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		num, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if num > high {
+			high = num
+		}
+		switch {
+		case fields[0] == "+" && len(fields) == 5:
+			b, _ := strconv.Atoi(fields[3])
+			l, _ := strconv.Atoi(fields[4])
+			g.ids[num] = fields[2]
+			sizes[num] = [2]int{b, l}
+		case fields[0] == "-":
+			delete(g.ids, num)
+			g.dead += 2
+		}
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	for num, id := range g.ids {
+		g.nums = append(g.nums, num)
+		m := s.articles[id]
+		if m == nil {
+			m = &meta{bytes: sizes[num][0], lines: sizes[num][1]}
+			s.articles[id] = m
+		}
+		m.refs++
+	}
+	sort.Slice(g.nums, func(i, j int) bool { return g.nums[i] < g.nums[j] })
+	s.numberer.Seed(info.Name, high)
+	g.update(s.numberer.High(info.Name))
+	s.groups[info.Name] = g
+	return nil
+}
+
+// update recomputes a group's counters.  An empty group's low water
+// mark is one more than its high water mark, as RFC 3977 suggests.
+func (g *group) update(high int64) {
+	g.info.High = high
+	g.info.Count = int64(len(g.nums))
+	if len(g.nums) > 0 {
+		g.info.Low = g.nums[0]
+	} else {
+		g.info.Low = high + 1
+	}
+}
+
+// appendIndex appends lines to a group's index and syncs it.  The
+// caller must hold s.wmu.
+func (g *group) appendIndex(lines string) error {
+	if _, err := io.WriteString(g.idx, lines); err != nil {
+		return err
+	}
+	return g.idx.Sync()
+}
+
+// CreateGroup adds a group, or updates the description and posting
+// status of an existing one.  Its article counters are ignored.
+func (s *Spool) CreateGroup(info *nntp.Group) error {
+	if info.Name == "" || strings.ContainsAny(info.Name, "/\\ \t\n") || info.Name[0] == '.' {
+		return fmt.Errorf("invalid group name %q", info.Name)
+	}
+	posting := info.Posting
+	if posting == nntp.Unknown {
+		posting = nntp.PostingPermitted
+	}
+	desc := strings.Replace(info.Description, "\n", " ", -1)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if g, ok := s.groups[info.Name]; ok {
+		s.mu.Lock()
+		g.info.Description, g.info.Posting = desc, posting
+		s.mu.Unlock()
+		return s.writeActive()
+	}
+
+	f, err := os.OpenFile(s.indexPath(info.Name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	g := &group{
+		info: nntp.Group{Name: info.Name, Description: desc, Posting: posting},
+		ids:  map[int64]string{},
+		idx:  f,
+	}
+	// A group that comes back keeps counting from where it was.
+	if high := s.numberer.High(info.Name); high > 0 {
+		if err := g.appendIndex(fmt.Sprintf("= %d\n", high)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	g.update(s.numberer.High(info.Name))
+	s.mu.Lock()
+	s.groups[info.Name] = g
+	s.mu.Unlock()
+	if err := s.writeActive(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Join(s.dir, "groups"))
+}
+
+// RemoveGroup removes a group and the articles only it held.
+func (s *Spool) RemoveGroup(name string) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	g, ok := s.groups[name]
+	if !ok {
+		return nntpserver.ErrNoSuchGroup
+	}
+	s.mu.Lock()
+	delete(s.groups, name)
+	gone := s.release(g, g.nums)
+	s.mu.Unlock()
+
+	if err := s.writeActive(); err != nil {
+		return err
+	}
+	g.idx.Close()
+	if err := os.Remove(s.indexPath(name)); err != nil {
+		return err
+	}
+	s.removeFiles(gone)
+	return s.overview.RemoveGroup(name)
+}
+
+// release takes the given numbers out of a group and returns the
+// message IDs of articles no group holds any more.  The caller must
+// hold s.mu for writing.
+func (s *Spool) release(g *group, nums []int64) []string {
+	gone := []string{}
+	drop := make(map[int64]bool, len(nums))
+	for _, num := range nums {
+		id, ok := g.ids[num]
+		if !ok {
+			continue
+		}
+		drop[num] = true
+		delete(g.ids, num)
+		if m := s.articles[id]; m != nil {
+			if m.refs--; m.refs <= 0 {
+				delete(s.articles, id)
+				gone = append(gone, id)
+			}
+		}
+	}
+	kept := make([]int64, 0, len(g.nums))
+	for _, num := range g.nums {
+		if !drop[num] {
+			kept = append(kept, num)
+		}
+	}
+	g.nums = kept
+	g.update(g.info.High)
+	return gone
+}
+
+func (s *Spool) removeFiles(ids []string) {
+	for _, id := range ids {
+		if err := os.Remove(s.articlePath(id)); err != nil && !os.IsNotExist(err) {
+			s.logf("Error removing %s: %v", id, err)
+		}
+	}
+}
+
+// ListGroups returns up to max groups, or all of them if max isn't
+// positive, sorted by name.
+func (s *Spool) ListGroups(max int) ([]*nntp.Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rv := make([]*nntp.Group, 0, len(s.groups))
+	for _, g := range s.groups {
+		info := g.info
+		rv = append(rv, &info)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Name < rv[j].Name })
+	if max > 0 && len(rv) > max {
+		rv = rv[:max]
+	}
+	return rv, nil
+}
+
+// GetGroup returns a copy of the named group.
+func (s *Spool) GetGroup(name string) (*nntp.Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	g, ok := s.groups[name]
+	if !ok {
+		return nil, nntpserver.ErrNoSuchGroup
+	}
+	info := g.info
+	return &info, nil
+}
+
+// readArticle loads an article's file.  The caller must hold s.mu for
+// reading, so the file can't be removed underneath it.
+func (s *Spool) readArticle(id string) (*nntp.Article, error) {
+	m, ok := s.articles[id]
+	if !ok {
+		return nil, nntpserver.ErrInvalidMessageID
+	}
+	data, err := ioutil.ReadFile(s.articlePath(id))
+	if os.IsNotExist(err) {
+		return nil, nntpserver.ErrInvalidMessageID
+	}
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(bytes.NewReader(data))
+	h, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &nntp.Article{
+		Header: h,
+		Body:   br,
+		Bytes:  m.bytes,
+		Lines:  m.lines,
+	}, nil
+}
+
+// GetArticle returns an article by message ID, or by number in the
+// given group.
+func (s *Spool) GetArticle(g *nntp.Group, id string) (*nntp.Article, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if num, err := strconv.ParseInt(id, 10, 64); err == nil {
+		if g == nil {
+			return nil, nntpserver.ErrNoGroupSelected
+		}
+		gs, ok := s.groups[g.Name]
+		if !ok {
+			return nil, nntpserver.ErrNoSuchGroup
+		}
+		msgid, ok := gs.ids[num]
+		if !ok {
+			return nil, nntpserver.ErrInvalidArticleNumber
+		}
+		id = msgid
+	}
+	return s.readArticle(id)
+}
+
+// HasArticle reports whether the Spool has the article with the given
+// message ID.
+func (s *Spool) HasArticle(id string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.articles[id]
+	return ok, nil
+}
+
+// GetArticles returns a group's articles numbered from from to to
+// inclusive, in order.
+func (s *Spool) GetArticles(g *nntp.Group, from, to int64) ([]nntpserver.NumberedArticle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	gs, ok := s.groups[g.Name]
+	if !ok {
+		return nil, nntpserver.ErrNoSuchGroup
+	}
+	rv := []nntpserver.NumberedArticle{}
+	i := sort.Search(len(gs.nums), func(i int) bool { return gs.nums[i] >= from })
+	for ; i < len(gs.nums) && gs.nums[i] <= to; i++ {
+		a, err := s.readArticle(gs.ids[gs.nums[i]])
+		if err != nil {
+			return rv, err
+		}
+		rv = append(rv, nntpserver.NumberedArticle{Num: gs.nums[i], Article: a})
+	}
+	return rv, nil
+}
+
+// EachArticle calls f with each of a group's articles numbered from
+// from to to, in order, stopping with f's error if it returns one.  The
+// spool isn't locked while f runs.
+func (s *Spool) EachArticle(g *nntp.Group, from, to int64, f func(nntpserver.NumberedArticle) error) error {
+	for {
+		num, a, err := s.next(g, from, to)
+		if err != nil || a == nil {
+			return err
+		}
+		if err := f(nntpserver.NumberedArticle{Num: num, Article: a}); err != nil {
+			return err
+		}
+		if num == to {
+			return nil
+		}
+		from = num + 1
+	}
+}
+
+// next loads the first article in a group numbered from from to to.
+func (s *Spool) next(g *nntp.Group, from, to int64) (int64, *nntp.Article, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	gs, ok := s.groups[g.Name]
+	if !ok {
+		return 0, nil, nntpserver.ErrNoSuchGroup
+	}
+	i := sort.Search(len(gs.nums), func(i int) bool { return gs.nums[i] >= from })
+	if i == len(gs.nums) || gs.nums[i] > to {
+		return 0, nil, nil
+	}
+	a, err := s.readArticle(gs.ids[gs.nums[i]])
+	return gs.nums[i], a, err
+}
+
+// GetOverview returns the overview of a group's articles numbered from
+// from to to inclusive, in order.
+func (s *Spool) GetOverview(g *nntp.Group, from, to int64) ([]nntpserver.OverviewRecord, error) {
+	if _, err := s.GetGroup(g.Name); err != nil {
+		return nil, err
+	}
+	return s.overview.GetOverview(g, from, to)
+}
+
+// EachOverview is like GetOverview, but passes the records to f one at
+// a time, stopping with f's error if it returns one.
+func (s *Spool) EachOverview(g *nntp.Group, from, to int64, f func(nntpserver.OverviewRecord) error) error {
+	if _, err := s.GetGroup(g.Name); err != nil {
+		return err
+	}
+	return s.overview.EachOverview(g, from, to, f)
+}
+
+// Authorized returns true: a Spool has no users.
+func (s *Spool) Authorized() bool {
+	return true
+}
+
+// Authenticate always fails.
+func (s *Spool) Authenticate(user, pass string) (nntpserver.Backend, error) {
+	return nil, nntpserver.ErrAuthRejected
+}
+
+// AllowPost returns true.
+func (s *Spool) AllowPost() bool {
+	return true
+}
+
+// Post stores an article in those of its newsgroups that exist,
+// numbering it and setting its Xref header.  Articles without a
+// message ID, already stored, or for no known group are refused.
+func (s *Spool) Post(a *nntp.Article) error {
+	body, err := ioutil.ReadAll(a.Body)
+	if err != nil {
+		return err
+	}
+	id := a.MessageID()
+	if id == "" || strings.ContainsAny(id, " \t\r\n") {
+		return nntpserver.ErrPostingFailed
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if _, ok := s.articles[id]; ok {
+		return nntpserver.ErrPostingFailed
+	}
+	groups := []string{}
+	for _, g := range nntpserver.SplitGroups(a.Header.Get("Newsgroups")) {
+		if _, ok := s.groups[g]; ok {
+			groups = append(groups, g)
+		}
+	}
+	if len(groups) == 0 {
+		return nntpserver.ErrPostingFailed
+	}
+
+	entries := s.numberer.Number(a, groups)
+	path := s.articlePath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	err = s.writeFile(path, func(w io.Writer) error {
+		keys := make([]string, 0, len(a.Header))
+		for k := range a.Header {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, v := range a.Header[k] {
+				if _, err := fmt.Fprintf(w, "%s: %s\r\n", k, v); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := io.WriteString(w, "\r\n"); err != nil {
+			return err
+		}
+		_, err := w.Write(body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	m := &meta{bytes: len(body), lines: bytes.Count(body, []byte{'\n'})}
+	for _, x := range entries {
+		line := fmt.Sprintf("+ %d %s %d %d\n", x.Num, id, m.bytes, m.lines)
+		if err := s.groups[x.Group].appendIndex(line); err != nil {
+			// Groups already written to keep the article; the
+			// file stays for them.
+			s.logf("Error indexing %s in %s: %v", id, x.Group, err)
+			if m.refs == 0 {
+				os.Remove(path)
+				return err
+			}
+			entries = entries[:m.refs]
+			break
+		}
+		m.refs++
+	}
+
+	s.mu.Lock()
+	s.articles[id] = m
+	for _, x := range entries {
+		g := s.groups[x.Group]
+		g.nums = append(g.nums, x.Num)
+		g.ids[x.Num] = id
+		g.update(x.Num)
+	}
+	s.mu.Unlock()
+
+	ov := &nntp.Article{Header: a.Header, Bytes: m.bytes, Lines: m.lines}
+	for _, x := range entries {
+		if err := s.overview.Put(x.Group, nntpserver.NewOverviewRecord(x.Num, ov)); err != nil {
+			s.logf("Error adding %s to the overview: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// unlink logs the removal of articles from a group, takes them out,
+// and removes the files of those no group holds any more.  The caller
+// must hold s.wmu.
+func (s *Spool) unlink(g *group, nums []int64) error {
+	var buf bytes.Buffer
+	for _, num := range nums {
+		if _, ok := g.ids[num]; ok {
+			fmt.Fprintf(&buf, "- %d\n", num)
+		}
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	if err := g.appendIndex(buf.String()); err != nil {
+		return err
+	}
+	if err := s.overview.Remove(g.info.Name, nums...); err != nil {
+		s.logf("Error removing from the overview of %s: %v", g.info.Name, err)
+	}
+	s.mu.Lock()
+	g.dead += 2 * strings.Count(buf.String(), "\n")
+	gone := s.release(g, nums)
+	s.mu.Unlock()
+	s.removeFiles(gone)
+	return nil
+}
+
+// DeleteArticle removes an article from every group.
+func (s *Spool) DeleteArticle(id string) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if _, ok := s.articles[id]; !ok {
+		return nntpserver.ErrInvalidMessageID
+	}
+	for _, g := range s.groups {
+		nums := []int64{}
+		for _, num := range g.nums {
+			if g.ids[num] == id {
+				nums = append(nums, num)
+			}
+		}
+		if err := s.unlink(g, nums); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExpireArticles removes the given numbers from a group.  Articles
+// crossposted elsewhere stay there.
+func (s *Spool) ExpireArticles(info *nntp.Group, nums []int64) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	g, ok := s.groups[info.Name]
+	if !ok {
+		return nntpserver.ErrNoSuchGroup
+	}
+	return s.unlink(g, nums)
+}
+
+// Compact rewrites the indexes that have removed entries, and removes
+// article files no index refers to.
+func (s *Spool) Compact() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	for name, g := range s.groups {
+		if g.dead == 0 {
+			continue
+		}
+		err := s.writeFile(s.indexPath(name), func(w io.Writer) error {
+			if _, err := fmt.Fprintf(w, "= %d\n", g.info.High); err != nil {
+				return err
+			}
+			for _, num := range g.nums {
+				id := g.ids[num]
+				m := s.articles[id]
+				if _, err := fmt.Fprintf(w, "+ %d %s %d %d\n", num, id, m.bytes, m.lines); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(s.indexPath(name), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		g.idx.Close()
+		g.idx = f
+		g.dead = 0
+	}
+
+	if err := s.overview.Compact(); err != nil {
+		return err
+	}
+
+	live := make(map[string]bool, len(s.articles))
+	for id := range s.articles {
+		live[filepath.Base(s.articlePath(id))] = true
+	}
+	return filepath.Walk(filepath.Join(s.dir, "articles"), func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || live[fi.Name()] {
+			return err
+		}
+		s.logf("Removing unreferenced article file %s", path)
+		return os.Remove(path)
+	})
+}
+
+// Run compacts the spool every interval until stop is closed.
+func (s *Spool) Run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		if err := s.Compact(); err != nil {
+			s.logf("Error compacting spool: %v", err)
+		}
+	}
+}
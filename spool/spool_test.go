@@ -0,0 +1,233 @@
+package spool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dustin/go-nntp"
+	"github.com/dustin/go-nntp/server"
+)
+
+func testArticle(id, groups, body string) *nntp.Article {
+	return &nntp.Article{
+		Header: textproto.MIMEHeader{
+			"Message-Id": {id},
+			"Newsgroups": {groups},
+			"Subject":    {"test"},
+		},
+		Body: strings.NewReader(body),
+	}
+}
+
+func openSpool(t *testing.T, dir string) *Spool {
+	t.Helper()
+	s, err := Open(dir, "test.example.com")
+	if err != nil {
+		t.Fatalf("Error opening spool: %v", err)
+	}
+	return s
+}
+
+func checkGroup(t *testing.T, s *Spool, name string, count, low, high int64) {
+	t.Helper()
+	g, err := s.GetGroup(name)
+	if err != nil {
+		t.Fatalf("Error getting %v: %v", name, err)
+	}
+	if g.Count != count || g.Low != low || g.High != high {
+		t.Errorf("%v: count=%d low=%d high=%d, wanted %d %d %d",
+			name, g.Count, g.Low, g.High, count, low, high)
+	}
+}
+
+func countFiles(t *testing.T, dir string) int {
+	n := 0
+	filepath.Walk(filepath.Join(dir, "articles"), func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	return dir
+}
+
+func TestSpool(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openSpool(t, dir)
+	for _, g := range []string{"a.test", "b.test"} {
+		if err := s.CreateGroup(&nntp.Group{Name: g, Description: "Testing " + g}); err != nil {
+			t.Fatalf("Error creating %v: %v", g, err)
+		}
+	}
+	for _, a := range []*nntp.Article{
+		testArticle("<1@x>", "a.test", "one\n"),
+		testArticle("<2@x>", "a.test,b.test", "two\nlines\n"),
+		testArticle("<3@x>", "b.test", "three\n"),
+	} {
+		if err := s.Post(a); err != nil {
+			t.Fatalf("Error posting %v: %v", a.MessageID(), err)
+		}
+	}
+	if err := s.Post(testArticle("<1@x>", "a.test", "again")); err != nntpserver.ErrPostingFailed {
+		t.Errorf("Expected duplicate refused, got %v", err)
+	}
+	if n := countFiles(t, dir); n != 3 {
+		t.Errorf("Expected 3 article files, got %d", n)
+	}
+	s.Close()
+
+	// A crash mid-append leaves a torn line, which is ignored.
+	f, _ := os.OpenFile(filepath.Join(dir, "groups", "a.test"), os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString("+ 3 <torn@x")
+	f.Close()
+	// The overview is rebuilt if lost.
+	os.RemoveAll(filepath.Join(dir, "overview"))
+
+	s = openSpool(t, dir)
+	defer s.Close()
+	checkGroup(t, s, "a.test", 2, 1, 2)
+	checkGroup(t, s, "b.test", 2, 1, 2)
+
+	g, _ := s.GetGroup("b.test")
+	if g.Description != "Testing b.test" {
+		t.Errorf("Description = %q", g.Description)
+	}
+	a, err := s.GetArticle(g, "1")
+	if err != nil {
+		t.Fatalf("Error getting article: %v", err)
+	}
+	body, _ := ioutil.ReadAll(a.Body)
+	if a.MessageID() != "<2@x>" || string(body) != "two\nlines\n" || a.Bytes != 10 || a.Lines != 2 {
+		t.Errorf("Got %v %q %d %d", a.MessageID(), body, a.Bytes, a.Lines)
+	}
+	if x := a.Header.Get("Xref"); x != "test.example.com a.test:2 b.test:1" {
+		t.Errorf("Xref = %q", x)
+	}
+	ov, err := s.GetOverview(g, 1, 2)
+	if err != nil || len(ov) != 2 || ov[0].MessageID != "<2@x>" || ov[1].Lines != 1 {
+		t.Errorf("GetOverview = %+v, %v", ov, err)
+	}
+	if _, err := s.GetArticle(g, "5"); err != nntpserver.ErrInvalidArticleNumber {
+		t.Errorf("Expected missing number, got %v", err)
+	}
+
+	// Numbering carries on after reopening.
+	if err := s.Post(testArticle("<4@x>", "a.test", "four\n")); err != nil {
+		t.Fatalf("Error posting: %v", err)
+	}
+	checkGroup(t, s, "a.test", 3, 1, 3)
+	articles, _ := s.GetArticles(g, 0, 10)
+	if len(articles) != 2 || articles[0].Num != 1 || articles[1].Num != 2 {
+		t.Errorf("GetArticles = %v", articles)
+	}
+}
+
+func TestSpoolRemoval(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openSpool(t, dir)
+	s.CreateGroup(&nntp.Group{Name: "a.test"})
+	s.CreateGroup(&nntp.Group{Name: "b.test"})
+	s.Post(testArticle("<1@x>", "a.test,b.test", "one"))
+	s.Post(testArticle("<2@x>", "a.test", "two"))
+	s.Post(testArticle("<3@x>", "a.test", "three"))
+
+	g, _ := s.GetGroup("a.test")
+	if err := s.ExpireArticles(g, []int64{1, 2}); err != nil {
+		t.Fatalf("Error expiring: %v", err)
+	}
+	checkGroup(t, s, "a.test", 1, 3, 3)
+	// Still in b.test.
+	if _, err := s.GetArticle(nil, "<1@x>"); err != nil {
+		t.Errorf("Crossposted article lost: %v", err)
+	}
+	if err := s.DeleteArticle("<1@x>"); err != nil {
+		t.Fatalf("Error deleting: %v", err)
+	}
+	checkGroup(t, s, "b.test", 0, 2, 1)
+	if n := countFiles(t, dir); n != 1 {
+		t.Errorf("Expected 1 article file, got %d", n)
+	}
+
+	// An article file written just before a crash.
+	orphan := filepath.Join(dir, "articles", "00", "00orphan")
+	os.MkdirAll(filepath.Dir(orphan), 0755)
+	ioutil.WriteFile(orphan, []byte("Message-ID: <orphan@x>\r\n\r\n"), 0644)
+
+	if err := s.Compact(); err != nil {
+		t.Fatalf("Error compacting: %v", err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("Orphan survived compaction: %v", err)
+	}
+	idx, _ := ioutil.ReadFile(filepath.Join(dir, "groups", "a.test"))
+	if string(idx) != "= 3\n+ 3 <3@x> 5 0\n" {
+		t.Errorf("Compacted index = %q", idx)
+	}
+
+	if err := s.RemoveGroup("b.test"); err != nil {
+		t.Fatalf("Error removing group: %v", err)
+	}
+	s.Close()
+
+	s = openSpool(t, dir)
+	defer s.Close()
+	if groups, _ := s.ListGroups(-1); len(groups) != 1 {
+		t.Errorf("Expected one group, got %v", groups)
+	}
+	checkGroup(t, s, "a.test", 1, 3, 3)
+	s.Post(testArticle("<4@x>", "a.test", "four"))
+	checkGroup(t, s, "a.test", 2, 3, 4)
+}
+
+func TestSpoolConcurrentUse(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openSpool(t, dir)
+	defer s.Close()
+	s.CreateGroup(&nntp.Group{Name: "a.test"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				s.Post(testArticle(fmt.Sprintf("<%d.%d@x>", i, j), "a.test", "body\n"))
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				g, _ := s.GetGroup("a.test")
+				articles, err := s.GetArticles(g, g.Low, g.High)
+				if err != nil {
+					t.Errorf("Error reading articles: %v", err)
+				}
+				for _, a := range articles {
+					ioutil.ReadAll(a.Article.Body)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	checkGroup(t, s, "a.test", 40, 1, 40)
+}
@@ -0,0 +1,435 @@
+// Package union provides an nntpserver.Backend serving the groups of
+// several backends as one, e.g. local groups kept in a spool alongside
+// public groups from a proxy.
+//
+// Each group belongs to one member backend: the first whose Groups
+// wildmat matches its name, or, among members without one, the first
+// that has it.  Requests about a group go to its owner.  Articles looked
+// up by message ID are looked for in each member in turn, among the
+// groups it owns, and a crossposted article is posted to each member
+// owning one of its newsgroups, naming only those in its Newsgroups.
+package union
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-nntp"
+	"github.com/dustin/go-nntp/server"
+)
+
+// ErrUnsupported is returned for a request that the member owning the
+// group can't carry out, such as creating a group in a backend that
+// isn't an nntpserver.GroupCreator.
+var ErrUnsupported = errors.New("union: member backend does not support this")
+
+// A Member is one of a Union's backends.
+type Member struct {
+	// Groups is a wildmat selecting the groups the backend owns.  If
+	// empty, it owns the groups it has that no earlier member owns.
+	Groups  string
+	Backend nntpserver.Backend
+}
+
+func (m *Member) claims(name string) bool {
+	return m.Groups != "" && nntp.MatchWildmat(m.Groups, name)
+}
+
+// A Union is a Backend combining its members' groups.  It is safe for
+// concurrent use.
+//
+// Besides Backend, a Union implements nntpserver.OverviewBackend,
+// OverviewStreamer, ArticleStreamer, ArticleDeleter, GroupCreator,
+// GroupRemover and ArticleExpirer, passing requests on to the owning
+// member.
+type Union struct {
+	Members []Member
+
+	mu sync.Mutex
+	// The members found to own groups by having them, by name.
+	found map[string]int
+}
+
+// New builds a Union of the given members, in order of precedence.
+func New(members ...Member) *Union {
+	return &Union{Members: members}
+}
+
+// owner returns the index of the member owning the named group, and
+// the group if finding the owner meant fetching it.  Groups not owned
+// by any member are reported missing.
+func (u *Union) owner(name string) (int, *nntp.Group, error) {
+	u.mu.Lock()
+	i, ok := u.found[name]
+	u.mu.Unlock()
+	if ok {
+		return i, nil, nil
+	}
+	for i := range u.Members {
+		m := &u.Members[i]
+		if m.claims(name) {
+			return i, nil, nil
+		}
+		if m.Groups != "" {
+			continue
+		}
+		if g, err := m.Backend.GetGroup(name); err == nil {
+			u.mu.Lock()
+			if u.found == nil {
+				u.found = map[string]int{}
+			}
+			u.found[name] = i
+			u.mu.Unlock()
+			return i, g, nil
+		}
+	}
+	return -1, nil, nntpserver.ErrNoSuchGroup
+}
+
+// forget drops what's known about which member has a group.
+func (u *Union) forget(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.found, name)
+}
+
+func (u *Union) backend(name string) (nntpserver.Backend, error) {
+	i, _, err := u.owner(name)
+	if err != nil {
+		return nil, err
+	}
+	return u.Members[i].Backend, nil
+}
+
+// owns reports whether the member with the given index would own the
+// named group if it had it.
+func (u *Union) owns(i int, name string) bool {
+	if u.Members[i].Groups != "" && !u.Members[i].claims(name) {
+		return false
+	}
+	for j := 0; j < i; j++ {
+		if u.Members[j].claims(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// ListGroups merges the members' lists, sorted by name.  Groups a
+// member has but doesn't own are left out.
+func (u *Union) ListGroups(max int) ([]*nntp.Group, error) {
+	seen := map[string]bool{}
+	rv := []*nntp.Group{}
+	for i := range u.Members {
+		groups, err := u.Members[i].Backend.ListGroups(-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			if !seen[g.Name] && u.owns(i, g.Name) {
+				seen[g.Name] = true
+				rv = append(rv, g)
+			}
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Name < rv[j].Name })
+	if max > 0 && len(rv) > max {
+		rv = rv[:max]
+	}
+	return rv, nil
+}
+
+// GetGroup fetches a group from its owner.
+func (u *Union) GetGroup(name string) (*nntp.Group, error) {
+	i, g, err := u.owner(name)
+	if err != nil || g != nil {
+		return g, err
+	}
+	g, err = u.Members[i].Backend.GetGroup(name)
+	if err != nil && u.Members[i].Groups == "" {
+		// It may have moved to another member.
+		u.forget(name)
+		if i, g, err = u.owner(name); err == nil && g == nil {
+			return u.Members[i].Backend.GetGroup(name)
+		}
+	}
+	return g, err
+}
+
+// GetArticle fetches an article by number from the group's owner, or
+// by message ID from the first member that has it.
+func (u *Union) GetArticle(group *nntp.Group, id string) (*nntp.Article, error) {
+	if !strings.HasPrefix(id, "<") {
+		if group == nil {
+			return nil, nntpserver.ErrNoGroupSelected
+		}
+		b, err := u.backend(group.Name)
+		if err != nil {
+			return nil, err
+		}
+		return b.GetArticle(group, id)
+	}
+	for i, m := range u.Members {
+		a, err := m.Backend.GetArticle(group, id)
+		if err != nil {
+			continue
+		}
+		for _, name := range nntpserver.SplitGroups(a.Header.Get("Newsgroups")) {
+			if u.owns(i, name) {
+				return a, nil
+			}
+		}
+	}
+	return nil, nntpserver.ErrInvalidMessageID
+}
+
+// GetArticles fetches a group's articles from its owner.
+func (u *Union) GetArticles(group *nntp.Group, from, to int64) ([]nntpserver.NumberedArticle, error) {
+	b, err := u.backend(group.Name)
+	if err != nil {
+		return nil, err
+	}
+	return b.GetArticles(group, from, to)
+}
+
+// EachArticle passes a group's articles to f, streaming them from its
+// owner if it can.
+func (u *Union) EachArticle(group *nntp.Group, from, to int64, f func(nntpserver.NumberedArticle) error) error {
+	b, err := u.backend(group.Name)
+	if err != nil {
+		return err
+	}
+	if as, ok := b.(nntpserver.ArticleStreamer); ok {
+		return as.EachArticle(group, from, to, f)
+	}
+	articles, err := b.GetArticles(group, from, to)
+	if err != nil {
+		return err
+	}
+	for _, a := range articles {
+		if err := f(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EachOverview passes the overview of a group's articles to f, using
+// the cheapest way its owner offers.
+func (u *Union) EachOverview(group *nntp.Group, from, to int64, f func(nntpserver.OverviewRecord) error) error {
+	b, err := u.backend(group.Name)
+	if err != nil {
+		return err
+	}
+	switch ob := b.(type) {
+	case nntpserver.OverviewStreamer:
+		return ob.EachOverview(group, from, to, f)
+	case nntpserver.OverviewBackend:
+		records, err := ob.GetOverview(group, from, to)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			if err := f(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return u.EachArticle(group, from, to, func(a nntpserver.NumberedArticle) error {
+		return f(nntpserver.NewOverviewRecord(a.Num, a.Article))
+	})
+}
+
+// GetOverview returns the overview of a group's articles.
+func (u *Union) GetOverview(group *nntp.Group, from, to int64) ([]nntpserver.OverviewRecord, error) {
+	rv := []nntpserver.OverviewRecord{}
+	err := u.EachOverview(group, from, to, func(r nntpserver.OverviewRecord) error {
+		rv = append(rv, r)
+		return nil
+	})
+	return rv, err
+}
+
+// Authorized reports whether every member is.
+func (u *Union) Authorized() bool {
+	for _, m := range u.Members {
+		if !m.Backend.Authorized() {
+			return false
+		}
+	}
+	return true
+}
+
+// Authenticate tries the credentials with every member, and succeeds
+// if any accepts them.  The Union returned uses the Backends those
+// members return in their place.
+func (u *Union) Authenticate(user, pass string) (nntpserver.Backend, error) {
+	members := make([]Member, len(u.Members))
+	copy(members, u.Members)
+	var firstErr error
+	accepted := false
+	for i, m := range members {
+		b, err := m.Backend.Authenticate(user, pass)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		accepted = true
+		if b != nil {
+			members[i].Backend = b
+		}
+	}
+	if !accepted {
+		if firstErr == nil {
+			firstErr = nntpserver.ErrAuthRejected
+		}
+		return nil, firstErr
+	}
+	return New(members...), nil
+}
+
+// AllowPost reports whether any member allows posting.
+func (u *Union) AllowPost() bool {
+	for _, m := range u.Members {
+		if m.Backend.AllowPost() {
+			return true
+		}
+	}
+	return false
+}
+
+// Post posts an article to each member owning one of its newsgroups,
+// with its Newsgroups header naming only the groups that member owns,
+// so that a member doesn't file it in groups it has but doesn't own.
+// It succeeds if any of them takes the article.
+func (u *Union) Post(article *nntp.Article) error {
+	owners := []int{}
+	groups := map[int][]string{}
+	for _, name := range nntpserver.SplitGroups(article.Header.Get("Newsgroups")) {
+		if i, _, err := u.owner(name); err == nil {
+			if _, ok := groups[i]; !ok {
+				owners = append(owners, i)
+			}
+			groups[i] = append(groups[i], name)
+		}
+	}
+	if len(owners) == 0 {
+		return nntpserver.ErrPostingFailed
+	}
+
+	var body []byte
+	if len(owners) > 1 {
+		var err error
+		if body, err = ioutil.ReadAll(article.Body); err != nil {
+			return err
+		}
+	}
+	var firstErr error
+	posted := false
+	for _, i := range owners {
+		h := make(textproto.MIMEHeader, len(article.Header))
+		for k, v := range article.Header {
+			h[k] = append([]string(nil), v...)
+		}
+		h.Set("Newsgroups", strings.Join(groups[i], ","))
+		a := &nntp.Article{
+			Header: h,
+			Body:   article.Body,
+			Bytes:  article.Bytes,
+			Lines:  article.Lines,
+		}
+		if body != nil {
+			a.Body = bytes.NewReader(body)
+		}
+		err := u.Members[i].Backend.Post(a)
+		if err == nil {
+			posted = true
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if posted {
+		return nil
+	}
+	return firstErr
+}
+
+// DeleteArticle removes an article from every member that can remove
+// articles.  It succeeds if any of them did.
+func (u *Union) DeleteArticle(id string) error {
+	err := error(ErrUnsupported)
+	deleted := false
+	for _, m := range u.Members {
+		if d, ok := m.Backend.(nntpserver.ArticleDeleter); ok {
+			if derr := d.DeleteArticle(id); derr == nil {
+				deleted = true
+			} else {
+				err = derr
+			}
+		}
+	}
+	if deleted {
+		return nil
+	}
+	return err
+}
+
+// CreateGroup creates a group in the member that would own it: the
+// first whose wildmat matches the name, or else the first without a
+// wildmat.
+func (u *Union) CreateGroup(group *nntp.Group) error {
+	i, _, err := u.owner(group.Name)
+	if err != nil {
+		i = -1
+		for j := range u.Members {
+			if u.Members[j].Groups == "" {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			return err
+		}
+	}
+	gc, ok := u.Members[i].Backend.(nntpserver.GroupCreator)
+	if !ok {
+		return ErrUnsupported
+	}
+	u.forget(group.Name)
+	return gc.CreateGroup(group)
+}
+
+// RemoveGroup removes a group from its owner.
+func (u *Union) RemoveGroup(name string) error {
+	b, err := u.backend(name)
+	if err != nil {
+		return err
+	}
+	gr, ok := b.(nntpserver.GroupRemover)
+	if !ok {
+		return ErrUnsupported
+	}
+	u.forget(name)
+	return gr.RemoveGroup(name)
+}
+
+// ExpireArticles removes articles from a group in its owner.
+func (u *Union) ExpireArticles(group *nntp.Group, nums []int64) error {
+	b, err := u.backend(group.Name)
+	if err != nil {
+		return err
+	}
+	ae, ok := b.(nntpserver.ArticleExpirer)
+	if !ok {
+		return nntpserver.ErrExpiryUnsupported
+	}
+	return ae.ExpireArticles(group, nums)
+}
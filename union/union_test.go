@@ -0,0 +1,143 @@
+package union
+
+import (
+	"io/ioutil"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-nntp"
+	"github.com/dustin/go-nntp/memstore"
+	"github.com/dustin/go-nntp/server"
+)
+
+func testArticle(id, groups string) *nntp.Article {
+	return &nntp.Article{
+		Header: textproto.MIMEHeader{
+			"Message-Id": {id},
+			"Newsgroups": {groups},
+			"Subject":    {"test"},
+		},
+		Body: strings.NewReader("body of " + id + "\n"),
+	}
+}
+
+func newStore(groups ...string) *memstore.Store {
+	s := memstore.New("test.example.com")
+	for _, g := range groups {
+		s.CreateGroup(&nntp.Group{Name: g, Posting: nntp.PostingPermitted})
+	}
+	return s
+}
+
+func names(groups []*nntp.Group) string {
+	rv := []string{}
+	for _, g := range groups {
+		rv = append(rv, g.Name)
+	}
+	return strings.Join(rv, " ")
+}
+
+func TestUnion(t *testing.T) {
+	// The local store has a stray public group, which it doesn't own.
+	local := newStore("local.chat", "local.admin", "comp.lang.go")
+	public := newStore("comp.lang.go", "misc.test", "local.hidden")
+	u := New(
+		Member{Groups: "local.*", Backend: local},
+		Member{Backend: public},
+	)
+
+	groups, err := u.ListGroups(-1)
+	if err != nil {
+		t.Fatalf("Error listing groups: %v", err)
+	}
+	if got := names(groups); got != "comp.lang.go local.admin local.chat misc.test" {
+		t.Errorf("ListGroups = %v", got)
+	}
+	if _, err := u.GetGroup("local.hidden"); err != nntpserver.ErrNoSuchGroup {
+		t.Errorf("Expected local.hidden hidden, got %v", err)
+	}
+
+	// A crosspost goes to both stores.
+	if err := u.Post(testArticle("<1@x>", "local.chat,misc.test")); err != nil {
+		t.Fatalf("Error posting: %v", err)
+	}
+	if err := u.Post(testArticle("<2@x>", "comp.lang.go")); err != nil {
+		t.Fatalf("Error posting: %v", err)
+	}
+	if err := u.Post(testArticle("<3@x>", "no.such")); err != nntpserver.ErrPostingFailed {
+		t.Errorf("Expected a post to no known group refused, got %v", err)
+	}
+	for name, count := range map[string]int64{"local.chat": 1, "misc.test": 1, "comp.lang.go": 1} {
+		g, err := u.GetGroup(name)
+		if err != nil || g.Count != count {
+			t.Errorf("%v: %+v, %v", name, g, err)
+		}
+	}
+	if g, _ := local.GetGroup("comp.lang.go"); g.Count != 0 {
+		t.Errorf("Post went to a group the member doesn't own")
+	}
+
+	// Each member sees only its own groups of a crosspost.
+	if err := u.Post(testArticle("<4@x>", "local.chat,comp.lang.go")); err != nil {
+		t.Fatalf("Error crossposting: %v", err)
+	}
+	if g, _ := local.GetGroup("comp.lang.go"); g.Count != 0 {
+		t.Errorf("Crosspost filed in a group the member doesn't own")
+	}
+	if g, _ := public.GetGroup("comp.lang.go"); g.Count != 2 {
+		t.Errorf("Crosspost not filed in its owner's group: %+v", g)
+	}
+	if a, _ := local.GetArticle(nil, "<4@x>"); a == nil || a.Header.Get("Newsgroups") != "local.chat" {
+		t.Errorf("Local copy of the crosspost: %v", a)
+	}
+	if a, _ := public.GetArticle(nil, "<4@x>"); a == nil || a.Header.Get("Newsgroups") != "comp.lang.go" {
+		t.Errorf("Public copy of the crosspost: %v", a)
+	}
+
+	// Articles in groups a member doesn't own aren't served.
+	public.Post(testArticle("<5@x>", "local.hidden"))
+	if _, err := u.GetArticle(nil, "<5@x>"); err != nntpserver.ErrInvalidMessageID {
+		t.Errorf("Got an article from a hidden group: %v", err)
+	}
+
+	g, _ := u.GetGroup("comp.lang.go")
+	a, err := u.GetArticle(g, "1")
+	if err != nil || a.MessageID() != "<2@x>" {
+		t.Fatalf("GetArticle by number = %v, %v", a, err)
+	}
+	body, _ := ioutil.ReadAll(a.Body)
+	if string(body) != "body of <2@x>\n" {
+		t.Errorf("Body = %q", body)
+	}
+	// Only the public store has <2@x>.
+	if a, err := u.GetArticle(nil, "<2@x>"); err != nil || a.MessageID() != "<2@x>" {
+		t.Errorf("GetArticle by message ID = %v, %v", a, err)
+	}
+	if _, err := u.GetArticle(nil, "<9@x>"); err != nntpserver.ErrInvalidMessageID {
+		t.Errorf("Expected no such article, got %v", err)
+	}
+	if recs, err := u.GetOverview(g, 1, 1); err != nil || len(recs) != 1 || recs[0].MessageID != "<2@x>" {
+		t.Errorf("GetOverview = %+v, %v", recs, err)
+	}
+
+	// New groups go to the member that would own them.
+	u.CreateGroup(&nntp.Group{Name: "local.new"})
+	u.CreateGroup(&nntp.Group{Name: "rec.new"})
+	if _, err := local.GetGroup("local.new"); err != nil {
+		t.Errorf("local.new not created locally: %v", err)
+	}
+	if _, err := public.GetGroup("rec.new"); err != nil {
+		t.Errorf("rec.new not created publicly: %v", err)
+	}
+
+	if err := u.DeleteArticle("<1@x>"); err != nil {
+		t.Fatalf("Error deleting: %v", err)
+	}
+	// Only the crosspost is left.
+	for name, count := range map[string]int64{"local.chat": 1, "misc.test": 0} {
+		if g, _ := u.GetGroup(name); g.Count != count {
+			t.Errorf("%v has %d articles, wanted %d", name, g.Count, count)
+		}
+	}
+}
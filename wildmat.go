@@ -0,0 +1,110 @@
+package nntp
+
+import "strings"
+
+// MatchWildmat reports whether s matches the RFC 3977 wildmat w.
+//
+// A wildmat is a comma-separated list of patterns, each optionally
+// preceded by "!" to negate it.  The rightmost pattern that matches s
+// decides the result.  Within a pattern "*" matches any run of
+// characters, "?" any single character and "[...]" a character class,
+// which may be negated with "^" or "!".  A backslash escapes the next
+// character.
+func MatchWildmat(w, s string) bool {
+	rv := false
+	for _, p := range strings.Split(w, ",") {
+		p = strings.TrimSpace(p)
+		negate := false
+		if strings.HasPrefix(p, "!") {
+			negate = true
+			p = p[1:]
+		}
+		if matchPattern(p, s) {
+			rv = !negate
+		}
+	}
+	return rv
+}
+
+func matchPattern(p, s string) bool {
+	for len(p) > 0 {
+		switch p[0] {
+		case '*':
+			for len(p) > 0 && p[0] == '*' {
+				p = p[1:]
+			}
+			if len(p) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(p, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			n, ok := matchClass(p, s[0])
+			if !ok {
+				return false
+			}
+			p = p[n:]
+			s = s[1:]
+			continue
+		case '\\':
+			if len(p) > 1 {
+				p = p[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || p[0] != s[0] {
+				return false
+			}
+		}
+		p = p[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+// matchClass matches c against the character class at the start of p,
+// returning the length of the class.  An unterminated class only
+// matches a literal "[".
+func matchClass(p string, c byte) (int, bool) {
+	end := strings.IndexByte(p[1:], ']')
+	if end == 0 {
+		// "]" first in the class is literal.
+		if e := strings.IndexByte(p[2:], ']'); e >= 0 {
+			end = e + 1
+		} else {
+			end = -1
+		}
+	}
+	if end < 0 {
+		return 1, c == '['
+	}
+	class := p[1 : end+1]
+	negate := false
+	if len(class) > 0 && (class[0] == '^' || class[0] == '!') {
+		negate = true
+		class = class[1:]
+	}
+	found := false
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			if class[i] <= c && c <= class[i+2] {
+				found = true
+			}
+			i += 2
+		} else if class[i] == c {
+			found = true
+		}
+	}
+	return end + 2, found != negate
+}
@@ -0,0 +1,31 @@
+package nntp
+
+import "testing"
+
+func TestMatchWildmat(t *testing.T) {
+	tests := []struct {
+		w, s string
+		exp  bool
+	}{
+		{"*", "comp.lang.go", true},
+		{"comp.*", "comp.lang.go", true},
+		{"comp.*", "comp", false},
+		{"comp.*,!comp.binaries.*", "comp.binaries.misc", false},
+		{"comp.*,!comp.binaries.*", "comp.lang.go", true},
+		{"!comp.binaries.*,comp.*", "comp.binaries.misc", true},
+		{"misc.tes?", "misc.test", true},
+		{"misc.tes?", "misc.tes", false},
+		{"alt.[a-c]*", "alt.binaries", true},
+		{"alt.[^a-c]*", "alt.binaries", false},
+		{"alt.[]x]", "alt.]", true},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"", "anything", false},
+	}
+	for _, test := range tests {
+		if got := MatchWildmat(test.w, test.s); got != test.exp {
+			t.Errorf("MatchWildmat(%q, %q) = %v, wanted %v",
+				test.w, test.s, got, test.exp)
+		}
+	}
+}